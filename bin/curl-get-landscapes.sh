@@ -0,0 +1,3 @@
+#!/usr/bin/env bash
+
+curl -iLs -G 'http://localhost:5000/api/v1/landscapes' --data-urlencode "selector=${1:-}" -X GET
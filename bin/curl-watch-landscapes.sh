@@ -0,0 +1,3 @@
+#!/usr/bin/env bash
+
+curl -iLsN 'http://localhost:5000/api/v1/landscapes/watch' -X GET -H "Accept: text/event-stream" ${1:+-H "Last-Event-ID: $1"}
@@ -1,16 +1,22 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
-
 	"os"
+	"os/signal"
+	"syscall"
 
+	"github.com/sklevenz/lookup-broker/config"
+	"github.com/sklevenz/lookup-broker/jws"
+	"github.com/sklevenz/lookup-broker/landscape"
 	"github.com/sklevenz/lookup-broker/server"
-)
-
-const (
-	defaultPort = "5000"
+	"github.com/sklevenz/lookup-broker/store"
 )
 
 var (
@@ -21,21 +27,125 @@ var (
 )
 
 func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = defaultPort
+// serve runs the broker until SIGTERM or interrupt
+func serve(flags *flag.FlagSet, args []string, stdout io.Writer) error {
+	cfg, err := config.LoadFlags(flags, args)
+	if err != nil {
+		return err
 	}
+	port := cfg.Port
 
 	log.Printf("start application on port: %v", port)
 	log.Printf("version: %v", Version)
 	log.Printf("commit: %v", Commit)
+	cfg.Print()
+
+	brokerStore, err := openStore(cfg)
+	if err != nil {
+		return err
+	}
+
+	sources := append(landscape.NewSources(cfg.LandscapeSources()), store.LandscapeSource{Store: brokerStore})
+	registry := landscape.NewRegistry(sources...)
+
+	options := []server.Option{
+		server.WithRegistry(registry),
+		server.WithStore(brokerStore),
+		server.WithAdminCredentials(cfg.AdminUsername, cfg.AdminPassword),
+		server.WithConfig(cfg),
+		server.WithUnknownFields(server.UnknownFieldPolicy(cfg.UnknownFields)),
+		server.WithOperationTimeout(cfg.OperationTimeout),
+		server.WithOrphanAge(cfg.OrphanAge),
+		server.WithBindingLifetimes(cfg.BindingLifetimes),
+		server.WithWebhookDeniedNetworks(cfg.WebhookDeniedNetworks),
+		server.WithRateLimit(cfg.RateLimit, cfg.RateLimitBurst),
+		server.WithTrustedProxies(cfg.TrustedProxies),
+		server.WithMaxBodySize(cfg.MaxBodySize),
+		server.WithMaxImportSize(cfg.MaxImportSize),
+	}
+
+	var tlsConfig *tls.Config
+	if cfg.TLSCertFile != "" {
+		tlsConfig, err = server.NewTLSConfig(cfg.TLSCertFile, cfg.TLSKeyFile, cfg.TLSClientCAFile)
+		if err != nil {
+			return fmt.Errorf("could not configure TLS: %v", err)
+		}
+	}
+	if cfg.TLSClientCAFile != "" {
+		options = append(options, server.WithClientCertificates(cfg.TLSClientPlatforms))
+	}
+	if cfg.SigningKeyFile != "" {
+		signer, err := jws.LoadSigner(cfg.SigningKeyFile)
+		if err != nil {
+			return fmt.Errorf("could not load credentials signing key: %v", err)
+		}
+		options = append(options, server.WithCredentialsSigner(signer), server.WithCredentialsIssuer(cfg.Issuer))
+	}
 
-	brokerServer := server.New()
+	brokerServer := server.New(options...)
 
-	log.Printf("call server: http://localhost:%v", port)
+	if err := registry.Reload(); err != nil {
+		log.Printf("Error: could not load landscapes: %v", err)
+	}
+	registry.Start(cfg.LandscapesPoll)
+
+	httpServer := &http.Server{
+		Addr:         ":" + port,
+		Handler:      brokerServer,
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+		IdleTimeout:  cfg.IdleTimeout,
+		TLSConfig:    tlsConfig,
+	}
+	httpServer.RegisterOnShutdown(brokerServer.Drain)
+
+	stopped := make(chan error, 1)
+	go func() {
+		if tlsConfig != nil {
+			log.Printf("call server: https://localhost:%v", port)
+			stopped <- httpServer.ListenAndServeTLS("", "")
+			return
+		}
+		log.Printf("call server: http://localhost:%v", port)
+		stopped <- httpServer.ListenAndServe()
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+
+	var result error
+	select {
+	case err := <-stopped:
+		result = fmt.Errorf("could not listen on port %v: %v", port, err)
+	case sig := <-signals:
+		log.Printf("received %v, shutting down", sig)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	if err := httpServer.Shutdown(ctx); err != nil {
+		log.Printf("Error: could not drain connections: %v", err)
+	}
+	registry.Stop()
+
+	closed := make(chan struct{})
+	go func() {
+		brokerServer.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-ctx.Done():
+		log.Printf("Error: shutdown timeout, pending webhook deliveries are dropped")
+	}
 
-	if err := http.ListenAndServe(":"+port, brokerServer); err != nil {
-		log.Fatalf("could not listen on port %v: %v", port, err)
+	if err := brokerStore.Close(); err != nil && result == nil {
+		result = fmt.Errorf("could not flush store: %v", err)
 	}
+	log.Printf("shutdown complete")
+	return result
 }
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sklevenz/lookup-broker/config"
+	"github.com/sklevenz/lookup-broker/landscape"
+	"github.com/sklevenz/lookup-broker/server"
+	"github.com/sklevenz/lookup-broker/store"
+)
+
+const (
+	programName    string = "lookup-broker"
+	defaultCommand string = "serve"
+)
+
+type command struct {
+	name  string
+	args  string
+	usage string
+	run   func(flags *flag.FlagSet, args []string, stdout io.Writer) error
+}
+
+var commands = []command{
+	{name: "serve", usage: "run the broker", run: serve},
+	{name: "validate-landscapes", args: "[file ...]", usage: "validate landscape files or the configured landscape sources", run: validateLandscapes},
+	{name: "print-catalog", usage: "print the service catalog", run: printCatalog},
+	{name: "lookup", args: "--labels <selector>", usage: "print the configured landscapes matching a label selector", run: lookup},
+	{name: "export-store", args: "[file]", usage: "export instances, bindings and landscapes of the configured store", run: exportStore},
+	{name: "import-store", args: "[-dry-run] <file>", usage: "import an export into the configured store", run: importStore},
+	{name: "backup-store", args: "<file>", usage: "copy the configured bbolt store to a file", run: backupStore},
+	{name: "compact-store", usage: "release the space of deleted entries of the configured bbolt store", run: compactStore},
+	{name: "orphans", args: "[-purge]", usage: "report or delete instances and bindings the platform lost track of", run: orphans},
+	{name: "version", usage: "print version and commit", run: version},
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintf(w, "usage: %v <command> [flags]\n\ncommands:\n", programName)
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-32v %v\n", strings.TrimSpace(c.name+" "+c.args), c.usage)
+	}
+	fmt.Fprintf(w, "\nwithout command the broker is served, %v <command> -help lists the flags of a command\n", programName)
+}
+
+// run executes the command given by args and returns the exit code
+func run(args []string, stdout io.Writer, stderr io.Writer) int {
+	name := defaultCommand
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+
+	for _, c := range commands {
+		if c.name != name {
+			continue
+		}
+
+		flags := flag.NewFlagSet(programName+" "+c.name, flag.ContinueOnError)
+		flags.SetOutput(stderr)
+
+		err := c.run(flags, args, stdout)
+		if err == flag.ErrHelp {
+			return 0
+		}
+		if err != nil {
+			fmt.Fprintf(stderr, "Error: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	if name == "help" {
+		usage(stdout)
+		return 0
+	}
+	fmt.Fprintf(stderr, "Error: unknown command %v\n\n", name)
+	usage(stderr)
+	return 2
+}
+
+// openStore opens the database, bbolt or file store of the configuration,
+// without any the state is kept in memory
+func openStore(cfg *config.Config) (store.Store, error) {
+	switch {
+	case cfg.DatabaseURL != "":
+		databaseStore, err := store.OpenDatabase(cfg.DatabaseURL)
+		if err != nil {
+			return nil, fmt.Errorf("could not open database: %v", err)
+		}
+		return databaseStore, nil
+	case cfg.BoltFile != "":
+		boltStore, err := store.NewBoltStore(cfg.BoltFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not open store %v: %v", cfg.BoltFile, err)
+		}
+		return boltStore, nil
+	case cfg.StoreFile != "":
+		fileStore, err := store.NewFileStore(cfg.StoreFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not open store %v: %v", cfg.StoreFile, err)
+		}
+		return fileStore, nil
+	}
+	return store.NewMemoryStore(), nil
+}
+
+// loadConfiguredLandscapes merges the landscape sources of the configuration
+// including the landscapes managed by the admin API if the store is persistent
+func loadConfiguredLandscapes(cfg *config.Config) (*landscape.Set, error) {
+	sources := landscape.NewSources(cfg.LandscapeSources())
+	if cfg.StoreFile != "" || cfg.DatabaseURL != "" || cfg.BoltFile != "" {
+		brokerStore, err := openStore(cfg)
+		if err != nil {
+			return nil, err
+		}
+		defer brokerStore.Close()
+		sources = append(sources, store.LandscapeSource{Store: brokerStore})
+	}
+	return loadLandscapes(sources)
+}
+
+func loadLandscapes(sources []landscape.Source) (*landscape.Set, error) {
+	var fragments []landscape.Fragment
+	for _, source := range sources {
+		loaded, err := source.Load()
+		if err != nil {
+			return nil, err
+		}
+		fragments = append(fragments, loaded...)
+	}
+	return landscape.Merge(fragments)
+}
+
+func writeJSON(w io.Writer, data interface{}) error {
+	js, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(js))
+	return err
+}
+
+func validateLandscapes(flags *flag.FlagSet, args []string, stdout io.Writer) error {
+	cfg, err := config.LoadFlags(flags, args)
+	if err != nil {
+		return err
+	}
+
+	var set *landscape.Set
+	if flags.NArg() > 0 {
+		var sources []landscape.Source
+		for _, path := range flags.Args() {
+			sources = append(sources, landscape.FileSource{Path: path})
+		}
+		set, err = loadLandscapes(sources)
+	} else {
+		set, err = loadConfiguredLandscapes(cfg)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, conflict := range set.Conflicts {
+		fmt.Fprintf(stdout, "warning: %v\n", conflict)
+	}
+	fmt.Fprintf(stdout, "%v landscapes from %v valid\n", len(set.Landscapes), strings.Join(set.Origins, ", "))
+	return nil
+}
+
+func printCatalog(flags *flag.FlagSet, args []string, stdout io.Writer) error {
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	return writeJSON(stdout, server.Catalog())
+}
+
+func lookup(flags *flag.FlagSet, args []string, stdout io.Writer) error {
+	labels := flags.String("labels", "", "label selector, e.g. 'aws && !master'")
+	names := flags.Bool("names", false, "print the names of the landscapes only")
+
+	cfg, err := config.LoadFlags(flags, args)
+	if err != nil {
+		return err
+	}
+
+	selector, err := landscape.ParseSelector(*labels)
+	if err != nil {
+		return err
+	}
+
+	set, err := loadConfiguredLandscapes(cfg)
+	if err != nil {
+		return err
+	}
+
+	landscapes := set.Landscapes.Filter(selector)
+	if !*names {
+		return writeJSON(stdout, landscapes)
+	}
+
+	sorted := make([]string, 0, len(landscapes))
+	for name := range landscapes {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	for _, name := range sorted {
+		fmt.Fprintln(stdout, name)
+	}
+	return nil
+}
+
+// storeCommand runs f with the configuration, the configured store and the
+// remaining arguments
+func storeCommand(flags *flag.FlagSet, args []string, f func(cfg *config.Config, s store.Store, args []string) error) error {
+	cfg, err := config.LoadFlags(flags, args)
+	if err != nil {
+		return err
+	}
+
+	s, err := openStore(cfg)
+	if err != nil {
+		return err
+	}
+	if err := f(cfg, s, flags.Args()); err != nil {
+		s.Close()
+		return err
+	}
+	return s.Close()
+}
+
+func exportStore(flags *flag.FlagSet, args []string, stdout io.Writer) error {
+	return storeCommand(flags, args, func(cfg *config.Config, s store.Store, args []string) error {
+		archive, err := store.Export(s)
+		if err != nil {
+			return err
+		}
+		if len(args) == 0 {
+			return writeJSON(stdout, archive)
+		}
+
+		data, err := json.MarshalIndent(archive, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(args[0], data, 0600); err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "%v instances, %v bindings and %v landscape versions exported to %v\n", len(archive.Instances), len(archive.Bindings), len(archive.LandscapeVersions), args[0])
+		return nil
+	})
+}
+
+func importStore(flags *flag.FlagSet, args []string, stdout io.Writer) error {
+	dryRun := flags.Bool("dry-run", false, "report the changes and conflicts without importing")
+
+	return storeCommand(flags, args, func(cfg *config.Config, s store.Store, args []string) error {
+		if len(args) != 1 {
+			return errors.New("import-store requires the file to import")
+		}
+
+		data, err := ioutil.ReadFile(args[0])
+		if err != nil {
+			return err
+		}
+		var archive store.Archive
+		if err := json.Unmarshal(data, &archive); err != nil {
+			return fmt.Errorf("%v: %v", args[0], err)
+		}
+
+		result, err := store.Import(s, &archive, *dryRun)
+		if err != nil {
+			return err
+		}
+		for _, conflict := range result.Conflicts {
+			fmt.Fprintf(stdout, "conflict: %v\n", conflict)
+		}
+		if len(result.Conflicts) > 0 {
+			return fmt.Errorf("%v conflicts, nothing imported from %v", len(result.Conflicts), args[0])
+		}
+
+		imported := "imported"
+		if result.DryRun {
+			imported = "to import"
+		}
+		fmt.Fprintf(stdout, "%v instances, %v bindings, %v landscape versions and %v landscape revisions %v from %v\n",
+			result.Imported.Instances, result.Imported.Bindings, result.Imported.LandscapeVersions, result.Imported.LandscapeRevisions, imported, args[0])
+		if result.Skipped.LandscapeRevisions > 0 {
+			fmt.Fprintf(stdout, "%v landscape revisions skipped, the store has a revision history\n", result.Skipped.LandscapeRevisions)
+		}
+		return nil
+	})
+}
+
+func backupStore(flags *flag.FlagSet, args []string, stdout io.Writer) error {
+	return storeCommand(flags, args, func(cfg *config.Config, s store.Store, args []string) error {
+		if len(args) != 1 {
+			return errors.New("backup-store requires the backup file")
+		}
+		backuper, ok := s.(store.Backuper)
+		if !ok {
+			return errors.New("the configured store does not support backups, use export-store")
+		}
+
+		file, err := os.OpenFile(args[0], os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		n, err := backuper.Backup(file)
+		if err != nil {
+			file.Close()
+			return err
+		}
+		if err := file.Close(); err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "%v bytes written to %v\n", n, args[0])
+		return nil
+	})
+}
+
+func compactStore(flags *flag.FlagSet, args []string, stdout io.Writer) error {
+	return storeCommand(flags, args, func(cfg *config.Config, s store.Store, args []string) error {
+		compacter, ok := s.(store.Compacter)
+		if !ok {
+			return errors.New("the configured store does not support compaction")
+		}
+		return compacter.Compact()
+	})
+}
+
+func orphans(flags *flag.FlagSet, args []string, stdout io.Writer) error {
+	purge := flags.Bool("purge", false, "delete the orphans")
+
+	return storeCommand(flags, args, func(cfg *config.Config, s store.Store, args []string) error {
+		found, err := store.FindOrphans(s, cfg.OrphanAge, time.Now().UTC())
+		if err != nil {
+			return err
+		}
+		if *purge {
+			if found, err = store.PurgeOrphans(s, found, cfg.OrphanAge, server.LockOwner(), cfg.OperationTimeout); err != nil {
+				return err
+			}
+		}
+
+		for _, orphan := range found {
+			id := orphan.InstanceID
+			if orphan.IsBinding() {
+				id += "/" + orphan.BindingID
+			}
+			fmt.Fprintf(stdout, "%v %v touched %v\n", id, orphan.Reason, orphan.Touched.Format(time.RFC3339))
+		}
+		if *purge {
+			fmt.Fprintf(stdout, "%v orphans purged\n", len(found))
+		}
+		return nil
+	})
+}
+
+func version(flags *flag.FlagSet, args []string, stdout io.Writer) error {
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "%v version %v commit %v\n", programName, Version, Commit)
+	return nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sklevenz/lookup-broker/openapi"
+	"github.com/stretchr/testify/assert"
+)
+
+const landscapes = `{
+	"cf-eu10": {"cloudcontroller": "https://api.cf.eu10.hana.ondemand.com", "labels": ["aws", "master"]},
+	"cf-eu10-001": {"cloudcontroller": "https://api.cf.eu10-001.hana.ondemand.com", "labels": ["aws"]},
+	"cf-eu20": {"cloudcontroller": "https://api.cf.eu20.hana.ondemand.com", "labels": ["azure"]}
+}`
+
+func runCommand(args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	code := run(args, &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestVersionCommand(t *testing.T) {
+	code, stdout, _ := runCommand("version")
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "lookup-broker version n/a commit n/a\n", stdout)
+}
+
+func TestUnknownCommand(t *testing.T) {
+	code, _, stderr := runCommand("unknown")
+	assert.Equal(t, 2, code)
+	assert.Contains(t, stderr, "unknown command unknown")
+	assert.Contains(t, stderr, "validate-landscapes")
+}
+
+func TestPrintCatalogCommand(t *testing.T) {
+	code, stdout, _ := runCommand("print-catalog")
+	assert.Equal(t, 0, code)
+
+	var catalog openapi.Catalog
+	assert.Nil(t, json.Unmarshal([]byte(stdout), &catalog))
+	assert.Equal(t, "lookup", catalog.Services[0].Name)
+}
+
+func TestValidateLandscapesCommand(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "landscapes")
+	defer os.RemoveAll(dir)
+
+	valid := filepath.Join(dir, "valid.json")
+	ioutil.WriteFile(valid, []byte(landscapes), 0644)
+	invalid := filepath.Join(dir, "invalid.json")
+	ioutil.WriteFile(invalid, []byte(`{"landscapes": {"cf-eu10": {"extends": "cf-unknown"}}}`), 0644)
+
+	code, stdout, _ := runCommand("validate-landscapes", valid)
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "3 landscapes from file:"+valid+" valid\n", stdout)
+
+	code, _, stderr := runCommand("validate-landscapes", valid, invalid)
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "extends unknown landscape cf-unknown")
+
+	code, stdout, _ = runCommand("validate-landscapes", "-landscapes", landscapes)
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "3 landscapes from flag:LANDSCAPES valid\n", stdout)
+}
+
+func TestLookupCommand(t *testing.T) {
+	code, stdout, _ := runCommand("lookup", "-landscapes", landscapes, "--labels", "aws && !master", "--names")
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "cf-eu10-001\n", stdout)
+
+	code, stdout, _ = runCommand("lookup", "-landscapes", landscapes, "--labels", "azure")
+	assert.Equal(t, 0, code)
+	assert.JSONEq(t, `{"cf-eu20": {"cloudcontroller": "https://api.cf.eu20.hana.ondemand.com", "uaa": "", "labels": ["azure"]}}`, stdout)
+
+	code, _, stderr := runCommand("lookup", "--labels", "aws &&")
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "Error:")
+
+	// the store is closed again, so the next command can open it
+	dir, _ := ioutil.TempDir("", "lookup")
+	defer os.RemoveAll(dir)
+	boltFile := filepath.Join(dir, "broker.db")
+	for i := 0; i < 2; i++ {
+		code, stdout, _ = runCommand("lookup", "-landscapes", landscapes, "-bolt-file", boltFile, "--names")
+		assert.Equal(t, 0, code)
+		assert.Equal(t, "cf-eu10\ncf-eu10-001\ncf-eu20\n", stdout)
+	}
+}
+
+func TestExportImportStoreCommands(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "store")
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "source.json")
+	ioutil.WriteFile(source, []byte(`{"instances": [{"instance_id": "1", "service_id": "1", "plan_id": "1.1"}], "bindings": [{"instance_id": "1", "binding_id": "2", "selector": "aws"}]}`), 0644)
+	archive := filepath.Join(dir, "archive.json")
+	target := filepath.Join(dir, "target.db")
+
+	code, stdout, _ := runCommand("export-store", "-store-file", source, archive)
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "1 instances, 1 bindings and 0 landscape versions exported to "+archive+"\n", stdout)
+
+	code, stdout, _ = runCommand("import-store", "-bolt-file", target, "-dry-run", archive)
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "1 instances, 1 bindings, 0 landscape versions and 0 landscape revisions to import from "+archive+"\n", stdout)
+
+	code, stdout, _ = runCommand("import-store", "-bolt-file", target, archive)
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "1 instances, 1 bindings, 0 landscape versions and 0 landscape revisions imported from "+archive+"\n", stdout)
+
+	code, stdout, _ = runCommand("import-store", "-bolt-file", target, archive)
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "0 instances, 0 bindings, 0 landscape versions and 0 landscape revisions imported from "+archive+"\n", stdout)
+
+	conflicting := filepath.Join(dir, "conflicting.json")
+	ioutil.WriteFile(conflicting, []byte(`{"version": 1, "instances": [{"instance_id": "1", "service_id": "1", "plan_id": "1.2"}]}`), 0644)
+	code, stdout, stderr := runCommand("import-store", "-bolt-file", target, conflicting)
+	assert.Equal(t, 1, code)
+	assert.Equal(t, "conflict: instance 1: exists with different content\n", stdout)
+	assert.Contains(t, stderr, "1 conflicts, nothing imported from "+conflicting)
+
+	code, stdout, _ = runCommand("export-store", "-bolt-file", target)
+	assert.Equal(t, 0, code)
+	assert.Contains(t, stdout, `"selector": "aws"`)
+
+	backup := filepath.Join(dir, "backup.db")
+	code, _, _ = runCommand("backup-store", "-bolt-file", target, backup)
+	assert.Equal(t, 0, code)
+	code, _, _ = runCommand("compact-store", "-bolt-file", target)
+	assert.Equal(t, 0, code)
+
+	code, _, stderr = runCommand("backup-store", "-store-file", source, backup)
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "does not support backups")
+}
+
+func TestOrphansCommand(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "store")
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "store.json")
+	ioutil.WriteFile(file, []byte(`{"instances": [{"instance_id": "1", "created": "2020-01-01T00:00:00Z"}], "bindings": [{"instance_id": "2", "binding_id": "3", "created": "2021-01-01T00:00:00Z"}]}`), 0644)
+
+	code, stdout, _ := runCommand("orphans", "-store-file", file)
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "2/3 instance_missing touched 2021-01-01T00:00:00Z\n", stdout)
+
+	code, stdout, _ = runCommand("orphans", "-store-file", file, "-orphan-age", "720h", "-purge")
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "1 untouched touched 2020-01-01T00:00:00Z\n2/3 instance_missing touched 2021-01-01T00:00:00Z\n2 orphans purged\n", stdout)
+
+	code, stdout, _ = runCommand("orphans", "-store-file", file)
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "", stdout)
+}
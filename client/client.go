@@ -0,0 +1,398 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/sklevenz/lookup-broker/landscape"
+	"github.com/sklevenz/lookup-broker/openapi"
+)
+
+const (
+	// APIVersion is the OSB API version sent in HeaderAPIVersion
+	APIVersion string = "2.14"
+
+	// HeaderAPIVersion carries the OSB API version of a request
+	HeaderAPIVersion string = "X-Broker-API-Version"
+	// HeaderOriginatingIdentity carries the platform and the user a request is made for
+	HeaderOriginatingIdentity string = "X-Broker-API-Originating-Identity"
+	// HeaderRequestIdentity carries a unique id of the request
+	HeaderRequestIdentity string = "X-Broker-API-Request-Identity"
+
+	// StateInProgress is the state of a running asynchronous operation
+	StateInProgress string = "in progress"
+	// StateSucceeded is the state of a finished asynchronous operation
+	StateSucceeded string = "succeeded"
+	// StateFailed is the state of a failed asynchronous operation
+	StateFailed string = "failed"
+
+	defaultPollInterval = 2 * time.Second
+	defaultPollTimeout  = 10 * time.Minute
+	defaultTimeout      = 30 * time.Second
+)
+
+// Error is an error response of the broker
+type Error struct {
+	StatusCode int
+	Body       openapi.Error
+}
+
+func (e *Error) Error() string {
+	if e.Body.Description != "" {
+		return fmt.Sprintf("HTTP Status: (%v) %v: %v", e.StatusCode, e.Body.Error, e.Body.Description)
+	}
+	return fmt.Sprintf("HTTP Status: (%v) %v", e.StatusCode, e.Body.Error)
+}
+
+// OperationError is returned if an asynchronous operation failed
+type OperationError struct {
+	Operation     string
+	LastOperation openapi.LastOperationResource
+}
+
+func (e *OperationError) Error() string {
+	return fmt.Sprintf("operation %q %v: %v", e.Operation, e.LastOperation.State, e.LastOperation.Description)
+}
+
+// Client calls the OSB API and the lookup API of a broker
+type Client struct {
+	URL        string
+	HTTPClient *http.Client
+
+	// Username and Password authenticate at the broker with basic authentication
+	Username string
+	Password string
+
+	// Platform and User form the originating identity of all requests
+	Platform string
+	User     map[string]interface{}
+
+	// PollInterval and PollTimeout control the polling of asynchronous operations
+	PollInterval time.Duration
+	PollTimeout  time.Duration
+}
+
+// Option configures a client
+type Option func(*Client)
+
+// WithHTTPClient sets the HTTP client, e.g. for TLS client certificates
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.HTTPClient = httpClient
+	}
+}
+
+// WithBasicAuth authenticates all requests with username and password
+func WithBasicAuth(username, password string) Option {
+	return func(c *Client) {
+		c.Username = username
+		c.Password = password
+	}
+}
+
+// WithOriginatingIdentity sends the platform and the user, e.g.
+// "cloudfoundry" and {"user_id": "..."}, with every request
+func WithOriginatingIdentity(platform string, user map[string]interface{}) Option {
+	return func(c *Client) {
+		c.Platform = platform
+		c.User = user
+	}
+}
+
+// WithPolling sets interval and timeout to poll asynchronous operations
+func WithPolling(interval, timeout time.Duration) Option {
+	return func(c *Client) {
+		c.PollInterval = interval
+		c.PollTimeout = timeout
+	}
+}
+
+// New creates a client for the broker at url
+func New(url string, options ...Option) *Client {
+	c := &Client{
+		URL:          strings.TrimSuffix(url, "/"),
+		HTTPClient:   &http.Client{Timeout: defaultTimeout},
+		PollInterval: defaultPollInterval,
+		PollTimeout:  defaultPollTimeout,
+	}
+	for _, option := range options {
+		option(c)
+	}
+	return c
+}
+
+// Catalog returns the services and plans of the broker
+func (c *Client) Catalog(ctx context.Context) (*openapi.Catalog, error) {
+	var catalog openapi.Catalog
+	if _, err := c.do(ctx, http.MethodGet, "/v2/catalog", nil, nil, &catalog); err != nil {
+		return nil, err
+	}
+	return &catalog, nil
+}
+
+// Provision creates a service instance and waits until an asynchronous
+// provisioning is finished
+func (c *Client) Provision(ctx context.Context, instanceID string, request *openapi.ServiceInstanceProvisionRequest) (*openapi.ServiceInstanceAsyncOperation, error) {
+	var response openapi.ServiceInstanceAsyncOperation
+	path := instancePath(instanceID)
+	code, err := c.do(ctx, http.MethodPut, path, url.Values{"accepts_incomplete": {"true"}}, request, &response)
+	if err != nil {
+		return nil, err
+	}
+
+	if code == http.StatusAccepted {
+		if err := c.poll(ctx, path, response.Operation, request.ServiceId, request.PlanId, false); err != nil {
+			return nil, err
+		}
+	}
+	return &response, nil
+}
+
+// Deprovision deletes a service instance and waits until an asynchronous
+// deprovisioning is finished. An instance which is gone already is no error.
+func (c *Client) Deprovision(ctx context.Context, instanceID string, serviceID string, planID string) error {
+	var response openapi.AsyncOperation
+	path := instancePath(instanceID)
+	query := url.Values{"accepts_incomplete": {"true"}, "service_id": {serviceID}, "plan_id": {planID}}
+
+	code, err := c.do(ctx, http.MethodDelete, path, query, nil, &response)
+	if isGone(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if code == http.StatusAccepted {
+		return c.poll(ctx, path, response.Operation, serviceID, planID, true)
+	}
+	return nil
+}
+
+// Bind creates a service binding. If the broker creates the binding
+// asynchronously, Bind waits for it and fetches the binding afterwards.
+func (c *Client) Bind(ctx context.Context, instanceID string, bindingID string, request *openapi.ServiceBindingRequest) (*openapi.ServiceBindingResponse, error) {
+	var response struct {
+		openapi.ServiceBindingResponse
+		Operation string `json:"operation,omitempty"`
+	}
+	path := bindingPath(instanceID, bindingID)
+
+	code, err := c.do(ctx, http.MethodPut, path, url.Values{"accepts_incomplete": {"true"}}, request, &response)
+	if err != nil {
+		return nil, err
+	}
+
+	if code == http.StatusAccepted {
+		if err := c.poll(ctx, path, response.Operation, request.ServiceId, request.PlanId, false); err != nil {
+			return nil, err
+		}
+		return c.Binding(ctx, instanceID, bindingID)
+	}
+	return &response.ServiceBindingResponse, nil
+}
+
+// Binding fetches a service binding
+func (c *Client) Binding(ctx context.Context, instanceID string, bindingID string) (*openapi.ServiceBindingResponse, error) {
+	var response openapi.ServiceBindingResponse
+	if _, err := c.do(ctx, http.MethodGet, bindingPath(instanceID, bindingID), nil, nil, &response); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+// Unbind deletes a service binding and waits until an asynchronous unbinding
+// is finished. A binding which is gone already is no error.
+func (c *Client) Unbind(ctx context.Context, instanceID string, bindingID string, serviceID string, planID string) error {
+	var response openapi.AsyncOperation
+	path := bindingPath(instanceID, bindingID)
+	query := url.Values{"accepts_incomplete": {"true"}, "service_id": {serviceID}, "plan_id": {planID}}
+
+	code, err := c.do(ctx, http.MethodDelete, path, query, nil, &response)
+	if isGone(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if code == http.StatusAccepted {
+		return c.poll(ctx, path, response.Operation, serviceID, planID, true)
+	}
+	return nil
+}
+
+// InstanceLastOperation returns the state of an asynchronous operation of a service instance
+func (c *Client) InstanceLastOperation(ctx context.Context, instanceID string, operation string, serviceID string, planID string) (*openapi.LastOperationResource, error) {
+	return c.lastOperation(ctx, instancePath(instanceID), operation, serviceID, planID)
+}
+
+// BindingLastOperation returns the state of an asynchronous operation of a service binding
+func (c *Client) BindingLastOperation(ctx context.Context, instanceID string, bindingID string, operation string, serviceID string, planID string) (*openapi.LastOperationResource, error) {
+	return c.lastOperation(ctx, bindingPath(instanceID, bindingID), operation, serviceID, planID)
+}
+
+func (c *Client) lastOperation(ctx context.Context, path string, operation string, serviceID string, planID string) (*openapi.LastOperationResource, error) {
+	query := url.Values{}
+	if operation != "" {
+		query.Set("operation", operation)
+	}
+	if serviceID != "" {
+		query.Set("service_id", serviceID)
+	}
+	if planID != "" {
+		query.Set("plan_id", planID)
+	}
+
+	var response openapi.LastOperationResource
+	if _, err := c.do(ctx, http.MethodGet, path+"/last_operation", query, nil, &response); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+// Landscapes returns the landscapes matching the label selector, all
+// landscapes for an empty selector
+func (c *Client) Landscapes(ctx context.Context, selector string) (landscape.Landscapes, error) {
+	query := url.Values{}
+	if selector != "" {
+		query.Set("selector", selector)
+	}
+
+	var landscapes landscape.Landscapes
+	if _, err := c.do(ctx, http.MethodGet, "/api/v1/landscapes", query, nil, &landscapes); err != nil {
+		return nil, err
+	}
+	return landscapes, nil
+}
+
+// poll waits until the operation succeeded. For a deletion the resource
+// being gone is success too.
+func (c *Client) poll(ctx context.Context, path string, operation string, serviceID string, planID string, deletion bool) error {
+	ctx, cancel := context.WithTimeout(ctx, c.PollTimeout)
+	defer cancel()
+
+	ticker := time.NewTicker(c.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("operation %q: %v", operation, ctx.Err())
+		case <-ticker.C:
+		}
+
+		lastOperation, err := c.lastOperation(ctx, path, operation, serviceID, planID)
+		if deletion && isGone(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch lastOperation.State {
+		case StateSucceeded:
+			return nil
+		case StateFailed:
+			return &OperationError{Operation: operation, LastOperation: *lastOperation}
+		}
+	}
+}
+
+func (c *Client) do(ctx context.Context, method string, path string, query url.Values, body interface{}, result interface{}) (int, error) {
+	target := c.URL + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+
+	var reader io.Reader
+	if body != nil {
+		js, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		reader = bytes.NewReader(js)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, method, target, reader)
+	if err != nil {
+		return 0, err
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	request.Header.Set("Accept", "application/json")
+	request.Header.Set(HeaderAPIVersion, APIVersion)
+	request.Header.Set(HeaderRequestIdentity, requestIdentity())
+	if c.Platform != "" {
+		user, err := json.Marshal(c.User)
+		if err != nil {
+			return 0, err
+		}
+		request.Header.Set(HeaderOriginatingIdentity, c.Platform+" "+base64.StdEncoding.EncodeToString(user))
+	}
+	if c.Username != "" {
+		request.SetBasicAuth(c.Username, c.Password)
+	}
+
+	response, err := c.HTTPClient.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return response.StatusCode, err
+	}
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		clientErr := &Error{StatusCode: response.StatusCode}
+		if json.Unmarshal(data, &clientErr.Body) != nil || clientErr.Body.Error == "" {
+			clientErr.Body.Error = http.StatusText(response.StatusCode)
+		}
+		return response.StatusCode, clientErr
+	}
+
+	if result != nil && len(bytes.TrimSpace(data)) > 0 {
+		if err := json.Unmarshal(data, result); err != nil {
+			return response.StatusCode, fmt.Errorf("%v %v: %v", method, path, err)
+		}
+	}
+	return response.StatusCode, nil
+}
+
+func instancePath(instanceID string) string {
+	return "/v2/service_instances/" + url.PathEscape(instanceID)
+}
+
+func bindingPath(instanceID string, bindingID string) string {
+	return instancePath(instanceID) + "/service_bindings/" + url.PathEscape(bindingID)
+}
+
+func isGone(err error) bool {
+	clientErr, ok := err.(*Error)
+	return ok && clientErr.StatusCode == http.StatusGone
+}
+
+func requestIdentity() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	h := hex.EncodeToString(b)
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
@@ -0,0 +1,202 @@
+package client
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sklevenz/lookup-broker/config"
+	"github.com/sklevenz/lookup-broker/openapi"
+	"github.com/sklevenz/lookup-broker/server"
+	"github.com/stretchr/testify/assert"
+)
+
+const landscapes = `{
+	"cf-eu10": {"cloudcontroller": "https://api.cf.eu10.hana.ondemand.com", "labels": ["aws", "master"]},
+	"cf-eu10-001": {"cloudcontroller": "https://api.cf.eu10-001.hana.ondemand.com", "labels": ["aws"]},
+	"cf-eu20": {"cloudcontroller": "https://api.cf.eu20.hana.ondemand.com", "labels": ["azure"]}
+}`
+
+func newBroker(t *testing.T) (*httptest.Server, *Client) {
+	c := config.New()
+	c.Landscapes = landscapes
+	broker := httptest.NewServer(server.New(server.WithConfig(c)))
+	return broker, New(broker.URL, WithOriginatingIdentity("cloudfoundry", map[string]interface{}{"user_id": "683ea748-3092-4ff4-b656-39cacc4d5360"}))
+}
+
+func TestClientBroker(t *testing.T) {
+	broker, client := newBroker(t)
+	defer broker.Close()
+	ctx := context.Background()
+
+	catalog, err := client.Catalog(ctx)
+	assert.Nil(t, err)
+	service := catalog.Services[0]
+	plan := service.Plans[0]
+	assert.Equal(t, "lookup", service.Name)
+
+	_, err = client.Provision(ctx, "123", &openapi.ServiceInstanceProvisionRequest{ServiceId: service.Id, PlanId: plan.Id, OrganizationGuid: "org", SpaceGuid: "space"})
+	assert.Nil(t, err)
+
+	binding, err := client.Bind(ctx, "123", "456", &openapi.ServiceBindingRequest{ServiceId: service.Id, PlanId: plan.Id, Parameters: map[string]interface{}{"selector": "aws && !master"}})
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{"cf-eu10-001"}, keys(binding.Credentials["landscapes"]))
+
+	binding, err = client.Binding(ctx, "123", "456")
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{"cf-eu10-001"}, keys(binding.Credentials["landscapes"]))
+
+	assert.Nil(t, client.Unbind(ctx, "123", "456", service.Id, plan.Id))
+	assert.Nil(t, client.Deprovision(ctx, "123", service.Id, plan.Id))
+
+	result, err := client.Landscapes(ctx, "azure")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(result))
+	assert.Equal(t, "https://api.cf.eu20.hana.ondemand.com", result["cf-eu20"].CloudController)
+}
+
+func keys(value interface{}) []interface{} {
+	var result []interface{}
+	for key := range value.(map[string]interface{}) {
+		result = append(result, key)
+	}
+	return result
+}
+
+func TestClientErrors(t *testing.T) {
+	broker, client := newBroker(t)
+	defer broker.Close()
+	ctx := context.Background()
+
+	_, err := client.Provision(ctx, "123", &openapi.ServiceInstanceProvisionRequest{ServiceId: "unknown", PlanId: "1.1"})
+	assert.IsType(t, &Error{}, err)
+	assert.Equal(t, http.StatusBadRequest, err.(*Error).StatusCode)
+	assert.Equal(t, "unsupported service id: unknown", err.(*Error).Body.Description)
+
+	_, err = client.Landscapes(ctx, "aws &&")
+	assert.IsType(t, &Error{}, err)
+}
+
+func TestClientHeaders(t *testing.T) {
+	var request *http.Request
+	broker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request = r
+		w.Write([]byte(`{"services": []}`))
+	}))
+	defer broker.Close()
+
+	client := New(broker.URL+"/", WithBasicAuth("broker", "secret"), WithOriginatingIdentity("cloudfoundry", map[string]interface{}{"user_id": "42"}))
+	_, err := client.Catalog(context.Background())
+	assert.Nil(t, err)
+
+	assert.Equal(t, "/v2/catalog", request.URL.Path)
+	assert.Equal(t, APIVersion, request.Header.Get(HeaderAPIVersion))
+	assert.Len(t, request.Header.Get(HeaderRequestIdentity), 36)
+	assert.Equal(t, "cloudfoundry "+base64.StdEncoding.EncodeToString([]byte(`{"user_id":"42"}`)), request.Header.Get(HeaderOriginatingIdentity))
+
+	username, password, ok := request.BasicAuth()
+	assert.True(t, ok)
+	assert.Equal(t, "broker", username)
+	assert.Equal(t, "secret", password)
+}
+
+// asyncBroker accepts every request and finishes the operation after polls
+// requests to last_operation with state
+func asyncBroker(polls int, state string) *httptest.Server {
+	var mutex sync.Mutex
+	count := map[string]int{}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/last_operation"):
+			operation := r.URL.Query().Get("operation")
+			count[operation]++
+			if count[operation] < polls {
+				json.NewEncoder(w).Encode(openapi.LastOperationResource{State: StateInProgress})
+				return
+			}
+			if state == "gone" {
+				w.WriteHeader(http.StatusGone)
+				w.Write([]byte(`{}`))
+				return
+			}
+			json.NewEncoder(w).Encode(openapi.LastOperationResource{State: state, Description: "operation " + state})
+		case r.Method == http.MethodGet:
+			json.NewEncoder(w).Encode(openapi.ServiceBindingResponse{Credentials: map[string]interface{}{"fetched": true}})
+		default:
+			if r.URL.Query().Get("accepts_incomplete") != "true" {
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				w.Write([]byte(`{"error": "AsyncRequired"}`))
+				return
+			}
+			w.WriteHeader(http.StatusAccepted)
+			fmt.Fprintf(w, `{"operation": "%v %v"}`, r.Method, r.URL.Path)
+		}
+	}))
+}
+
+func TestClientAsync(t *testing.T) {
+	broker := asyncBroker(3, StateSucceeded)
+	defer broker.Close()
+
+	client := New(broker.URL, WithPolling(time.Millisecond, time.Second))
+	ctx := context.Background()
+
+	response, err := client.Provision(ctx, "123", &openapi.ServiceInstanceProvisionRequest{ServiceId: "1", PlanId: "1.1"})
+	assert.Nil(t, err)
+	assert.Equal(t, "PUT /v2/service_instances/123", response.Operation)
+
+	binding, err := client.Bind(ctx, "123", "456", &openapi.ServiceBindingRequest{ServiceId: "1", PlanId: "1.1"})
+	assert.Nil(t, err)
+	assert.Equal(t, true, binding.Credentials["fetched"])
+
+	assert.Nil(t, client.Unbind(ctx, "123", "456", "1", "1.1"))
+	assert.Nil(t, client.Deprovision(ctx, "123", "1", "1.1"))
+
+	lastOperation, err := client.InstanceLastOperation(ctx, "123", "PUT /v2/service_instances/123", "1", "1.1")
+	assert.Nil(t, err)
+	assert.Equal(t, StateSucceeded, lastOperation.State)
+}
+
+func TestClientAsyncFailed(t *testing.T) {
+	broker := asyncBroker(2, StateFailed)
+	defer broker.Close()
+
+	client := New(broker.URL, WithPolling(time.Millisecond, time.Second))
+
+	_, err := client.Provision(context.Background(), "123", &openapi.ServiceInstanceProvisionRequest{ServiceId: "1", PlanId: "1.1"})
+	assert.IsType(t, &OperationError{}, err)
+	assert.Equal(t, `operation "PUT /v2/service_instances/123" failed: operation failed`, err.Error())
+}
+
+func TestClientAsyncGone(t *testing.T) {
+	broker := asyncBroker(2, "gone")
+	defer broker.Close()
+
+	client := New(broker.URL, WithPolling(time.Millisecond, time.Second))
+
+	assert.Nil(t, client.Deprovision(context.Background(), "123", "1", "1.1"))
+
+	_, err := client.Provision(context.Background(), "123", &openapi.ServiceInstanceProvisionRequest{ServiceId: "1", PlanId: "1.1"})
+	assert.IsType(t, &Error{}, err)
+}
+
+func TestClientAsyncTimeout(t *testing.T) {
+	broker := asyncBroker(1000, StateSucceeded)
+	defer broker.Close()
+
+	client := New(broker.URL, WithPolling(time.Millisecond, 20*time.Millisecond))
+
+	_, err := client.Provision(context.Background(), "123", &openapi.ServiceInstanceProvisionRequest{ServiceId: "1", PlanId: "1.1"})
+	assert.NotNil(t, err)
+}
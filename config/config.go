@@ -0,0 +1,622 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sklevenz/lookup-broker/landscape"
+)
+
+const (
+	// SourceDefault marks a setting which is not configured
+	SourceDefault string = "default"
+	// SourceFile marks a setting read from the configuration file
+	SourceFile string = "file"
+	// SourceEnv marks a setting read from the environment
+	SourceEnv string = "env"
+	// SourceFlag marks a setting read from the command line
+	SourceFlag string = "flag"
+
+	envConfigFile  string = "CONFIG_FILE"
+	flagConfigFile string = "config"
+
+	redacted string = "*****"
+
+	// defaultWebhookDeniedNetworks are the loopback, private, link-local
+	// (including cloud metadata services) and unspecified addresses
+	defaultWebhookDeniedNetworks string = "127.0.0.0/8,10.0.0.0/8,172.16.0.0/12,192.168.0.0/16,100.64.0.0/10,169.254.0.0/16,0.0.0.0/8,::1/128,fc00::/7,fe80::/10,::/128"
+)
+
+// Config is the configuration of the broker. Every setting is read from the
+// configuration file, the environment and the command line flags, later ones
+// take precedence.
+type Config struct {
+	Port string
+
+	StoreFile     string
+	DatabaseURL   string
+	BoltFile      string
+	AdminUsername string
+	AdminPassword string
+
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	IdleTimeout     time.Duration
+	ShutdownTimeout time.Duration
+
+	UnknownFields    string
+	OperationTimeout time.Duration
+	OrphanAge        time.Duration
+	BindingLifetimes map[string]time.Duration
+	SigningKeyFile   string
+	Issuer           string
+
+	WebhookDeniedNetworks []*net.IPNet
+
+	RateLimit      float64
+	RateLimitBurst int
+	TrustedProxies []*net.IPNet
+	MaxBodySize    int64
+	MaxImportSize  int64
+
+	TLSCertFile        string
+	TLSKeyFile         string
+	TLSClientCAFile    string
+	TLSClientPlatforms map[string][]string
+
+	Landscapes            string
+	LandscapesFiles       []string
+	LandscapesDir         string
+	LandscapesGitRepo     string
+	LandscapesGitBranch   string
+	LandscapesGitPath     string
+	LandscapesGitCloneDir string
+	LandscapesURL         string
+	LandscapesCache       string
+	LandscapesPoll        time.Duration
+
+	// File is the configuration file which was read, if any
+	File string
+
+	settings []*setting
+}
+
+// Setting is a single setting of the effective configuration
+type Setting struct {
+	Name   string `json:"name"`
+	Flag   string `json:"flag"`
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+type setting struct {
+	name         string
+	flag         string
+	usage        string
+	defaultValue string
+	value        flag.Value
+	source       string
+
+	// secret values are never printed, URLs are printed without password
+	secret bool
+	url    bool
+
+	// an empty environment variable clears a clearable value instead of
+	// keeping its default
+	clearable bool
+}
+
+// New creates a configuration with default values
+func New() *Config {
+	c := &Config{}
+	c.settings = []*setting{
+		{name: "PORT", flag: "port", usage: "port to listen on", defaultValue: "5000", value: (*stringValue)(&c.Port)},
+		{name: "STORE_FILE", flag: "store-file", usage: "JSON file persisting the broker state, in memory if not set", value: (*stringValue)(&c.StoreFile)},
+		{name: "DATABASE_URL", flag: "database-url", usage: "SQL database shared by all broker instances, postgres://... or sqlite:path", value: (*stringValue)(&c.DatabaseURL), url: true},
+		{name: "BOLT_FILE", flag: "bolt-file", usage: "embedded bbolt database for a single broker instance", value: (*stringValue)(&c.BoltFile)},
+		{name: "ADMIN_USERNAME", flag: "admin-username", usage: "user of the admin API", value: (*stringValue)(&c.AdminUsername)},
+		{name: "ADMIN_PASSWORD", flag: "admin-password", usage: "password of the admin API", value: (*stringValue)(&c.AdminPassword), secret: true},
+		{name: "HTTP_READ_TIMEOUT", flag: "http-read-timeout", usage: "maximum duration for reading a request", defaultValue: "30s", value: (*durationValue)(&c.ReadTimeout)},
+		{name: "HTTP_WRITE_TIMEOUT", flag: "http-write-timeout", usage: "maximum duration for writing a response", defaultValue: "60s", value: (*durationValue)(&c.WriteTimeout)},
+		{name: "HTTP_IDLE_TIMEOUT", flag: "http-idle-timeout", usage: "maximum duration of an idle keep-alive connection", defaultValue: "120s", value: (*durationValue)(&c.IdleTimeout)},
+		{name: "SHUTDOWN_TIMEOUT", flag: "shutdown-timeout", usage: "maximum duration of a graceful shutdown", defaultValue: "9s", value: (*durationValue)(&c.ShutdownTimeout)},
+		{name: "OSB_UNKNOWN_FIELDS", flag: "osb-unknown-fields", usage: "policy for unknown fields in OSB request bodies, ignore or reject", defaultValue: "ignore", value: (*stringValue)(&c.UnknownFields)},
+		{name: "OPERATION_TIMEOUT", flag: "operation-timeout", usage: "duration after which the lock of an operation on a service instance expires", defaultValue: "1m", value: (*durationValue)(&c.OperationTimeout)},
+		{name: "ORPHAN_AGE", flag: "orphan-age", usage: "duration after which untouched instances and bindings are reported as orphans, e.g. 2160h", value: (*durationValue)(&c.OrphanAge)},
+		{name: "BINDING_LIFETIMES", flag: "binding-lifetimes", usage: "JSON map of plan IDs or names to the lifetime of binding credentials, e.g. {\"extension\": \"720h\"}", value: (*lifetimesValue)(&c.BindingLifetimes)},
+		{name: "CREDENTIALS_SIGNING_KEY_FILE", flag: "credentials-signing-key-file", usage: "PEM encoded RSA, ECDSA or Ed25519 private key signing the binding credentials", value: (*stringValue)(&c.SigningKeyFile)},
+		{name: "CREDENTIALS_ISSUER", flag: "credentials-issuer", usage: "iss claim of the signed binding credentials", defaultValue: "lookup-broker", value: (*stringValue)(&c.Issuer)},
+		{name: "WEBHOOK_DENIED_NETWORKS", flag: "webhook-denied-networks", usage: "comma separated addresses or CIDR networks which webhooks must not point to", defaultValue: defaultWebhookDeniedNetworks, value: (*networksValue)(&c.WebhookDeniedNetworks), clearable: true},
+		{name: "RATE_LIMIT", flag: "rate-limit", usage: "requests per second of a client, 0 disables the limit", defaultValue: "0", value: (*floatValue)(&c.RateLimit)},
+		{name: "RATE_LIMIT_BURST", flag: "rate-limit-burst", usage: "maximum burst of requests of a client", defaultValue: "20", value: (*intValue)(&c.RateLimitBurst)},
+		{name: "TRUSTED_PROXIES", flag: "trusted-proxies", usage: "comma separated addresses or CIDR networks of proxies whose X-Forwarded-For header identifies clients", value: (*networksValue)(&c.TrustedProxies)},
+		{name: "MAX_BODY_SIZE", flag: "max-body-size", usage: "maximum size of a request body in bytes, 0 disables the limit", defaultValue: "1048576", value: (*sizeValue)(&c.MaxBodySize)},
+		{name: "MAX_IMPORT_SIZE", flag: "max-import-size", usage: "maximum size of the body of a store import in bytes, 0 disables the limit", defaultValue: "67108864", value: (*sizeValue)(&c.MaxImportSize)},
+		{name: "TLS_CERT_FILE", flag: "tls-cert-file", usage: "certificate to serve HTTPS", value: (*stringValue)(&c.TLSCertFile)},
+		{name: "TLS_KEY_FILE", flag: "tls-key-file", usage: "private key of the certificate", value: (*stringValue)(&c.TLSKeyFile)},
+		{name: "TLS_CLIENT_CA_FILE", flag: "tls-client-ca-file", usage: "CA bundle verifying client certificates of the OSB API", value: (*stringValue)(&c.TLSClientCAFile)},
+		{name: "TLS_CLIENT_PLATFORMS", flag: "tls-client-platforms", usage: "JSON map of client certificate subjects to allowed platforms", value: (*platformsValue)(&c.TLSClientPlatforms)},
+		{name: "LANDSCAPES", flag: "landscapes", usage: "landscape document", value: (*stringValue)(&c.Landscapes)},
+		{name: "LANDSCAPES_FILES", flag: "landscapes-files", usage: "list of landscape files separated by " + string(os.PathListSeparator), value: (*listValue)(&c.LandscapesFiles)},
+		{name: "LANDSCAPES_DIR", flag: "landscapes-dir", usage: "directory of landscape fragments", value: (*stringValue)(&c.LandscapesDir)},
+		{name: "LANDSCAPES_GIT_REPOSITORY", flag: "landscapes-git-repository", usage: "Git repository of the landscape document", value: (*stringValue)(&c.LandscapesGitRepo), url: true},
+		{name: "LANDSCAPES_GIT_BRANCH", flag: "landscapes-git-branch", usage: "branch of the Git repository", value: (*stringValue)(&c.LandscapesGitBranch)},
+		{name: "LANDSCAPES_GIT_PATH", flag: "landscapes-git-path", usage: "path of the landscape document in the Git repository", value: (*stringValue)(&c.LandscapesGitPath)},
+		{name: "LANDSCAPES_GIT_CLONE_DIR", flag: "landscapes-git-clone-dir", usage: "directory of the Git clone", value: (*stringValue)(&c.LandscapesGitCloneDir)},
+		{name: "LANDSCAPES_URL", flag: "landscapes-url", usage: "URL of the landscape document", value: (*stringValue)(&c.LandscapesURL), url: true},
+		{name: "LANDSCAPES_CACHE", flag: "landscapes-cache", usage: "cache file of the landscape document at the URL", value: (*stringValue)(&c.LandscapesCache)},
+		{name: "LANDSCAPES_POLL_INTERVAL", flag: "landscapes-poll-interval", usage: "interval to reload the landscape sources", defaultValue: "1m", value: (*durationValue)(&c.LandscapesPoll)},
+	}
+
+	for _, s := range c.settings {
+		if err := s.value.Set(s.defaultValue); err != nil {
+			panic(fmt.Sprintf("invalid default of %v: %v", s.name, err))
+		}
+		s.source = SourceDefault
+	}
+	return c
+}
+
+// Load reads the configuration from the file given by flag -config or
+// environment variable CONFIG_FILE, the environment and the command line
+// args, in ascending precedence, and validates it. The file is a JSON object
+// with the flag names as keys.
+func Load(name string, args []string) (*Config, error) {
+	return LoadFlags(flag.NewFlagSet(name, flag.ContinueOnError), args)
+}
+
+// LoadFlags is Load with the flags of the configuration added to flags, so
+// callers can define their own flags and read the remaining arguments
+func LoadFlags(flags *flag.FlagSet, args []string) (*Config, error) {
+	c := New()
+
+	c.AddFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	c.File = os.Getenv(envConfigFile)
+	if f := flags.Lookup(flagConfigFile); f.Value.String() != "" {
+		c.File = f.Value.String()
+	}
+	if c.File != "" {
+		if err := c.readFile(c.File); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, s := range c.settings {
+		if value, ok := os.LookupEnv(s.name); value != "" || ok && s.clearable {
+			if err := s.set(value, SourceEnv); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var err error
+	flags.Visit(func(f *flag.Flag) {
+		if s := c.lookupFlag(f.Name); s != nil && err == nil {
+			err = s.set(f.Value.String(), SourceFlag)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// AddFlags defines the command line flags of all settings and the flag -config
+func (c *Config) AddFlags(flags *flag.FlagSet) {
+	flags.String(flagConfigFile, "", "JSON configuration file, env "+envConfigFile)
+	for _, s := range c.settings {
+		flags.String(s.flag, "", fmt.Sprintf("%v, env %v", s.usage, s.name))
+	}
+}
+
+func (c *Config) lookupFlag(name string) *setting {
+	for _, s := range c.settings {
+		if s.flag == name {
+			return s
+		}
+	}
+	return nil
+}
+
+func (s *setting) set(value string, source string) error {
+	if err := s.value.Set(value); err != nil {
+		return fmt.Errorf("invalid %v %q from %v: %v", s.name, value, source, err)
+	}
+	s.source = source
+	return nil
+}
+
+func (c *Config) readFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("config file %v: %v", path, err)
+	}
+
+	for key, raw := range values {
+		s := c.lookupFlag(key)
+		if s == nil {
+			return fmt.Errorf("config file %v: unknown setting %v", path, key)
+		}
+
+		value := string(raw)
+		var str string
+		if err := json.Unmarshal(raw, &str); err == nil {
+			value = str
+		}
+		if err := s.set(value, SourceFile); err != nil {
+			return fmt.Errorf("config file %v: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// Validate checks the consistency of the settings
+func (c *Config) Validate() error {
+	var problems []string
+
+	if port, err := strconv.Atoi(c.Port); err != nil || port < 1 || port > 65535 {
+		problems = append(problems, fmt.Sprintf("PORT %q is not a port number", c.Port))
+	}
+	if (c.AdminUsername == "") != (c.AdminPassword == "") {
+		problems = append(problems, "ADMIN_USERNAME and ADMIN_PASSWORD must be set together")
+	}
+	if nonEmpty(c.StoreFile, c.DatabaseURL, c.BoltFile) > 1 {
+		problems = append(problems, "STORE_FILE, DATABASE_URL and BOLT_FILE are mutually exclusive")
+	}
+	if c.DatabaseURL != "" && !strings.HasPrefix(c.DatabaseURL, "postgres://") && !strings.HasPrefix(c.DatabaseURL, "postgresql://") && !strings.HasPrefix(c.DatabaseURL, "sqlite:") {
+		problems = append(problems, fmt.Sprintf("DATABASE_URL %q is neither a postgres:// nor a sqlite: URL", redactURL(c.DatabaseURL)))
+	}
+	if c.UnknownFields != "ignore" && c.UnknownFields != "reject" {
+		problems = append(problems, fmt.Sprintf("OSB_UNKNOWN_FIELDS %q is neither ignore nor reject", c.UnknownFields))
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		problems = append(problems, "TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if c.TLSClientCAFile != "" && c.TLSCertFile == "" {
+		problems = append(problems, "TLS_CLIENT_CA_FILE requires TLS_CERT_FILE and TLS_KEY_FILE")
+	}
+	if c.TLSClientPlatforms != nil && c.TLSClientCAFile == "" {
+		problems = append(problems, "TLS_CLIENT_PLATFORMS requires TLS_CLIENT_CA_FILE")
+	}
+	// an empty value would disable timers, which cannot be switched off
+	for _, required := range []struct {
+		name     string
+		duration time.Duration
+	}{
+		{"SHUTDOWN_TIMEOUT", c.ShutdownTimeout},
+		{"OPERATION_TIMEOUT", c.OperationTimeout},
+		{"LANDSCAPES_POLL_INTERVAL", c.LandscapesPoll},
+	} {
+		if required.duration <= 0 {
+			problems = append(problems, required.name+" must be a positive duration")
+		}
+	}
+	if c.LandscapesURL != "" {
+		if u, err := url.Parse(c.LandscapesURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("LANDSCAPES_URL %q is not an absolute http(s) URL", redactURL(c.LandscapesURL)))
+		}
+	}
+	// git would take these values as options
+	if strings.HasPrefix(c.LandscapesGitRepo, "-") {
+		problems = append(problems, fmt.Sprintf("LANDSCAPES_GIT_REPOSITORY %q must not start with -", redactURL(c.LandscapesGitRepo)))
+	}
+	if strings.HasPrefix(c.LandscapesGitBranch, "-") {
+		problems = append(problems, fmt.Sprintf("LANDSCAPES_GIT_BRANCH %q must not start with -", c.LandscapesGitBranch))
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid configuration: " + strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+func nonEmpty(values ...string) int {
+	n := 0
+	for _, value := range values {
+		if value != "" {
+			n++
+		}
+	}
+	return n
+}
+
+// Settings returns the effective configuration with secrets redacted
+func (c *Config) Settings() []Setting {
+	settings := make([]Setting, len(c.settings))
+	for i, s := range c.settings {
+		value := s.value.String()
+		switch {
+		case s.secret && value != "":
+			value = redacted
+		case s.url:
+			value = redactURL(value)
+		}
+		settings[i] = Setting{Name: s.name, Flag: s.flag, Value: value, Source: s.source}
+	}
+	return settings
+}
+
+// Source returns where setting name was read from
+func (c *Config) Source(name string) string {
+	for _, s := range c.settings {
+		if s.name == name {
+			return s.source
+		}
+	}
+	return ""
+}
+
+// Print logs the effective configuration with secrets redacted
+func (c *Config) Print() {
+	if c.File != "" {
+		log.Printf("config file: %v", c.File)
+	}
+	for _, s := range c.Settings() {
+		log.Printf("config %v=%v (%v)", s.Name, s.Value, s.Source)
+	}
+}
+
+func redactURL(value string) string {
+	u, err := url.Parse(value)
+	if err != nil || u.User == nil {
+		return value
+	}
+	if _, ok := u.User.Password(); !ok {
+		// a user without password is a token
+		u.User = url.User("xxxxx")
+	}
+	return u.Redacted()
+}
+
+type stringValue string
+
+func (v *stringValue) Set(value string) error {
+	*v = stringValue(value)
+	return nil
+}
+
+func (v *stringValue) String() string {
+	return string(*v)
+}
+
+type durationValue time.Duration
+
+func (v *durationValue) Set(value string) error {
+	if value == "" {
+		*v = 0
+		return nil
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	if duration <= 0 {
+		return errors.New("duration must be positive")
+	}
+	*v = durationValue(duration)
+	return nil
+}
+
+func (v *durationValue) String() string {
+	if *v == 0 {
+		return ""
+	}
+	return time.Duration(*v).String()
+}
+
+type floatValue float64
+
+func (v *floatValue) Set(value string) error {
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return err
+	}
+	if f < 0 {
+		return errors.New("value must not be negative")
+	}
+	*v = floatValue(f)
+	return nil
+}
+
+func (v *floatValue) String() string {
+	return strconv.FormatFloat(float64(*v), 'g', -1, 64)
+}
+
+type intValue int
+
+func (v *intValue) Set(value string) error {
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return err
+	}
+	if i < 0 {
+		return errors.New("value must not be negative")
+	}
+	*v = intValue(i)
+	return nil
+}
+
+func (v *intValue) String() string {
+	return strconv.Itoa(int(*v))
+}
+
+type sizeValue int64
+
+func (v *sizeValue) Set(value string) error {
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return err
+	}
+	if size < 0 {
+		return errors.New("size must not be negative")
+	}
+	*v = sizeValue(size)
+	return nil
+}
+
+func (v *sizeValue) String() string {
+	return strconv.FormatInt(int64(*v), 10)
+}
+
+// listValue is a list separated by the OS path list separator or a JSON array
+type listValue []string
+
+func (v *listValue) Set(value string) error {
+	if strings.HasPrefix(strings.TrimSpace(value), "[") {
+		return json.Unmarshal([]byte(value), (*[]string)(v))
+	}
+
+	*v = nil
+	for _, item := range filepath.SplitList(value) {
+		if strings.TrimSpace(item) != "" {
+			*v = append(*v, item)
+		}
+	}
+	return nil
+}
+
+func (v *listValue) String() string {
+	return strings.Join(*v, string(os.PathListSeparator))
+}
+
+// networksValue is a comma separated list of IP addresses and CIDR networks
+type networksValue []*net.IPNet
+
+func (v *networksValue) Set(value string) error {
+	var networks []*net.IPNet
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return fmt.Errorf("invalid address %v", item)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return err
+		}
+		networks = append(networks, network)
+	}
+	*v = networks
+	return nil
+}
+
+func (v *networksValue) String() string {
+	items := make([]string, len(*v))
+	for i, network := range *v {
+		items[i] = network.String()
+	}
+	return strings.Join(items, ",")
+}
+
+type platformsValue map[string][]string
+
+func (v *platformsValue) Set(value string) error {
+	if value == "" {
+		*v = nil
+		return nil
+	}
+
+	var platforms map[string][]string
+	if err := json.Unmarshal([]byte(value), &platforms); err != nil {
+		return err
+	}
+	*v = platforms
+	return nil
+}
+
+func (v *platformsValue) String() string {
+	if *v == nil {
+		return ""
+	}
+	js, _ := json.Marshal(*v)
+	return string(js)
+}
+
+type lifetimesValue map[string]time.Duration
+
+func (v *lifetimesValue) Set(value string) error {
+	if value == "" {
+		*v = nil
+		return nil
+	}
+
+	var durations map[string]string
+	if err := json.Unmarshal([]byte(value), &durations); err != nil {
+		return err
+	}
+
+	lifetimes := map[string]time.Duration{}
+	for plan, duration := range durations {
+		var lifetime durationValue
+		if err := lifetime.Set(duration); err != nil || lifetime == 0 {
+			return fmt.Errorf("plan %v: invalid lifetime %q", plan, duration)
+		}
+		lifetimes[plan] = time.Duration(lifetime)
+	}
+	*v = lifetimes
+	return nil
+}
+
+func (v *lifetimesValue) String() string {
+	if *v == nil {
+		return ""
+	}
+	durations := map[string]string{}
+	for plan, lifetime := range *v {
+		durations[plan] = lifetime.String()
+	}
+	js, _ := json.Marshal(durations)
+	return string(js)
+}
+
+// LandscapeSources returns the configuration of the landscape sources
+func (c *Config) LandscapeSources() landscape.SourceConfig {
+	return landscape.SourceConfig{
+		Files:          c.LandscapesFiles,
+		Dir:            c.LandscapesDir,
+		GitRepository:  c.LandscapesGitRepo,
+		GitBranch:      c.LandscapesGitBranch,
+		GitPath:        c.LandscapesGitPath,
+		GitCloneDir:    c.LandscapesGitCloneDir,
+		URL:            c.LandscapesURL,
+		CacheFile:      c.LandscapesCache,
+		Document:       c.Landscapes,
+		DocumentOrigin: c.Source("LANDSCAPES") + ":LANDSCAPES",
+	}
+}
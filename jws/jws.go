@@ -0,0 +1,337 @@
+// Package jws signs payloads as JSON Web Signatures in compact serialization
+// (RFC 7515) and publishes the verification keys as JSON Web Key Set
+// (RFC 7517), so consumers can verify data passed on by others.
+package jws
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// Algorithms of the JWS "alg" header by key type
+const (
+	AlgorithmRS256 string = "RS256"
+	AlgorithmES256 string = "ES256"
+	AlgorithmES384 string = "ES384"
+	AlgorithmEdDSA string = "EdDSA"
+
+	minRSABits = 2048
+)
+
+var encoding = base64.RawURLEncoding
+
+// Key is a public JSON Web Key
+type Key struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	Curve     string `json:"crv,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	X         string `json:"x,omitempty"`
+	Y         string `json:"y,omitempty"`
+}
+
+// KeySet is a JSON Web Key Set as published at /.well-known/jwks.json
+type KeySet struct {
+	Keys []Key `json:"keys"`
+}
+
+type header struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+	Type      string `json:"typ,omitempty"`
+}
+
+// Signer signs payloads with a private key
+type Signer struct {
+	key       crypto.Signer
+	algorithm string
+	hash      crypto.Hash
+	public    Key
+}
+
+// LoadSigner reads a PEM encoded RSA, ECDSA (P-256, P-384) or Ed25519 private
+// key in PKCS #8, PKCS #1 or SEC 1 form
+func LoadSigner(path string) (*Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%v: no PEM encoded key", path)
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+
+	signer, err := NewSigner(key)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	return signer, nil
+}
+
+// NewSigner creates a signer for an *rsa.PrivateKey, *ecdsa.PrivateKey or
+// ed25519.PrivateKey. The key ID is the JWK thumbprint (RFC 7638).
+func NewSigner(key interface{}) (*Signer, error) {
+	s := &Signer{}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if k.N.BitLen() < minRSABits {
+			return nil, fmt.Errorf("RSA key has %v bits, at least %v are required", k.N.BitLen(), minRSABits)
+		}
+		s.key, s.algorithm, s.hash = k, AlgorithmRS256, crypto.SHA256
+		s.public = Key{KeyType: "RSA", N: encoding.EncodeToString(k.N.Bytes()), E: encoding.EncodeToString(big.NewInt(int64(k.E)).Bytes())}
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256():
+			s.algorithm, s.hash = AlgorithmES256, crypto.SHA256
+		case elliptic.P384():
+			s.algorithm, s.hash = AlgorithmES384, crypto.SHA384
+		default:
+			return nil, fmt.Errorf("unsupported curve %v", k.Curve.Params().Name)
+		}
+		size := curveSize(k.Curve)
+		s.key = k
+		s.public = Key{KeyType: "EC", Curve: k.Curve.Params().Name, X: encoding.EncodeToString(pad(k.X.Bytes(), size)), Y: encoding.EncodeToString(pad(k.Y.Bytes(), size))}
+	case ed25519.PrivateKey:
+		s.key, s.algorithm = k, AlgorithmEdDSA
+		s.public = Key{KeyType: "OKP", Curve: "Ed25519", X: encoding.EncodeToString(k.Public().(ed25519.PublicKey))}
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+
+	s.public.Use = "sig"
+	s.public.Algorithm = s.algorithm
+	s.public.KeyID = thumbprint(s.public)
+	return s, nil
+}
+
+// Sign returns the compact serialization of the JWS of payload
+func (s *Signer) Sign(payload []byte) (string, error) {
+	h, err := json.Marshal(header{Algorithm: s.algorithm, KeyID: s.public.KeyID, Type: "JWT"})
+	if err != nil {
+		return "", err
+	}
+
+	input := encoding.EncodeToString(h) + "." + encoding.EncodeToString(payload)
+	signature, err := s.sign([]byte(input))
+	if err != nil {
+		return "", err
+	}
+	return input + "." + encoding.EncodeToString(signature), nil
+}
+
+func (s *Signer) sign(input []byte) ([]byte, error) {
+	if s.algorithm == AlgorithmEdDSA {
+		return s.key.Sign(rand.Reader, input, crypto.Hash(0))
+	}
+
+	digest := digest(s.hash, input)
+	if key, ok := s.key.(*ecdsa.PrivateKey); ok {
+		// JWS uses the fixed size concatenation of r and s, not ASN.1
+		r, sig, err := ecdsa.Sign(rand.Reader, key, digest)
+		if err != nil {
+			return nil, err
+		}
+		size := curveSize(key.Curve)
+		return append(pad(r.Bytes(), size), pad(sig.Bytes(), size)...), nil
+	}
+	return s.key.Sign(rand.Reader, digest, s.hash)
+}
+
+// KeySet returns the public key of the signer as key set
+func (s *Signer) KeySet() KeySet {
+	return KeySet{Keys: []Key{s.public}}
+}
+
+// Verify checks the compact serialized JWS token against the keys of set and
+// returns its payload. A payload of JWT claims with an exp claim in the past
+// is rejected, other claims like iss and sub are left to the caller.
+func Verify(token string, set KeySet) ([]byte, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed JWS")
+	}
+
+	var h header
+	data, err := encoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed JWS header: %v", err)
+	}
+	if err := json.Unmarshal(data, &h); err != nil {
+		return nil, fmt.Errorf("malformed JWS header: %v", err)
+	}
+	payload, err := encoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed JWS payload: %v", err)
+	}
+	signature, err := encoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed JWS signature: %v", err)
+	}
+
+	for _, key := range set.Keys {
+		if key.KeyID != h.KeyID {
+			continue
+		}
+		if key.Algorithm != h.Algorithm {
+			return nil, fmt.Errorf("key %v is no %v key", key.KeyID, h.Algorithm)
+		}
+		if err := verify(key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+			return nil, err
+		}
+		if err := checkExpiry(payload, time.Now()); err != nil {
+			return nil, err
+		}
+		return payload, nil
+	}
+	return nil, fmt.Errorf("unknown key %v", h.KeyID)
+}
+
+// checkExpiry rejects payload if it is a JSON object with an exp claim, the
+// expiry in seconds since the epoch, which is not after now
+func checkExpiry(payload []byte, now time.Time) error {
+	var claims struct {
+		Expiry *json.Number `json:"exp"`
+	}
+	if json.Unmarshal(payload, &claims) != nil || claims.Expiry == nil {
+		return nil
+	}
+
+	expiry, err := claims.Expiry.Float64()
+	if err != nil {
+		return fmt.Errorf("malformed exp claim: %v", err)
+	}
+	if !now.Before(time.Unix(int64(expiry), 0)) {
+		return fmt.Errorf("token expired at %v", time.Unix(int64(expiry), 0).UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+func verify(key Key, input []byte, signature []byte) error {
+	invalid := errors.New("invalid signature")
+
+	switch key.Algorithm {
+	case AlgorithmRS256:
+		n, err := decodeInt(key.N)
+		if err != nil {
+			return err
+		}
+		e, err := decodeInt(key.E)
+		if err != nil {
+			return err
+		}
+		public := &rsa.PublicKey{N: n, E: int(e.Int64())}
+		if rsa.VerifyPKCS1v15(public, crypto.SHA256, digest(crypto.SHA256, input), signature) != nil {
+			return invalid
+		}
+	case AlgorithmES256, AlgorithmES384:
+		curve, hash := elliptic.P256(), crypto.SHA256
+		if key.Algorithm == AlgorithmES384 {
+			curve, hash = elliptic.P384(), crypto.SHA384
+		}
+		x, err := decodeInt(key.X)
+		if err != nil {
+			return err
+		}
+		y, err := decodeInt(key.Y)
+		if err != nil {
+			return err
+		}
+		size := curveSize(curve)
+		if len(signature) != 2*size {
+			return invalid
+		}
+		public := &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+		r, s := new(big.Int).SetBytes(signature[:size]), new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(public, digest(hash, input), r, s) {
+			return invalid
+		}
+	case AlgorithmEdDSA:
+		x, err := encoding.DecodeString(key.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return errors.New("malformed Ed25519 key")
+		}
+		if !ed25519.Verify(ed25519.PublicKey(x), input, signature) {
+			return invalid
+		}
+	default:
+		return fmt.Errorf("unsupported algorithm %v", key.Algorithm)
+	}
+	return nil
+}
+
+// thumbprint is the JWK thumbprint of RFC 7638, the SHA-256 of the required
+// members in lexicographic order
+func thumbprint(key Key) string {
+	var members string
+	switch key.KeyType {
+	case "RSA":
+		members = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, key.E, key.N)
+	case "EC":
+		members = fmt.Sprintf(`{"crv":%q,"kty":"EC","x":%q,"y":%q}`, key.Curve, key.X, key.Y)
+	default:
+		members = fmt.Sprintf(`{"crv":%q,"kty":%q,"x":%q}`, key.Curve, key.KeyType, key.X)
+	}
+	sum := sha256.Sum256([]byte(members))
+	return encoding.EncodeToString(sum[:])
+}
+
+func digest(hash crypto.Hash, input []byte) []byte {
+	if hash == crypto.SHA384 {
+		sum := sha512.Sum384(input)
+		return sum[:]
+	}
+	sum := sha256.Sum256(input)
+	return sum[:]
+}
+
+func decodeInt(value string) (*big.Int, error) {
+	data, err := encoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("malformed key: %v", err)
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+func curveSize(curve elliptic.Curve) int {
+	return (curve.Params().BitSize + 7) / 8
+}
+
+func pad(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+	return append(make([]byte, size-len(b)), b...)
+}
@@ -0,0 +1,130 @@
+package jws
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeKey(t *testing.T, dir string, name string, block *pem.Block) string {
+	path := filepath.Join(dir, name)
+	assert.Nil(t, ioutil.WriteFile(path, pem.EncodeToMemory(block), 0600))
+	return path
+}
+
+func TestSignVerify(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "jws")
+	defer os.RemoveAll(dir)
+
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	p256Key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	p384Key, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	ecDER, _ := x509.MarshalECPrivateKey(p256Key)
+	pkcs8RSA, _ := x509.MarshalPKCS8PrivateKey(rsaKey)
+	pkcs8P384, _ := x509.MarshalPKCS8PrivateKey(p384Key)
+	pkcs8Ed, _ := x509.MarshalPKCS8PrivateKey(edKey)
+
+	for _, test := range []struct {
+		path      string
+		algorithm string
+	}{
+		{writeKey(t, dir, "rsa.pem", &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}), AlgorithmRS256},
+		{writeKey(t, dir, "rsa-pkcs8.pem", &pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8RSA}), AlgorithmRS256},
+		{writeKey(t, dir, "ec.pem", &pem.Block{Type: "EC PRIVATE KEY", Bytes: ecDER}), AlgorithmES256},
+		{writeKey(t, dir, "p384.pem", &pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8P384}), AlgorithmES384},
+		{writeKey(t, dir, "ed25519.pem", &pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8Ed}), AlgorithmEdDSA},
+	} {
+		signer, err := LoadSigner(test.path)
+		assert.Nil(t, err, test.path)
+
+		set := signer.KeySet()
+		assert.Equal(t, test.algorithm, set.Keys[0].Algorithm)
+		assert.Equal(t, "sig", set.Keys[0].Use)
+
+		token, err := signer.Sign([]byte(`{"landscapes":{}}`))
+		assert.Nil(t, err)
+		assert.Equal(t, 3, len(strings.Split(token, ".")))
+
+		payload, err := Verify(token, set)
+		assert.Nil(t, err, test.path)
+		assert.Equal(t, `{"landscapes":{}}`, string(payload))
+
+		parts := strings.Split(token, ".")
+		tampered := parts[0] + "." + encoding.EncodeToString([]byte(`{"landscapes":{"a":{}}}`)) + "." + parts[2]
+		_, err = Verify(tampered, set)
+		assert.EqualError(t, err, "invalid signature", test.path)
+	}
+}
+
+func TestVerifyErrors(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	signer, _ := NewSigner(key)
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherSigner, _ := NewSigner(other)
+
+	token, _ := signer.Sign([]byte(`{}`))
+	_, err := Verify(token, otherSigner.KeySet())
+	assert.Contains(t, err.Error(), "unknown key")
+
+	set := signer.KeySet()
+	set.Keys[0].Algorithm = AlgorithmES384
+	_, err = Verify(token, set)
+	assert.Contains(t, err.Error(), "is no ES256 key")
+
+	_, err = Verify("a.b", signer.KeySet())
+	assert.EqualError(t, err, "malformed JWS")
+
+	token, _ = signer.Sign([]byte(`{"exp": 1614600000}`))
+	_, err = Verify(token, signer.KeySet())
+	assert.EqualError(t, err, "token expired at 2021-03-01T12:00:00Z")
+
+	token, _ = signer.Sign([]byte(fmt.Sprintf(`{"exp": %v}`, time.Now().Add(time.Minute).Unix())))
+	_, err = Verify(token, signer.KeySet())
+	assert.Nil(t, err)
+}
+
+func TestLoadSignerErrors(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "jws")
+	defer os.RemoveAll(dir)
+
+	_, err := LoadSigner(filepath.Join(dir, "missing.pem"))
+	assert.NotNil(t, err)
+
+	path := filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(path, []byte("no key"), 0600)
+	_, err = LoadSigner(path)
+	assert.EqualError(t, err, path+": no PEM encoded key")
+
+	small, _ := rsa.GenerateKey(rand.Reader, 1024)
+	path = writeKey(t, dir, "small.pem", &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(small)})
+	_, err = LoadSigner(path)
+	assert.EqualError(t, err, path+": RSA key has 1024 bits, at least 2048 are required")
+
+	p224, _ := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	_, err = NewSigner(p224)
+	assert.EqualError(t, err, "unsupported curve P-224")
+}
+
+func TestThumbprint(t *testing.T) {
+	// the example of RFC 7638 section 3.1
+	key := Key{
+		KeyType: "RSA",
+		N:       "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw",
+		E:       "AQAB",
+	}
+	assert.Equal(t, "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs", thumbprint(key))
+}
@@ -0,0 +1,87 @@
+package landscape
+
+import (
+	"reflect"
+	"sort"
+)
+
+// ChangeType classifies a change between two landscape sets
+type ChangeType string
+
+const (
+	// Added landscape
+	Added ChangeType = "added"
+	// Removed landscape
+	Removed ChangeType = "removed"
+	// Modified landscape
+	Modified ChangeType = "modified"
+)
+
+// Change of a single landscape, Before is nil for added and After is nil
+// for removed landscapes. Fields lists the changed fields of a modified
+// landscape, Origin is the source providing the landscape.
+type Change struct {
+	Type   ChangeType    `json:"type"`
+	Name   string        `json:"name"`
+	Origin string        `json:"origin,omitempty"`
+	Before *Landscape    `json:"before,omitempty"`
+	After  *Landscape    `json:"after,omitempty"`
+	Fields []FieldChange `json:"fields,omitempty"`
+}
+
+// FieldChange is the change of a single field of a modified landscape
+type FieldChange struct {
+	Field  string      `json:"field"`
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// Diff returns the changes from before to after ordered by landscape name
+func Diff(before, after Landscapes) []Change {
+	changes := []Change{}
+
+	for name, b := range before {
+		b := b
+		a, ok := after[name]
+		if !ok {
+			changes = append(changes, Change{Type: Removed, Name: name, Before: &b})
+			continue
+		}
+		if fields := diffFields(normalize(b), normalize(a)); len(fields) > 0 {
+			changes = append(changes, Change{Type: Modified, Name: name, Before: &b, After: &a, Fields: fields})
+		}
+	}
+
+	for name, a := range after {
+		a := a
+		if _, ok := before[name]; !ok {
+			changes = append(changes, Change{Type: Added, Name: name, After: &a})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Name < changes[j].Name
+	})
+	return changes
+}
+
+func normalize(l Landscape) Landscape {
+	if len(l.Labels) == 0 {
+		l.Labels = nil
+	}
+	return l
+}
+
+func diffFields(before, after Landscape) []FieldChange {
+	var fields []FieldChange
+	if before.CloudController != after.CloudController {
+		fields = append(fields, FieldChange{Field: "cloudcontroller", Before: before.CloudController, After: after.CloudController})
+	}
+	if before.Uaa != after.Uaa {
+		fields = append(fields, FieldChange{Field: "uaa", Before: before.Uaa, After: after.Uaa})
+	}
+	if !reflect.DeepEqual(before.Labels, after.Labels) {
+		fields = append(fields, FieldChange{Field: "labels", Before: before.Labels, After: after.Labels})
+	}
+	return fields
+}
@@ -0,0 +1,43 @@
+package landscape
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiff(t *testing.T) {
+	before := Landscapes{
+		"a": {CloudController: "https://api.a.example.com", Labels: []string{}},
+		"b": {CloudController: "https://api.b.example.com", Labels: []string{"aws"}},
+		"c": {CloudController: "https://api.c.example.com"},
+	}
+	after := Landscapes{
+		"a": {CloudController: "https://api.a.example.com"},
+		"b": {CloudController: "https://api.b.example.com", Labels: []string{"gcp"}},
+		"d": {CloudController: "https://api.d.example.com"},
+	}
+
+	changes := Diff(before, after)
+	assert.Equal(t, 3, len(changes))
+
+	assert.Equal(t, Modified, changes[0].Type)
+	assert.Equal(t, "b", changes[0].Name)
+	assert.Equal(t, []string{"aws"}, changes[0].Before.Labels)
+	assert.Equal(t, []string{"gcp"}, changes[0].After.Labels)
+	assert.Equal(t, []FieldChange{{Field: "labels", Before: []string{"aws"}, After: []string{"gcp"}}}, changes[0].Fields)
+
+	assert.Equal(t, Change{Type: Removed, Name: "c", Before: &Landscape{CloudController: "https://api.c.example.com"}}, changes[1])
+	assert.Equal(t, Change{Type: Added, Name: "d", After: &Landscape{CloudController: "https://api.d.example.com"}}, changes[2])
+
+	assert.Equal(t, 0, len(Diff(after, after)))
+}
+
+func TestDiffFields(t *testing.T) {
+	before := Landscapes{"a": {CloudController: "https://api.a.example.com", Uaa: "https://uaa.a.example.com", Labels: []string{"aws"}}}
+	after := Landscapes{"a": {CloudController: "https://api.a2.example.com", Uaa: "https://uaa.a.example.com", Labels: []string{"aws"}}}
+
+	changes := Diff(before, after)
+	assert.Equal(t, 1, len(changes))
+	assert.Equal(t, []FieldChange{{Field: "cloudcontroller", Before: "https://api.a.example.com", After: "https://api.a2.example.com"}}, changes[0].Fields)
+}
@@ -0,0 +1,162 @@
+package landscape
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	defaultGitBranch string = "HEAD"
+	defaultGitPath   string = "landscapes.json"
+)
+
+// GitSource reads landscapes from a path of a Git repository. The path is
+// either a landscape document or a directory of *.json fragments.
+//
+// The repository is mirrored into a bare clone, so documents are read from a
+// single commit and never from a partially updated work tree. A commit whose
+// documents do not parse is rejected and the last good commit stays active.
+// They are resolved together with the other sources, as they may extend
+// their landscapes.
+type GitSource struct {
+	Repository string
+	Branch     string
+	Path       string
+	CloneDir   string
+
+	mutex     sync.Mutex
+	commit    string
+	fragments []Fragment
+}
+
+// NewGitSource creates a source for path on branch of repository, which is
+// a local path or any URL supported by git, e.g. file:///srv/landscapes.git
+func NewGitSource(repository, branch, path, cloneDir string) *GitSource {
+	if branch == "" {
+		branch = defaultGitBranch
+	}
+	if path == "" {
+		path = defaultGitPath
+	}
+	return &GitSource{
+		Repository: repository,
+		Branch:     branch,
+		Path:       path,
+		CloneDir:   cloneDir,
+	}
+}
+
+// Name of the source
+func (s *GitSource) Name() string {
+	return "git:" + s.Repository + "//" + s.Path
+}
+
+// Commit returns the SHA of the active commit
+func (s *GitSource) Commit() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.commit
+}
+
+// Load fetches the branch and reads the documents of its head commit
+func (s *GitSource) Load() ([]Fragment, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	commit, err := s.fetch()
+	if err == nil && commit != s.commit {
+		var fragments []Fragment
+		fragments, err = s.read(commit)
+		if err == nil {
+			log.Printf("%v: switch from commit %q to %q", s.Name(), s.commit, commit)
+			s.commit = commit
+			s.fragments = fragments
+		}
+	}
+
+	if err != nil {
+		if s.commit == "" {
+			return nil, fmt.Errorf("%v: %v", s.Name(), err)
+		}
+		log.Printf("Warning: %v: %v, keep commit %v", s.Name(), err, s.commit)
+	}
+	return s.fragments, nil
+}
+
+func (s *GitSource) fetch() (string, error) {
+	if _, err := os.Stat(s.CloneDir); os.IsNotExist(err) {
+		if _, err := s.git("", "clone", "--quiet", "--bare", "--", s.Repository, s.CloneDir); err != nil {
+			return "", err
+		}
+	} else if _, err := s.git(s.CloneDir, "fetch", "--quiet", "--force", "--prune", "--", s.Repository, "+refs/heads/*:refs/heads/*"); err != nil {
+		return "", err
+	}
+
+	out, err := s.git(s.CloneDir, "rev-parse", "--verify", s.Branch+"^{commit}")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out), nil
+}
+
+func (s *GitSource) read(commit string) ([]Fragment, error) {
+	kind, err := s.git(s.CloneDir, "cat-file", "-t", commit+":"+s.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := []string{s.Path}
+	if strings.TrimSpace(kind) == "tree" {
+		out, err := s.git(s.CloneDir, "ls-tree", "--name-only", commit, strings.TrimSuffix(s.Path, "/")+"/")
+		if err != nil {
+			return nil, err
+		}
+
+		paths = nil
+		for _, name := range strings.Split(strings.TrimSpace(out), "\n") {
+			if path.Ext(name) == ".json" {
+				paths = append(paths, name)
+			}
+		}
+		sort.Strings(paths)
+	}
+
+	var fragments []Fragment
+	for _, p := range paths {
+		data, err := s.git(s.CloneDir, "show", commit+":"+p)
+		if err != nil {
+			return nil, err
+		}
+
+		doc, err := ParseDocument([]byte(data))
+		if err != nil {
+			return nil, fmt.Errorf("%v at %v: %v", p, commit, err)
+		}
+		fragments = append(fragments, Fragment{Origin: "git:" + s.Repository + "//" + p, Document: doc, Commit: commit})
+	}
+	return fragments, nil
+}
+
+func (s *GitSource) git(dir string, args ...string) (string, error) {
+	if dir != "" {
+		args = append([]string{"--git-dir", dir}, args...)
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("git", args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("git %v: %v: %v", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
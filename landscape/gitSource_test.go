@@ -0,0 +1,137 @@
+package landscape
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func gitCommit(t *testing.T, repository string, files map[string]string) string {
+	for name, content := range files {
+		path := filepath.Join(repository, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		writeFile(t, path, content)
+	}
+
+	for _, args := range [][]string{
+		{"add", "-A"},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "--quiet", "-m", "update"},
+	} {
+		out, err := exec.Command("git", append([]string{"-C", repository}, args...)...).CombinedOutput()
+		assert.Nil(t, err, string(out))
+	}
+
+	out, err := exec.Command("git", "-C", repository, "rev-parse", "HEAD").Output()
+	assert.Nil(t, err)
+	return strings.TrimSpace(string(out))
+}
+
+func gitRepository(t *testing.T) (string, func()) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	dir, _ := ioutil.TempDir("", "landscapes")
+	repository := filepath.Join(dir, "repository")
+
+	out, err := exec.Command("git", "init", "--quiet", repository).CombinedOutput()
+	assert.Nil(t, err, string(out))
+
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func TestGitSource(t *testing.T) {
+	dir, cleanup := gitRepository(t)
+	defer cleanup()
+	repository := filepath.Join(dir, "repository")
+
+	first := gitCommit(t, repository, map[string]string{"config/landscapes.json": LANDSCAPES})
+
+	source := NewGitSource("file://"+repository, "", "config/landscapes.json", filepath.Join(dir, "clone"))
+	assert.Equal(t, "git:file://"+repository+"//config/landscapes.json", source.Name())
+
+	fragments, err := source.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(fragments))
+	assert.Equal(t, first, fragments[0].Commit)
+	assert.Equal(t, first, source.Commit())
+	assert.Equal(t, 3, len(fragments[0].Document.Landscapes))
+
+	second := gitCommit(t, repository, map[string]string{"config/landscapes.json": DOCUMENT})
+
+	fragments, err = source.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, second, source.Commit())
+	assert.Equal(t, 4, len(fragments[0].Document.Landscapes))
+
+	gitCommit(t, repository, map[string]string{"config/landscapes.json": `{"landscapes": {`})
+
+	fragments, err = source.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, second, source.Commit())
+	assert.Equal(t, 4, len(fragments[0].Document.Landscapes))
+}
+
+func TestGitSourceDirectory(t *testing.T) {
+	dir, cleanup := gitRepository(t)
+	defer cleanup()
+	repository := filepath.Join(dir, "repository")
+
+	commit := gitCommit(t, repository, map[string]string{
+		"landscapes/10-global.json": LANDSCAPES,
+		"landscapes/20-team.json":   `{"cf-team": {"cloudcontroller": "https://api.example.com"}}`,
+		"landscapes/README.md":      "not a fragment",
+	})
+
+	registry := NewRegistry(NewGitSource(repository, "", "landscapes", filepath.Join(dir, "clone")))
+	err := registry.Reload()
+	assert.Nil(t, err)
+
+	set := registry.Current()
+	assert.Equal(t, 4, len(set.Landscapes))
+	assert.Equal(t, commit, set.Commit)
+	assert.Equal(t, "git:"+repository+"//landscapes/20-team.json", set.Provenance["cf-team"])
+}
+
+func TestGitSourceExtendsOtherSource(t *testing.T) {
+	dir, cleanup := gitRepository(t)
+	defer cleanup()
+	repository := filepath.Join(dir, "repository")
+
+	gitCommit(t, repository, map[string]string{"landscapes.json": `{"landscapes": {"cf-team": {"extends": "cf-eu10"}}}`})
+
+	registry := NewRegistry(
+		DocumentSource{Origin: "env:LANDSCAPES", Data: []byte(LANDSCAPES)},
+		NewGitSource(repository, "", "landscapes.json", filepath.Join(dir, "clone")),
+	)
+	assert.Nil(t, registry.Reload())
+	set := registry.Current()
+	assert.Equal(t, set.Landscapes["cf-eu10"].CloudController, set.Landscapes["cf-team"].CloudController)
+}
+
+func TestGitSourceError(t *testing.T) {
+	dir, cleanup := gitRepository(t)
+	defer cleanup()
+
+	_, err := NewGitSource(filepath.Join(dir, "missing"), "", "", filepath.Join(dir, "clone")).Load()
+	assert.NotNil(t, err)
+}
+
+func TestGitSourceOptionAsRepository(t *testing.T) {
+	dir, cleanup := gitRepository(t)
+	defer cleanup()
+
+	// the option is passed to git as the repository
+	repository := "--upload-pack=touch " + filepath.Join(dir, "marker")
+	_, err := NewGitSource(repository, "", "", filepath.Join(dir, "clone")).Load()
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "repository '"+repository+"' does not exist")
+	}
+	_, err = os.Stat(filepath.Join(dir, "marker"))
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,156 @@
+package landscape
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	headerETag        string = "ETag"
+	headerIfNoneMatch string = "If-None-Match"
+
+	defaultHTTPTimeout = 30 * time.Second
+)
+
+// HTTPSource reads a landscape document from an HTTP(S) URL. Unchanged
+// documents are detected by ETag. The last good copy is cached on disk and
+// served as long as the origin is not reachable.
+type HTTPSource struct {
+	URL       string
+	CacheFile string
+	Client    *http.Client
+
+	mutex sync.Mutex
+	cache *httpCache
+}
+
+type httpCache struct {
+	URL      string          `json:"url"`
+	ETag     string          `json:"etag"`
+	Fetched  time.Time       `json:"fetched"`
+	Document json.RawMessage `json:"document"`
+}
+
+// NewHTTPSource creates a source for url caching the document in cacheFile.
+// An empty cacheFile disables the disk cache.
+func NewHTTPSource(url string, cacheFile string) *HTTPSource {
+	return &HTTPSource{
+		URL:       url,
+		CacheFile: cacheFile,
+		Client:    &http.Client{Timeout: defaultHTTPTimeout},
+	}
+}
+
+// Name of the source
+func (s *HTTPSource) Name() string {
+	return s.URL
+}
+
+// Load fetches the document if it has changed since the last load and falls
+// back to the cached copy if the origin fails
+func (s *HTTPSource) Load() ([]Fragment, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.cache == nil {
+		s.cache = s.readCache()
+	}
+
+	data, err := s.fetch()
+	if err != nil {
+		if s.cache == nil {
+			return nil, fmt.Errorf("%v: %v", s.Name(), err)
+		}
+		log.Printf("Warning: %v: %v, serving copy fetched at %v", s.Name(), err, s.cache.Fetched)
+		data = s.cache.Document
+	}
+
+	doc, err := ParseDocument(data)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", s.Name(), err)
+	}
+	return []Fragment{{Origin: s.Name(), Document: doc}}, nil
+}
+
+func (s *HTTPSource) fetch() ([]byte, error) {
+	request, err := http.NewRequest(http.MethodGet, s.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if s.cache != nil && s.cache.ETag != "" {
+		request.Header.Set(headerIfNoneMatch, s.cache.ETag)
+	}
+
+	response, err := s.Client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	switch response.StatusCode {
+	case http.StatusNotModified:
+		if s.cache == nil {
+			return nil, fmt.Errorf("HTTP Status: (%v) without cached document", response.StatusCode)
+		}
+		return s.cache.Document, nil
+	case http.StatusOK:
+	default:
+		return nil, fmt.Errorf("HTTP Status: (%v)", response.StatusCode)
+	}
+
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := ParseDocument(data); err != nil {
+		return nil, err
+	}
+
+	s.cache = &httpCache{
+		URL:      s.URL,
+		ETag:     response.Header.Get(headerETag),
+		Fetched:  time.Now(),
+		Document: data,
+	}
+	s.writeCache()
+
+	return data, nil
+}
+
+func (s *HTTPSource) readCache() *httpCache {
+	if s.CacheFile == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(s.CacheFile)
+	if err != nil {
+		return nil
+	}
+
+	cache := &httpCache{}
+	if err := json.Unmarshal(data, cache); err != nil || cache.URL != s.URL {
+		log.Printf("Warning: ignore landscape cache %v", s.CacheFile)
+		return nil
+	}
+	return cache
+}
+
+func (s *HTTPSource) writeCache() {
+	if s.CacheFile == "" {
+		return
+	}
+
+	data, err := json.Marshal(s.cache)
+	if err == nil {
+		err = writeFileAtomic(s.CacheFile, data)
+	}
+	if err != nil {
+		log.Printf("Error: could not write landscape cache %v: %v", s.CacheFile, err)
+	}
+}
@@ -0,0 +1,108 @@
+package landscape
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPSource(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "landscapes")
+	defer os.RemoveAll(dir)
+	cacheFile := filepath.Join(dir, "cache.json")
+
+	requests := 0
+	notModified := 0
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(DOCUMENT))
+	}))
+
+	source := NewHTTPSource(origin.URL, cacheFile)
+	assert.Equal(t, origin.URL, source.Name())
+
+	fragments, err := source.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(fragments[0].Document.Landscapes))
+	assert.FileExists(t, cacheFile)
+
+	fragments, err = source.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(fragments[0].Document.Landscapes))
+	assert.Equal(t, 2, requests)
+	assert.Equal(t, 1, notModified)
+
+	origin.Close()
+
+	fragments, err = source.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(fragments[0].Document.Landscapes))
+
+	restarted := NewHTTPSource(origin.URL, cacheFile)
+	fragments, err = restarted.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(fragments[0].Document.Landscapes))
+}
+
+func TestHTTPSourceRevalidatesFromDiskCache(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "landscapes")
+	defer os.RemoveAll(dir)
+	cacheFile := filepath.Join(dir, "cache.json")
+
+	var ifNoneMatch string
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ifNoneMatch = r.Header.Get("If-None-Match")
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(LANDSCAPES))
+	}))
+	defer origin.Close()
+
+	_, err := NewHTTPSource(origin.URL, cacheFile).Load()
+	assert.Nil(t, err)
+	assert.Equal(t, "", ifNoneMatch)
+
+	_, err = NewHTTPSource(origin.URL, cacheFile).Load()
+	assert.Nil(t, err)
+	assert.Equal(t, `"v1"`, ifNoneMatch)
+}
+
+func TestHTTPSourceOriginFailure(t *testing.T) {
+	body := DOCUMENT
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if body == "" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	defer origin.Close()
+
+	source := NewHTTPSource(origin.URL, "")
+
+	_, err := source.Load()
+	assert.Nil(t, err)
+
+	body = "this is not json"
+	fragments, err := source.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(fragments[0].Document.Landscapes))
+
+	body = ""
+	fragments, err = source.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(fragments[0].Document.Landscapes))
+
+	_, err = NewHTTPSource(origin.URL, "").Load()
+	assert.NotNil(t, err)
+}
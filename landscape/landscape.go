@@ -1,39 +1,11 @@
 package landscape
 
-import (
-	"encoding/json"
-	"log"
-	"os"
-)
-
-var (
-	jsonStr string
-)
-
-// Landscapes data structure
-type Landscapes map[string]struct {
+// Landscape describes the endpoints and labels of a single landscape
+type Landscape struct {
 	CloudController string   `json:"cloudcontroller"`
 	Uaa             string   `json:"uaa"`
 	Labels          []string `json:"labels"`
 }
 
-// Get returns a lookup data structure
-func Get() Landscapes {
-	str := os.Getenv("LANDSCAPES")
-
-	if str == "" {
-		log.Println("LANDSCAPES environment variable not set")
-		return Landscapes{}
-	}
-
-	data := Landscapes{}
-
-	err := json.Unmarshal([]byte(str), &data)
-	if err != nil {
-		log.Printf("Error: %v", err)
-		log.Printf("env was: %v", "LANDSCAPES")
-		log.Printf("json object was: %v", str)
-	}
-
-	return data
-}
+// Landscapes data structure
+type Landscapes map[string]Landscape
@@ -0,0 +1,83 @@
+package landscape
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Conflict reports a landscape defined by more than one origin. The
+// definition of the origin with the higher precedence wins.
+type Conflict struct {
+	Landscape  string `json:"landscape"`
+	Origin     string `json:"origin"`
+	Overridden string `json:"overridden"`
+}
+
+func (c Conflict) String() string {
+	return fmt.Sprintf("landscape %v from %v overrides %v", c.Landscape, c.Origin, c.Overridden)
+}
+
+// Set is a resolved set of landscapes together with the origin of each entry
+type Set struct {
+	Landscapes Landscapes        `json:"landscapes"`
+	Provenance map[string]string `json:"provenance"`
+	Conflicts  []Conflict        `json:"conflicts"`
+	Origins    []string          `json:"origins"`
+	// Commit is the SHA of the commit of the Git backed fragment with the
+	// highest precedence, empty if no fragment was read from Git
+	Commit string `json:"commit,omitempty"`
+	// Revision is the number of the last revision of the registry changing the landscapes
+	Revision int64 `json:"revision"`
+}
+
+// Merge combines fragments given in ascending precedence. A landscape
+// definition replaces a definition of the same name from an earlier fragment,
+// non empty default fields override the ones of earlier fragments. The merged
+// document is resolved afterwards, so landscapes may extend landscapes from
+// other fragments.
+func Merge(fragments []Fragment) (*Set, error) {
+	merged := &Document{Landscapes: map[string]Definition{}}
+	set := &Set{
+		Provenance: map[string]string{},
+		Conflicts:  []Conflict{},
+		Origins:    []string{},
+	}
+
+	for _, fragment := range fragments {
+		set.Origins = append(set.Origins, fragment.Origin)
+		if fragment.Commit != "" {
+			set.Commit = fragment.Commit
+		}
+		merged.Defaults = inheritDefaults(merged.Defaults, fragment.Document.Defaults)
+
+		names := make([]string, 0, len(fragment.Document.Landscapes))
+		for name := range fragment.Document.Landscapes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			if origin, ok := set.Provenance[name]; ok {
+				set.Conflicts = append(set.Conflicts, Conflict{Landscape: name, Origin: fragment.Origin, Overridden: origin})
+			}
+			merged.Landscapes[name] = fragment.Document.Landscapes[name]
+			set.Provenance[name] = fragment.Origin
+		}
+	}
+
+	landscapes, err := merged.Resolve()
+	if err != nil {
+		return nil, err
+	}
+	set.Landscapes = landscapes
+
+	return set, nil
+}
+
+func inheritDefaults(base, def Definition) Definition {
+	result := inherit(base, def)
+	if len(def.Labels) > 0 {
+		result.Labels = def.Labels
+	}
+	return result
+}
@@ -0,0 +1,51 @@
+package landscape
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func fragment(t *testing.T, origin string, document string) Fragment {
+	doc, err := ParseDocument([]byte(document))
+	assert.Nil(t, err)
+	return Fragment{Origin: origin, Document: doc}
+}
+
+func TestMerge(t *testing.T) {
+	set, err := Merge([]Fragment{
+		fragment(t, "global", DOCUMENT),
+		fragment(t, "team", `{"landscapes": {"cf-eu10-002": {"extends": "cf-eu10", "labels": ["team"]}, "cf-team": {"extends": "cf-eu10"}}}`),
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, 5, len(set.Landscapes))
+	assert.Equal(t, []string{"global", "team"}, set.Origins)
+
+	assert.Equal(t, "global", set.Provenance["cf-eu10"])
+	assert.Equal(t, "team", set.Provenance["cf-eu10-002"])
+	assert.Equal(t, "team", set.Provenance["cf-team"])
+
+	assert.Equal(t, []string{"team", "master", "aws"}, set.Landscapes["cf-eu10-002"].Labels)
+	assert.Equal(t, "https://api.cf.team.hana.ondemand.com", set.Landscapes["cf-team"].CloudController)
+
+	assert.Equal(t, []Conflict{{Landscape: "cf-eu10-002", Origin: "team", Overridden: "global"}}, set.Conflicts)
+}
+
+func TestMergeDefaults(t *testing.T) {
+	set, err := Merge([]Fragment{
+		fragment(t, "global", DOCUMENT),
+		fragment(t, "team", `{"defaults": {"uaa": "https://uaa.example.com"}, "landscapes": {}}`),
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, "https://api.cf.eu10.hana.ondemand.com", set.Landscapes["cf-eu10"].CloudController)
+	assert.Equal(t, "https://uaa.example.com", set.Landscapes["cf-eu10"].Uaa)
+}
+
+func TestMergeError(t *testing.T) {
+	_, err := Merge([]Fragment{
+		fragment(t, "team", `{"landscapes": {"cf-team": {"extends": "cf-eu10"}}}`),
+	})
+	assert.NotNil(t, err)
+}
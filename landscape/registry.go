@@ -0,0 +1,309 @@
+package landscape
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Listener is notified with the new revision whenever the active set changes
+type Listener func(before, after *Set, revision Revision)
+
+// Revision is a change of the active landscape set. Revision numbers
+// increase monotonically with every reload that changes the landscapes.
+// Sources lists the origins of the changed landscapes, Landscapes is the
+// complete set after the change.
+type Revision struct {
+	Number     int64      `json:"revision"`
+	Time       time.Time  `json:"time"`
+	Sources    []string   `json:"sources"`
+	Commit     string     `json:"commit,omitempty"`
+	Changes    []Change   `json:"changes,omitempty"`
+	Landscapes Landscapes `json:"landscapes,omitempty"`
+}
+
+const (
+	// historySize is the number of revisions kept for watchers to resume
+	historySize = 100
+	// watchBuffer is the number of revisions buffered per watcher
+	watchBuffer = 16
+)
+
+// Registry holds the active landscape set loaded from an ordered list of sources
+type Registry struct {
+	sources []Source
+
+	reloadMutex sync.Mutex
+
+	mutex     sync.RWMutex
+	current   *Set
+	listeners []Listener
+	history   []Revision
+	watchers  map[chan Revision]struct{}
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewRegistry creates a registry for the sources given in ascending precedence.
+// The registry is empty until Reload is called.
+func NewRegistry(sources ...Source) *Registry {
+	return &Registry{
+		sources: sources,
+		current: &Set{
+			Landscapes: Landscapes{},
+			Provenance: map[string]string{},
+			Conflicts:  []Conflict{},
+			Origins:    []string{},
+		},
+		watchers: map[chan Revision]struct{}{},
+	}
+}
+
+// Sources returns the sources of the registry in ascending precedence
+func (r *Registry) Sources() []Source {
+	return r.sources
+}
+
+// Reload reads and merges all sources. On error the active set is kept.
+func (r *Registry) Reload() error {
+	r.reloadMutex.Lock()
+	defer r.reloadMutex.Unlock()
+
+	set, err := r.load("", nil)
+	if err != nil {
+		return err
+	}
+
+	for _, conflict := range set.Conflicts {
+		log.Printf("Warning: %v", conflict)
+	}
+
+	r.mutex.Lock()
+	before := r.current
+	changes := Diff(before.Landscapes, set.Landscapes)
+	set.Revision = before.Revision
+
+	var revision Revision
+	if len(changes) > 0 {
+		set.Revision++
+		revision = newRevision(set, before, changes)
+		r.publish(revision)
+	}
+	r.current = set
+	listeners := r.listeners
+	r.mutex.Unlock()
+
+	if len(changes) > 0 {
+		for _, listener := range listeners {
+			listener(before, set, revision)
+		}
+	}
+
+	return nil
+}
+
+func newRevision(set *Set, before *Set, changes []Change) Revision {
+	revision := Revision{
+		Number:     set.Revision,
+		Time:       time.Now().UTC(),
+		Sources:    []string{},
+		Commit:     set.Commit,
+		Changes:    changes,
+		Landscapes: set.Landscapes,
+	}
+
+	seen := map[string]bool{}
+	for i, change := range changes {
+		origin, ok := set.Provenance[change.Name]
+		if !ok {
+			origin = before.Provenance[change.Name]
+		}
+		changes[i].Origin = origin
+
+		if origin != "" && !seen[origin] {
+			seen[origin] = true
+			revision.Sources = append(revision.Sources, origin)
+		}
+	}
+	sort.Strings(revision.Sources)
+	return revision
+}
+
+// Restore activates the landscapes of a revision persisted before a restart,
+// so the next reload reports the changes since then and continues the
+// revision numbers. It has no effect once the registry has a revision.
+func (r *Registry) Restore(revision Revision) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.current.Revision > 0 {
+		return
+	}
+
+	r.current = &Set{
+		Landscapes: revision.Landscapes,
+		Provenance: map[string]string{},
+		Conflicts:  []Conflict{},
+		Origins:    []string{},
+		Commit:     revision.Commit,
+		Revision:   revision.Number,
+	}
+	if r.current.Landscapes == nil {
+		r.current.Landscapes = Landscapes{}
+	}
+}
+
+// publish adds revision to the history and sends it to all watchers, a
+// watcher not keeping up is closed. Must be called with the mutex locked.
+func (r *Registry) publish(revision Revision) {
+	r.history = append(r.history, revision)
+	if len(r.history) > historySize {
+		r.history = r.history[len(r.history)-historySize:]
+	}
+
+	for watcher := range r.watchers {
+		select {
+		case watcher <- revision:
+		default:
+			log.Printf("Warning: watcher does not keep up, close it at revision %v", revision.Number)
+			delete(r.watchers, watcher)
+			close(watcher)
+		}
+	}
+}
+
+// Revisions returns the revisions after revision since. If the history does
+// not reach back to since, false is returned and the caller has to start over
+// from the current set.
+func (r *Registry) Revisions(since int64) ([]Revision, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	if since > r.current.Revision {
+		return nil, false
+	}
+	if since == r.current.Revision {
+		return []Revision{}, true
+	}
+	if len(r.history) == 0 || r.history[0].Number > since+1 {
+		return nil, false
+	}
+
+	revisions := []Revision{}
+	for _, revision := range r.history {
+		if revision.Number > since {
+			revisions = append(revisions, revision)
+		}
+	}
+	return revisions, true
+}
+
+// Watch returns the set active at subscription time together with a channel
+// receiving all later revisions. The channel is closed when cancel is called
+// or when the watcher does not keep up.
+func (r *Registry) Watch() (current *Set, revisions <-chan Revision, cancel func()) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	watcher := make(chan Revision, watchBuffer)
+	r.watchers[watcher] = struct{}{}
+
+	cancel = func() {
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+
+		if _, ok := r.watchers[watcher]; ok {
+			delete(r.watchers, watcher)
+			close(watcher)
+		}
+	}
+	return r.current, watcher, cancel
+}
+
+// OnChange registers a listener called after a reload changed the landscapes
+func (r *Registry) OnChange(listener Listener) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.listeners = append(r.listeners, listener)
+}
+
+// Preview merges all sources like Reload but uses fragments instead of the
+// fragments of the source named origin, or appends them if there is no such
+// source. The active set is not changed.
+func (r *Registry) Preview(origin string, fragments []Fragment) (*Set, error) {
+	return r.load(origin, fragments)
+}
+
+func (r *Registry) load(origin string, replacement []Fragment) (*Set, error) {
+	var fragments []Fragment
+	replaced := false
+	for _, source := range r.sources {
+		if origin != "" && source.Name() == origin {
+			fragments = append(fragments, replacement...)
+			replaced = true
+			continue
+		}
+
+		loaded, err := source.Load()
+		if err != nil {
+			return nil, err
+		}
+		fragments = append(fragments, loaded...)
+	}
+	if !replaced {
+		fragments = append(fragments, replacement...)
+	}
+
+	return Merge(fragments)
+}
+
+// Current returns the active landscape set
+func (r *Registry) Current() *Set {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return r.current
+}
+
+// Landscapes returns the active landscapes
+func (r *Registry) Landscapes() Landscapes {
+	return r.Current().Landscapes
+}
+
+// Start reloads the sources every interval until Stop is called
+func (r *Registry) Start(interval time.Duration) {
+	r.stop = make(chan struct{})
+	r.done = make(chan struct{})
+
+	go func() {
+		defer close(r.done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := r.Reload(); err != nil {
+					log.Printf("Error: reload landscapes: %v", err)
+				}
+			case <-r.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends reloading started by Start
+func (r *Registry) Stop() {
+	if r.stop == nil {
+		return
+	}
+
+	close(r.stop)
+	<-r.done
+	r.stop = nil
+}
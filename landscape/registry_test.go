@@ -0,0 +1,169 @@
+package landscape
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistryReload(t *testing.T) {
+	source := &DocumentSource{Origin: "env:LANDSCAPES", Data: []byte(LANDSCAPES)}
+	registry := NewRegistry(source)
+	assert.Equal(t, 0, len(registry.Landscapes()))
+
+	err := registry.Reload()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(registry.Landscapes()))
+	assert.Equal(t, "env:LANDSCAPES", registry.Current().Provenance["cf-eu10"])
+
+	source.Data = []byte("this is not json")
+
+	err = registry.Reload()
+	assert.NotNil(t, err)
+	assert.Equal(t, 3, len(registry.Landscapes()))
+}
+
+func TestRegistryStart(t *testing.T) {
+	registry := NewRegistry(DocumentSource{Origin: "env:LANDSCAPES", Data: []byte(LANDSCAPES)})
+	registry.Start(time.Millisecond)
+	defer registry.Stop()
+
+	assert.Eventually(t, func() bool {
+		return len(registry.Landscapes()) == 3
+	}, time.Second, time.Millisecond)
+}
+
+func TestRegistryOnChange(t *testing.T) {
+	var changes []Change
+	source := &DocumentSource{Origin: "env:LANDSCAPES", Data: []byte(LANDSCAPES)}
+	registry := NewRegistry(source)
+	registry.OnChange(func(before, after *Set, revision Revision) {
+		changes = append(changes, revision.Changes...)
+	})
+
+	assert.Nil(t, registry.Reload())
+	assert.Equal(t, 3, len(changes))
+	assert.Equal(t, Added, changes[0].Type)
+
+	changes = nil
+	assert.Nil(t, registry.Reload())
+	assert.Equal(t, 0, len(changes))
+
+	source.Data = []byte(`{"cf-eu10": {"cloudcontroller": "https://api.example.com"}}`)
+	assert.Nil(t, registry.Reload())
+	assert.Equal(t, 3, len(changes))
+	assert.Equal(t, Modified, changes[0].Type)
+	assert.Equal(t, Removed, changes[1].Type)
+}
+
+func TestRegistryRevisions(t *testing.T) {
+	source := &DocumentSource{Origin: "env:LANDSCAPES", Data: []byte(LANDSCAPES)}
+	registry := NewRegistry(source)
+	assert.Equal(t, int64(0), registry.Current().Revision)
+
+	revisions, ok := registry.Revisions(0)
+	assert.True(t, ok)
+	assert.Equal(t, 0, len(revisions))
+
+	assert.Nil(t, registry.Reload())
+	assert.Nil(t, registry.Reload())
+	assert.Equal(t, int64(1), registry.Current().Revision)
+
+	source.Data = []byte(`{"cf-eu10": {"cloudcontroller": "https://api.example.com"}}`)
+	assert.Nil(t, registry.Reload())
+	assert.Equal(t, int64(2), registry.Current().Revision)
+
+	revisions, ok = registry.Revisions(0)
+	assert.True(t, ok)
+	assert.Equal(t, 2, len(revisions))
+	assert.Equal(t, 3, len(revisions[0].Changes))
+
+	revisions, ok = registry.Revisions(1)
+	assert.True(t, ok)
+	assert.Equal(t, 1, len(revisions))
+	assert.Equal(t, int64(2), revisions[0].Number)
+
+	_, ok = registry.Revisions(3)
+	assert.False(t, ok)
+
+	for i := 0; i < historySize; i++ {
+		source.Data = []byte(fmt.Sprintf(`{"cf-eu10": {"cloudcontroller": "https://api%v.example.com"}}`, i))
+		assert.Nil(t, registry.Reload())
+	}
+
+	_, ok = registry.Revisions(1)
+	assert.False(t, ok)
+	revisions, ok = registry.Revisions(2)
+	assert.True(t, ok)
+	assert.Equal(t, historySize, len(revisions))
+}
+
+func TestRegistryRevisionSources(t *testing.T) {
+	source := &DocumentSource{Origin: "env:LANDSCAPES", Data: []byte(LANDSCAPES)}
+	registry := NewRegistry(source)
+	assert.Nil(t, registry.Reload())
+
+	revisions, _ := registry.Revisions(0)
+	assert.Equal(t, []string{"env:LANDSCAPES"}, revisions[0].Sources)
+	assert.Equal(t, "env:LANDSCAPES", revisions[0].Changes[0].Origin)
+	assert.Equal(t, 3, len(revisions[0].Landscapes))
+	assert.False(t, revisions[0].Time.IsZero())
+}
+
+func TestRegistryRestore(t *testing.T) {
+	source := &DocumentSource{Origin: "env:LANDSCAPES", Data: []byte(`{"cf-eu10": {"cloudcontroller": "https://api.example.com"}}`)}
+	registry := NewRegistry(source)
+	registry.Restore(Revision{Number: 7, Landscapes: Landscapes{
+		"cf-eu10": {CloudController: "https://api.old.example.com", Labels: []string{}},
+	}})
+	assert.Equal(t, int64(7), registry.Current().Revision)
+
+	assert.Nil(t, registry.Reload())
+	revisions, ok := registry.Revisions(7)
+	assert.True(t, ok)
+	assert.Equal(t, 1, len(revisions))
+	assert.Equal(t, int64(8), revisions[0].Number)
+	assert.Equal(t, []FieldChange{{Field: "cloudcontroller", Before: "https://api.old.example.com", After: "https://api.example.com"}}, revisions[0].Changes[0].Fields)
+
+	registry.Restore(Revision{Number: 1})
+	assert.Equal(t, int64(8), registry.Current().Revision)
+}
+
+func TestRegistryWatch(t *testing.T) {
+	source := &DocumentSource{Origin: "env:LANDSCAPES", Data: []byte(LANDSCAPES)}
+	registry := NewRegistry(source)
+	current, revisions, cancel := registry.Watch()
+	assert.Equal(t, int64(0), current.Revision)
+
+	assert.Nil(t, registry.Reload())
+
+	revision := <-revisions
+	assert.Equal(t, int64(1), revision.Number)
+	assert.Equal(t, 3, len(revision.Changes))
+
+	cancel()
+	cancel()
+
+	_, open := <-revisions
+	assert.False(t, open)
+}
+
+func TestRegistryWatchSlowWatcher(t *testing.T) {
+	source := &DocumentSource{Origin: "env:LANDSCAPES"}
+	registry := NewRegistry(source)
+	_, revisions, cancel := registry.Watch()
+	defer cancel()
+
+	for i := 0; i <= watchBuffer; i++ {
+		source.Data = []byte(fmt.Sprintf(`{"cf-eu10": {"cloudcontroller": "https://api%v.example.com"}}`, i))
+		assert.Nil(t, registry.Reload())
+	}
+
+	count := 0
+	for range revisions {
+		count++
+	}
+	assert.Equal(t, watchBuffer, count)
+}
@@ -0,0 +1,260 @@
+package landscape
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	varName       string = "name"
+	varNameSuffix string = "name-suffix"
+)
+
+var templateVar = regexp.MustCompile(`{{\s*([A-Za-z0-9_.-]+)\s*}}`)
+
+// Definition is a landscape as written in the configuration. Empty fields are
+// inherited from the extended landscape or the defaults section, labels are
+// added to the inherited ones.
+type Definition struct {
+	Extends         string            `json:"extends,omitempty"`
+	CloudController string            `json:"cloudcontroller,omitempty"`
+	Uaa             string            `json:"uaa,omitempty"`
+	Labels          []string          `json:"labels,omitempty"`
+	Vars            map[string]string `json:"vars,omitempty"`
+}
+
+// Document is the configuration format of landscapes with a defaults section.
+//
+//	{
+//	  "defaults": {
+//	    "cloudcontroller": "https://api.cf.{{name-suffix}}.hana.ondemand.com",
+//	    "uaa": "https://uaa.cf.{{name-suffix}}.hana.ondemand.com",
+//	    "labels": ["aws"]
+//	  },
+//	  "landscapes": {
+//	    "cf-eu10": {"labels": ["master"]},
+//	    "cf-eu10-001": {"labels": ["scaleout"]},
+//	    "cf-eu10-002": {"extends": "cf-eu10-001"}
+//	  }
+//	}
+//
+// URLs may use the variables {{name}}, {{name-suffix}} (the name without its
+// first dash separated segment) and any variable declared in vars.
+type Document struct {
+	Defaults   Definition            `json:"defaults,omitempty"`
+	Landscapes map[string]Definition `json:"landscapes"`
+}
+
+// ParseDocument reads a landscape document. A plain map of landscape names to
+// definitions, as used by the LANDSCAPES environment variable, is accepted too.
+//
+// The formats are told apart by their shape: data is a document if it has a
+// landscapes key and decodes as document without unknown fields. Otherwise a
+// plain map with a landscape named landscapes is tried, which decodes as map
+// of definitions without unknown fields. The error of the document is
+// reported if neither fits.
+func ParseDocument(data []byte) (*Document, error) {
+	var probe map[string]json.RawMessage
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return nil, err
+	}
+
+	doc := &Document{}
+	if _, ok := probe["landscapes"]; ok {
+		if err := decodeStrict(data, doc); err != nil {
+			var landscapes map[string]Definition
+			if decodeStrict(data, &landscapes) != nil {
+				return nil, err
+			}
+			doc = &Document{Landscapes: landscapes}
+		}
+	} else if err := json.Unmarshal(data, &doc.Landscapes); err != nil {
+		return nil, err
+	}
+
+	if doc.Landscapes == nil {
+		doc.Landscapes = map[string]Definition{}
+	}
+	return doc, nil
+}
+
+// decodeStrict decodes data into v and fails on unknown fields
+func decodeStrict(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
+
+// Clone returns a deep copy of the document
+func (d *Document) Clone() *Document {
+	clone := &Document{
+		Defaults:   d.Defaults.clone(),
+		Landscapes: make(map[string]Definition, len(d.Landscapes)),
+	}
+	for name, def := range d.Landscapes {
+		clone.Landscapes[name] = def.clone()
+	}
+	return clone
+}
+
+func (d Definition) clone() Definition {
+	clone := d
+	if d.Labels != nil {
+		clone.Labels = append([]string{}, d.Labels...)
+	}
+	if d.Vars != nil {
+		clone.Vars = make(map[string]string, len(d.Vars))
+		for key, value := range d.Vars {
+			clone.Vars[key] = value
+		}
+	}
+	return clone
+}
+
+// Parse reads a landscape document and resolves it
+func Parse(data []byte) (Landscapes, error) {
+	doc, err := ParseDocument(data)
+	if err != nil {
+		return nil, err
+	}
+	return doc.Resolve()
+}
+
+// Resolve expands defaults, extends and URL templates of all landscapes
+func (d *Document) Resolve() (Landscapes, error) {
+	r := &resolver{doc: d, resolved: map[string]Definition{}, active: map[string]bool{}}
+
+	names := make([]string, 0, len(d.Landscapes))
+	for name := range d.Landscapes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	result := Landscapes{}
+	for _, name := range names {
+		def, err := r.resolve(name, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		landscape, err := expand(name, def)
+		if err != nil {
+			return nil, err
+		}
+		result[name] = landscape
+	}
+	return result, nil
+}
+
+type resolver struct {
+	doc      *Document
+	resolved map[string]Definition
+	active   map[string]bool
+}
+
+func (r *resolver) resolve(name string, chain []string) (Definition, error) {
+	if def, ok := r.resolved[name]; ok {
+		return def, nil
+	}
+
+	chain = append(chain, name)
+	if r.active[name] {
+		return Definition{}, fmt.Errorf("landscape %v: cyclic extends %v", chain[0], strings.Join(chain, " -> "))
+	}
+
+	def, ok := r.doc.Landscapes[name]
+	if !ok {
+		return Definition{}, fmt.Errorf("landscape %v: extends unknown landscape %v", chain[len(chain)-2], name)
+	}
+
+	base := r.doc.Defaults
+	if def.Extends != "" {
+		r.active[name] = true
+		parent, err := r.resolve(def.Extends, chain)
+		delete(r.active, name)
+		if err != nil {
+			return Definition{}, err
+		}
+		base = parent
+	}
+
+	merged := inherit(base, def)
+	r.resolved[name] = merged
+	return merged, nil
+}
+
+func inherit(base, def Definition) Definition {
+	result := Definition{
+		CloudController: base.CloudController,
+		Uaa:             base.Uaa,
+		Vars:            map[string]string{},
+	}
+
+	if def.CloudController != "" {
+		result.CloudController = def.CloudController
+	}
+	if def.Uaa != "" {
+		result.Uaa = def.Uaa
+	}
+
+	for key, value := range base.Vars {
+		result.Vars[key] = value
+	}
+	for key, value := range def.Vars {
+		result.Vars[key] = value
+	}
+
+	seen := map[string]bool{}
+	for _, labels := range [][]string{def.Labels, base.Labels} {
+		for _, label := range labels {
+			if !seen[label] {
+				seen[label] = true
+				result.Labels = append(result.Labels, label)
+			}
+		}
+	}
+	return result
+}
+
+func expand(name string, def Definition) (Landscape, error) {
+	vars := map[string]string{
+		varName:       name,
+		varNameSuffix: name,
+	}
+	if i := strings.Index(name, "-"); i >= 0 {
+		vars[varNameSuffix] = name[i+1:]
+	}
+	for key, value := range def.Vars {
+		vars[key] = value
+	}
+
+	var err error
+	replace := func(s string) string {
+		return templateVar.ReplaceAllStringFunc(s, func(match string) string {
+			key := templateVar.FindStringSubmatch(match)[1]
+			value, ok := vars[key]
+			if !ok && err == nil {
+				err = fmt.Errorf("landscape %v: unknown template variable %v in %q", name, key, s)
+			}
+			return value
+		})
+	}
+
+	landscape := Landscape{
+		CloudController: replace(def.CloudController),
+		Uaa:             replace(def.Uaa),
+		Labels:          []string{},
+	}
+	for _, label := range def.Labels {
+		landscape.Labels = append(landscape.Labels, replace(label))
+	}
+
+	if err != nil {
+		return Landscape{}, err
+	}
+	return landscape, nil
+}
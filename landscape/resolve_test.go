@@ -0,0 +1,124 @@
+package landscape
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	DOCUMENT string = `
+	{
+		"defaults": {
+			"cloudcontroller": "https://api.cf.{{name-suffix}}.hana.ondemand.com",
+			"uaa": "https://uaa.cf.{{name-suffix}}.hana.ondemand.com",
+			"labels": ["aws"]
+		},
+		"landscapes": {
+			"cf-eu10": {
+				"labels": ["master"]
+			},
+			"cf-eu10-001": {
+				"labels": ["scaleout"]
+			},
+			"cf-eu10-002": {
+				"extends": "cf-eu10-001"
+			},
+			"cf-us10": {
+				"uaa": "https://login.{{region}}.example.com",
+				"vars": {"region": "us10"},
+				"labels": ["region={{region}}"]
+			}
+		}
+	}
+	`
+	LANDSCAPES string = `
+	{
+		"cf-eu10": {
+			"cloudcontroller": "https://api.cf.eu10.hana.ondemand.com",
+			"uaa": "https://uaa.cf.eu10.hana.ondemand.com",
+			"labels": [
+				"master",
+				"aws"
+				]
+		},
+		"cf-eu10-001": {
+			"cloudcontroller": "https://api.cf.eu10-001.hana.ondemand.com",
+			"uaa": "https://uaa.cf.eu10-001.hana.ondemand.com",
+			"labels": [
+				"scaleout",
+				"aws"
+				]
+		},
+		"cf-eu10-002": {
+			"cloudcontroller": "https://api.cf.eu10-002.hana.ondemand.com",
+			"uaa": "https://uaa.cf.eu10-002.hana.ondemand.com",
+			"labels": [
+				"scaleout",
+				"aws"
+				]
+		}
+	}
+  `
+)
+
+func TestParseDocument(t *testing.T) {
+	data, err := Parse([]byte(DOCUMENT))
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(data))
+
+	assert.Equal(t, "https://api.cf.eu10.hana.ondemand.com", data["cf-eu10"].CloudController)
+	assert.Equal(t, "https://uaa.cf.eu10.hana.ondemand.com", data["cf-eu10"].Uaa)
+	assert.Equal(t, []string{"master", "aws"}, data["cf-eu10"].Labels)
+
+	assert.Equal(t, "https://api.cf.eu10-002.hana.ondemand.com", data["cf-eu10-002"].CloudController)
+	assert.Equal(t, "https://uaa.cf.eu10-002.hana.ondemand.com", data["cf-eu10-002"].Uaa)
+	assert.Equal(t, []string{"scaleout", "aws"}, data["cf-eu10-002"].Labels)
+
+	assert.Equal(t, "https://api.cf.us10.hana.ondemand.com", data["cf-us10"].CloudController)
+	assert.Equal(t, "https://login.us10.example.com", data["cf-us10"].Uaa)
+	assert.Equal(t, []string{"region=us10", "aws"}, data["cf-us10"].Labels)
+}
+
+func TestParseLegacyDocument(t *testing.T) {
+	data, err := Parse([]byte(LANDSCAPES))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(data))
+	assert.Equal(t, "https://api.cf.eu10-001.hana.ondemand.com", data["cf-eu10-001"].CloudController)
+	assert.Equal(t, []string{"scaleout", "aws"}, data["cf-eu10-001"].Labels)
+}
+
+func TestParseLegacyLandscapeNamedLandscapes(t *testing.T) {
+	for _, document := range []string{
+		`{"landscapes": {"cloudcontroller": "https://api.example.com", "labels": ["aws"]}}`,
+		`{"landscapes": {"labels": ["aws"]}, "defaults": {"cloudcontroller": "https://api.example.com"}}`,
+	} {
+		doc, err := ParseDocument([]byte(document))
+		assert.Nil(t, err, document)
+		assert.Equal(t, []string{"aws"}, doc.Landscapes["landscapes"].Labels, document)
+	}
+
+	doc, err := ParseDocument([]byte(`{"landscapes": {"labels": {"cloudcontroller": "https://api.example.com"}}}`))
+	assert.Nil(t, err)
+	assert.Equal(t, "https://api.example.com", doc.Landscapes["labels"].CloudController)
+}
+
+func TestParseDocumentErrors(t *testing.T) {
+	tests := []struct {
+		document string
+		message  string
+	}{
+		{`{"landscapes": {"a": {"extends": "b"}}}`, "extends unknown landscape b"},
+		{`{"landscapes": {"a": {"extends": "b"}, "b": {"extends": "a"}}}`, "cyclic extends a -> b -> a"},
+		{`{"landscapes": {"a": {"uaa": "https://{{region}}"}}}`, "unknown template variable region"},
+		{`{"landscapes": {"a": {"url": "https://example.com"}}}`, "unknown field"},
+		{`not json`, "invalid character"},
+	}
+
+	for _, test := range tests {
+		_, err := Parse([]byte(test.document))
+		if assert.NotNil(t, err, test.document) {
+			assert.Contains(t, err.Error(), test.message, test.document)
+		}
+	}
+}
@@ -0,0 +1,438 @@
+package landscape
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Selector matches a landscape by its labels.
+//
+// Selectors are written in a small expression language:
+//
+//	aws                      label aws is present
+//	!master                  label master is absent
+//	aws && !master           both must hold
+//	master || scaleout       either must hold
+//	aws, scaleout            comma separated terms must all hold
+//	region = eu10            label region=eu10 is present
+//	region != eu10           label region=eu10 is absent
+//	region in (eu10, us10)   one of region=eu10, region=us10 is present
+//	region notin (eu10)      none of the listed values is present
+//
+// Labels of the form key=value carry a value, a bare label only a key.
+// The comma binds weaker than ||, which binds weaker than &&.
+type Selector interface {
+	Matches(labels []string) bool
+	String() string
+}
+
+// SyntaxError reports an invalid selector expression
+type SyntaxError struct {
+	Selector string
+	Pos      int
+	Msg      string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("selector syntax error at position %d: %s (selector: %q)", e.Pos, e.Msg, e.Selector)
+}
+
+// ParseSelector parses a selector expression. An empty expression selects everything.
+func ParseSelector(expr string) (Selector, error) {
+	p := &selectorParser{expr: expr}
+	p.next()
+
+	if p.tok.kind == tokenEOF {
+		return allSelector{}, nil
+	}
+
+	sel, err := p.parseList()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokenEOF {
+		return nil, p.errorf("unexpected %v", p.tok)
+	}
+	return sel, nil
+}
+
+// Filter returns the landscapes matched by the selector
+func (l Landscapes) Filter(sel Selector) Landscapes {
+	result := Landscapes{}
+	for name, landscape := range l {
+		if sel.Matches(landscape.Labels) {
+			result[name] = landscape
+		}
+	}
+	return result
+}
+
+type allSelector struct{}
+
+func (allSelector) Matches(labels []string) bool { return true }
+func (allSelector) String() string               { return "" }
+
+type andSelector []Selector
+
+func (s andSelector) Matches(labels []string) bool {
+	for _, sel := range s {
+		if !sel.Matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s andSelector) String() string {
+	return joinSelectors(s, " && ")
+}
+
+type orSelector []Selector
+
+func (s orSelector) Matches(labels []string) bool {
+	for _, sel := range s {
+		if sel.Matches(labels) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s orSelector) String() string {
+	return joinSelectors(s, " || ")
+}
+
+type notSelector struct {
+	sel Selector
+}
+
+func (s notSelector) Matches(labels []string) bool {
+	return !s.sel.Matches(labels)
+}
+
+func (s notSelector) String() string {
+	return "!" + joinSelectors([]Selector{s.sel}, "")
+}
+
+type existsSelector struct {
+	key string
+}
+
+func (s existsSelector) Matches(labels []string) bool {
+	for _, label := range labels {
+		key, _ := splitLabel(label)
+		if key == s.key {
+			return true
+		}
+	}
+	return false
+}
+
+func (s existsSelector) String() string {
+	return s.key
+}
+
+type inSelector struct {
+	key    string
+	values []string
+}
+
+func (s inSelector) Matches(labels []string) bool {
+	for _, label := range labels {
+		key, value := splitLabel(label)
+		if key != s.key {
+			continue
+		}
+		for _, v := range s.values {
+			if v == value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s inSelector) String() string {
+	if len(s.values) == 1 {
+		return s.key + " = " + s.values[0]
+	}
+	return s.key + " in (" + strings.Join(s.values, ", ") + ")"
+}
+
+func joinSelectors(selectors []Selector, sep string) string {
+	parts := make([]string, len(selectors))
+	for i, sel := range selectors {
+		switch sel.(type) {
+		case andSelector, orSelector:
+			parts[i] = "(" + sel.String() + ")"
+		default:
+			parts[i] = sel.String()
+		}
+	}
+	return strings.Join(parts, sep)
+}
+
+func splitLabel(label string) (string, string) {
+	if i := strings.Index(label, "="); i >= 0 {
+		return strings.TrimSpace(label[:i]), strings.TrimSpace(label[i+1:])
+	}
+	return strings.TrimSpace(label), ""
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenInvalid
+	tokenIdent
+	tokenAnd
+	tokenOr
+	tokenNot
+	tokenComma
+	tokenEqual
+	tokenNotEqual
+	tokenLParen
+	tokenRParen
+	tokenIn
+	tokenNotIn
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t token) String() string {
+	if t.kind == tokenEOF {
+		return "end of selector"
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+type selectorParser struct {
+	expr string
+	pos  int
+	tok  token
+}
+
+func (p *selectorParser) errorf(format string, args ...interface{}) error {
+	return &SyntaxError{Selector: p.expr, Pos: p.tok.pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+func isIdentRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("-_.:/", r)
+}
+
+func (p *selectorParser) next() {
+	for p.pos < len(p.expr) && unicode.IsSpace(rune(p.expr[p.pos])) {
+		p.pos++
+	}
+
+	start := p.pos
+	if p.pos >= len(p.expr) {
+		p.tok = token{kind: tokenEOF, pos: start}
+		return
+	}
+
+	two := ""
+	if p.pos+1 < len(p.expr) {
+		two = p.expr[p.pos : p.pos+2]
+	}
+
+	switch {
+	case two == "&&":
+		p.pos += 2
+		p.tok = token{kind: tokenAnd, text: two, pos: start}
+	case two == "||":
+		p.pos += 2
+		p.tok = token{kind: tokenOr, text: two, pos: start}
+	case two == "!=":
+		p.pos += 2
+		p.tok = token{kind: tokenNotEqual, text: two, pos: start}
+	case two == "==":
+		p.pos += 2
+		p.tok = token{kind: tokenEqual, text: two, pos: start}
+	default:
+		c := p.expr[p.pos]
+		kinds := map[byte]tokenKind{'!': tokenNot, ',': tokenComma, '=': tokenEqual, '(': tokenLParen, ')': tokenRParen}
+		if kind, ok := kinds[c]; ok {
+			p.pos++
+			p.tok = token{kind: kind, text: string(c), pos: start}
+			return
+		}
+
+		for p.pos < len(p.expr) {
+			r := rune(p.expr[p.pos])
+			if r >= 0x80 || isIdentRune(r) {
+				p.pos++
+				continue
+			}
+			break
+		}
+		if p.pos == start {
+			p.pos++
+			p.tok = token{kind: tokenInvalid, text: p.expr[start:p.pos], pos: start}
+			return
+		}
+
+		text := p.expr[start:p.pos]
+		switch text {
+		case "in":
+			p.tok = token{kind: tokenIn, text: text, pos: start}
+		case "notin":
+			p.tok = token{kind: tokenNotIn, text: text, pos: start}
+		default:
+			p.tok = token{kind: tokenIdent, text: text, pos: start}
+		}
+	}
+}
+
+func (p *selectorParser) parseList() (Selector, error) {
+	var list andSelector
+	for {
+		sel, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, sel)
+
+		if p.tok.kind != tokenComma {
+			break
+		}
+		p.next()
+	}
+	if len(list) == 1 {
+		return list[0], nil
+	}
+	return list, nil
+}
+
+func (p *selectorParser) parseOr() (Selector, error) {
+	var list orSelector
+	for {
+		sel, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, sel)
+
+		if p.tok.kind != tokenOr {
+			break
+		}
+		p.next()
+	}
+	if len(list) == 1 {
+		return list[0], nil
+	}
+	return list, nil
+}
+
+func (p *selectorParser) parseAnd() (Selector, error) {
+	var list andSelector
+	for {
+		sel, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, sel)
+
+		if p.tok.kind != tokenAnd {
+			break
+		}
+		p.next()
+	}
+	if len(list) == 1 {
+		return list[0], nil
+	}
+	return list, nil
+}
+
+func (p *selectorParser) parseUnary() (Selector, error) {
+	switch p.tok.kind {
+	case tokenNot:
+		p.next()
+		sel, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notSelector{sel}, nil
+	case tokenLParen:
+		p.next()
+		sel, err := p.parseList()
+		if err != nil {
+			return nil, err
+		}
+		if p.tok.kind != tokenRParen {
+			return nil, p.errorf("expected \")\" but found %v", p.tok)
+		}
+		p.next()
+		return sel, nil
+	case tokenIdent:
+		return p.parseTerm()
+	case tokenEOF:
+		return nil, p.errorf("unexpected end of selector, expected label")
+	default:
+		return nil, p.errorf("unexpected %v, expected label", p.tok)
+	}
+}
+
+func (p *selectorParser) parseTerm() (Selector, error) {
+	key := p.tok.text
+	p.next()
+
+	switch p.tok.kind {
+	case tokenEqual, tokenNotEqual:
+		negate := p.tok.kind == tokenNotEqual
+		p.next()
+		if p.tok.kind != tokenIdent {
+			return nil, p.errorf("expected value for label %q but found %v", key, p.tok)
+		}
+		var sel Selector = inSelector{key: key, values: []string{p.tok.text}}
+		p.next()
+		if negate {
+			sel = notSelector{sel}
+		}
+		return sel, nil
+	case tokenIn, tokenNotIn:
+		negate := p.tok.kind == tokenNotIn
+		p.next()
+		values, err := p.parseValues(key)
+		if err != nil {
+			return nil, err
+		}
+		var sel Selector = inSelector{key: key, values: values}
+		if negate {
+			sel = notSelector{sel}
+		}
+		return sel, nil
+	default:
+		return existsSelector{key: key}, nil
+	}
+}
+
+func (p *selectorParser) parseValues(key string) ([]string, error) {
+	if p.tok.kind != tokenLParen {
+		return nil, p.errorf("expected \"(\" after in for label %q but found %v", key, p.tok)
+	}
+	p.next()
+
+	var values []string
+	for {
+		if p.tok.kind != tokenIdent {
+			return nil, p.errorf("expected value for label %q but found %v", key, p.tok)
+		}
+		values = append(values, p.tok.text)
+		p.next()
+
+		if p.tok.kind == tokenRParen {
+			p.next()
+			return values, nil
+		}
+		if p.tok.kind != tokenComma {
+			return nil, p.errorf("expected \",\" or \")\" but found %v", p.tok)
+		}
+		p.next()
+	}
+}
@@ -0,0 +1,83 @@
+package landscape
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSelectorMatches(t *testing.T) {
+	labels := []string{"aws", "scaleout", "region=eu10"}
+
+	tests := []struct {
+		selector string
+		expected bool
+	}{
+		{"", true},
+		{"aws", true},
+		{"gcp", false},
+		{"!master", true},
+		{"aws && !master", true},
+		{"aws && master", false},
+		{"master || scaleout", true},
+		{"aws, scaleout", true},
+		{"aws, master", false},
+		{"region", true},
+		{"region = eu10", true},
+		{"region == us10", false},
+		{"region != eu10", false},
+		{"region in (eu10, us10)", true},
+		{"region in (us10)", false},
+		{"region notin (us10, us20)", true},
+		{"!(aws && scaleout)", false},
+		{"gcp || (aws && region in (eu10))", true},
+	}
+
+	for _, test := range tests {
+		sel, err := ParseSelector(test.selector)
+		assert.Nil(t, err, test.selector)
+		assert.Equal(t, test.expected, sel.Matches(labels), test.selector)
+	}
+}
+
+func TestParseSelectorSyntaxError(t *testing.T) {
+	tests := []struct {
+		selector string
+		pos      int
+	}{
+		{"aws &&", 6},
+		{"aws master", 4},
+		{"(aws", 4},
+		{"region in eu10", 10},
+		{"region in (eu10,", 16},
+		{"region =", 8},
+		{"aws & master", 4},
+		{"&& aws", 0},
+	}
+
+	for _, test := range tests {
+		sel, err := ParseSelector(test.selector)
+		assert.Nil(t, sel, test.selector)
+		if assert.IsType(t, &SyntaxError{}, err, test.selector) {
+			assert.Equal(t, test.pos, err.(*SyntaxError).Pos, test.selector)
+		}
+	}
+}
+
+func TestSelectorString(t *testing.T) {
+	sel, err := ParseSelector("!(aws && master) || region in (eu10,us10)")
+	assert.Nil(t, err)
+	assert.Equal(t, "!(aws && master) || region in (eu10, us10)", sel.String())
+}
+
+func TestFilter(t *testing.T) {
+	landscapes, err := Parse([]byte(LANDSCAPES))
+	assert.Nil(t, err)
+	sel, err := ParseSelector("aws && !master")
+	assert.Nil(t, err)
+
+	data := landscapes.Filter(sel)
+	assert.Equal(t, 2, len(data))
+	assert.Contains(t, data, "cf-eu10-001")
+	assert.Contains(t, data, "cf-eu10-002")
+}
@@ -0,0 +1,189 @@
+package landscape
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	defaultCacheFile   string = "lookup-broker-landscapes.json"
+	defaultGitCloneDir string = "lookup-broker-landscapes.git"
+)
+
+// Fragment is a landscape document read from a single origin
+type Fragment struct {
+	Origin   string
+	Document *Document
+	// Commit is the SHA of the commit the document was read from, if any
+	Commit string
+}
+
+// Source provides landscape documents
+type Source interface {
+	// Name identifies the source in logs and provenance information
+	Name() string
+	// Load reads all fragments of the source in ascending precedence
+	Load() ([]Fragment, error)
+}
+
+// DocumentSource provides a landscape document given as data
+type DocumentSource struct {
+	Origin string
+	Data   []byte
+}
+
+// Name of the source
+func (s DocumentSource) Name() string {
+	return s.Origin
+}
+
+// Load the document
+func (s DocumentSource) Load() ([]Fragment, error) {
+	doc, err := ParseDocument(s.Data)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", s.Name(), err)
+	}
+	return []Fragment{{Origin: s.Name(), Document: doc}}, nil
+}
+
+// FileSource reads a landscape document from a file
+type FileSource struct {
+	Path string
+}
+
+// Name of the source
+func (s FileSource) Name() string {
+	return "file:" + s.Path
+}
+
+// Load the document
+func (s FileSource) Load() ([]Fragment, error) {
+	doc, err := readDocument(s.Path)
+	if err != nil {
+		return nil, err
+	}
+	return []Fragment{{Origin: s.Name(), Document: doc}}, nil
+}
+
+// DirSource reads all *.json landscape documents of a directory in
+// lexical order, so later fragments take precedence over earlier ones
+type DirSource struct {
+	Path string
+}
+
+// Name of the source
+func (s DirSource) Name() string {
+	return "dir:" + s.Path
+}
+
+// Load all fragments
+func (s DirSource) Load() ([]Fragment, error) {
+	paths, err := filepath.Glob(filepath.Join(s.Path, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	var fragments []Fragment
+	for _, path := range paths {
+		doc, err := readDocument(path)
+		if err != nil {
+			return nil, err
+		}
+		fragments = append(fragments, Fragment{Origin: "file:" + path, Document: doc})
+	}
+	return fragments, nil
+}
+
+func readDocument(path string) (*Document, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	doc, err := ParseDocument(data)
+	if err != nil {
+		return nil, fmt.Errorf("file:%v: %v", path, err)
+	}
+	return doc, nil
+}
+
+// SourceConfig configures the landscape sources
+type SourceConfig struct {
+	// Files lists landscape documents
+	Files []string
+	// Dir contains landscape fragments
+	Dir string
+	// GitRepository, GitBranch and GitPath locate a landscape document in Git,
+	// the repository is cloned to GitCloneDir
+	GitRepository string
+	GitBranch     string
+	GitPath       string
+	GitCloneDir   string
+	// URL serves a landscape document, the last good copy is kept in CacheFile
+	URL       string
+	CacheFile string
+	// Document is an inline landscape document named DocumentOrigin
+	Document       string
+	DocumentOrigin string
+}
+
+// NewSources returns the sources of config in ascending precedence: the
+// files, the fragments of the directory, the document in Git, the document
+// at the URL and finally the inline document.
+func NewSources(config SourceConfig) []Source {
+	var sources []Source
+
+	for _, path := range config.Files {
+		if strings.TrimSpace(path) != "" {
+			sources = append(sources, FileSource{Path: path})
+		}
+	}
+
+	if config.Dir != "" {
+		sources = append(sources, DirSource{Path: config.Dir})
+	}
+
+	if config.GitRepository != "" {
+		cloneDir := config.GitCloneDir
+		if cloneDir == "" {
+			cloneDir = filepath.Join(os.TempDir(), defaultGitCloneDir)
+		}
+		sources = append(sources, NewGitSource(config.GitRepository, config.GitBranch, config.GitPath, cloneDir))
+	}
+
+	if config.URL != "" {
+		cacheFile := config.CacheFile
+		if cacheFile == "" {
+			cacheFile = filepath.Join(os.TempDir(), defaultCacheFile)
+		}
+		sources = append(sources, NewHTTPSource(config.URL, cacheFile))
+	}
+
+	if config.Document != "" {
+		sources = append(sources, DocumentSource{Origin: config.DocumentOrigin, Data: []byte(config.Document)})
+	}
+
+	return sources
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,88 @@
+package landscape
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeFile(t *testing.T, path string, content string) {
+	err := ioutil.WriteFile(path, []byte(content), 0644)
+	assert.Nil(t, err)
+}
+
+func TestFileSource(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "landscapes")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "global.json")
+	writeFile(t, path, DOCUMENT)
+
+	fragments, err := FileSource{Path: path}.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(fragments))
+	assert.Equal(t, "file:"+path, fragments[0].Origin)
+
+	_, err = FileSource{Path: filepath.Join(dir, "missing.json")}.Load()
+	assert.NotNil(t, err)
+}
+
+func TestDirSource(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "landscapes")
+	defer os.RemoveAll(dir)
+
+	writeFile(t, filepath.Join(dir, "20-team.json"), `{"cf-eu10": {"labels": ["team"]}}`)
+	writeFile(t, filepath.Join(dir, "10-global.json"), LANDSCAPES)
+	writeFile(t, filepath.Join(dir, "README.md"), "not a fragment")
+
+	fragments, err := DirSource{Path: dir}.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(fragments))
+	assert.Equal(t, "file:"+filepath.Join(dir, "10-global.json"), fragments[0].Origin)
+	assert.Equal(t, "file:"+filepath.Join(dir, "20-team.json"), fragments[1].Origin)
+
+	writeFile(t, filepath.Join(dir, "30-broken.json"), "not json")
+
+	_, err = DirSource{Path: dir}.Load()
+	assert.NotNil(t, err)
+}
+
+func TestNewSources(t *testing.T) {
+	sources := NewSources(SourceConfig{
+		Files:          []string{"a.json", " "},
+		URL:            "https://example.com/landscapes.json",
+		Document:       LANDSCAPES,
+		DocumentOrigin: "file:config.json",
+	})
+	assert.Equal(t, 3, len(sources))
+	assert.Equal(t, "file:a.json", sources[0].Name())
+	assert.Equal(t, "https://example.com/landscapes.json", sources[1].Name())
+	assert.Equal(t, "file:config.json", sources[2].Name())
+
+	fragments, err := sources[2].Load()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(fragments[0].Document.Landscapes))
+}
+
+func TestDocumentSource(t *testing.T) {
+	fragments, err := DocumentSource{Origin: "env:LANDSCAPES", Data: []byte(LANDSCAPES)}.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(fragments))
+	assert.Equal(t, "env:LANDSCAPES", fragments[0].Origin)
+
+	for _, data := range []string{
+		"",
+		"not json",
+		`["cf-eu10"]`,
+		`{"cf-eu10": "https://api.example.com"}`,
+		`{"landscapes": {"cf-eu10": {}}, "unknown": true}`,
+	} {
+		_, err := DocumentSource{Origin: "flag:landscapes", Data: []byte(data)}.Load()
+		if assert.NotNil(t, err, data) {
+			assert.Contains(t, err.Error(), "flag:landscapes: ", data)
+		}
+	}
+}
@@ -0,0 +1,481 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sklevenz/lookup-broker/landscape"
+	"github.com/sklevenz/lookup-broker/store"
+)
+
+const (
+	headerWWWAuthenticate    string = "WWW-Authenticate"
+	headerContentDisposition string = "Content-Disposition"
+
+	contentTypeBinary string = "application/octet-stream"
+)
+
+func handleJSON(w http.ResponseWriter, code int, data interface{}) {
+	js, err := json.Marshal(data)
+	if err != nil {
+		handleHTTPError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set(headerContentType, contentTypeJSON)
+	w.WriteHeader(code)
+	w.Write(js)
+}
+
+// adminAuthenticated reports whether r carries the configured admin credentials
+func (b *Broker) adminAuthenticated(r *http.Request) bool {
+	username, password, ok := r.BasicAuth()
+	return ok && b.adminUsername != "" && b.adminPassword != "" &&
+		subtle.ConstantTimeCompare([]byte(username), []byte(b.adminUsername)) == 1 &&
+		subtle.ConstantTimeCompare([]byte(password), []byte(b.adminPassword)) == 1
+}
+
+func (b *Broker) adminAuthHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if b.adminUsername == "" || b.adminPassword == "" {
+			err := errors.New("admin API disabled, no admin credentials configured")
+			log.Printf("Error: %v", err)
+			handleHTTPError(w, http.StatusForbidden, err)
+			return
+		}
+
+		if !b.adminAuthenticated(r) {
+			err := errors.New("invalid admin credentials")
+			log.Printf("Error: %v", err)
+			w.Header().Set(headerWWWAuthenticate, `Basic realm="lookup-broker admin"`)
+			handleHTTPError(w, http.StatusUnauthorized, err)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (b *Broker) provenanceGetHandler(w http.ResponseWriter, r *http.Request) {
+	set := b.registry.Current()
+
+	handleJSON(w, http.StatusOK, map[string]interface{}{
+		"origins":    set.Origins,
+		"provenance": set.Provenance,
+		"conflicts":  set.Conflicts,
+	})
+}
+
+func (b *Broker) latestLandscapeVersion() (*store.LandscapeVersion, error) {
+	version, err := b.store.LandscapeVersion(0)
+	if err == store.ErrNotFound {
+		return &store.LandscapeVersion{Document: &landscape.Document{Landscapes: map[string]landscape.Definition{}}}, nil
+	}
+	return version, err
+}
+
+// saveLandscapes validates document against all landscape sources, stores it
+// as new version and activates it
+func (b *Broker) saveLandscapes(w http.ResponseWriter, r *http.Request, code int, document *landscape.Document, change string) {
+	source := store.LandscapeSource{Store: b.store}
+	if _, err := b.registry.Preview(source.Name(), []landscape.Fragment{{Origin: source.Name(), Document: document}}); err != nil {
+		log.Printf("Error: %v", err)
+		handleHTTPError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	username, _, _ := r.BasicAuth()
+	version, err := b.store.SaveLandscapes(document, username, change)
+	if err != nil {
+		log.Printf("Error: %v", err)
+		handleHTTPError(w, http.StatusInternalServerError, err)
+		return
+	}
+	log.Printf("landscape version %v saved by %v: %v", version.Number, version.Author, version.Change)
+
+	if err := b.registry.Reload(); err != nil {
+		log.Printf("Error: %v", err)
+	}
+
+	version.Document = nil
+	handleJSON(w, code, version)
+}
+
+func (b *Broker) adminLandscapesGetHandler(w http.ResponseWriter, r *http.Request) {
+	version, err := b.latestLandscapeVersion()
+	if err != nil {
+		handleHTTPError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	handleJSON(w, http.StatusOK, version)
+}
+
+func (b *Broker) adminLandscapeGetHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	version, err := b.latestLandscapeVersion()
+	if err != nil {
+		handleHTTPError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	definition, ok := version.Document.Landscapes[name]
+	if !ok {
+		handleHTTPError(w, http.StatusNotFound, fmt.Errorf("landscape %v not found", name))
+		return
+	}
+
+	handleJSON(w, http.StatusOK, definition)
+}
+
+func (b *Broker) adminLandscapePutHandler(w http.ResponseWriter, r *http.Request) {
+	b.landscapesMutex.Lock()
+	defer b.landscapesMutex.Unlock()
+
+	name := mux.Vars(r)["name"]
+	if err := checkLandscapeName(name); err != nil {
+		handleHTTPError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var definition landscape.Definition
+
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&definition); err != nil {
+		log.Printf("Error: %v", err)
+		handleHTTPError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	version, err := b.latestLandscapeVersion()
+	if err != nil {
+		handleHTTPError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	document := version.Document.Clone()
+	code := http.StatusOK
+	if _, ok := document.Landscapes[name]; !ok {
+		code = http.StatusCreated
+	}
+	document.Landscapes[name] = definition
+
+	b.saveLandscapes(w, r, code, document, "put landscape "+name)
+}
+
+func (b *Broker) adminLandscapeDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	b.landscapesMutex.Lock()
+	defer b.landscapesMutex.Unlock()
+
+	name := mux.Vars(r)["name"]
+	if err := checkLandscapeName(name); err != nil {
+		handleHTTPError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	version, err := b.latestLandscapeVersion()
+	if err != nil {
+		handleHTTPError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	document := version.Document.Clone()
+	if _, ok := document.Landscapes[name]; !ok {
+		handleHTTPError(w, http.StatusNotFound, fmt.Errorf("landscape %v not found", name))
+		return
+	}
+	delete(document.Landscapes, name)
+
+	b.saveLandscapes(w, r, http.StatusOK, document, "delete landscape "+name)
+}
+
+// reservedLandscapeNames are the routes below /admin/landscapes, a landscape
+// with such a name could not be read by GET /admin/landscapes/{name}
+var reservedLandscapeNames = map[string]bool{"provenance": true, "versions": true, "revisions": true}
+
+func checkLandscapeName(name string) error {
+	if reservedLandscapeNames[name] {
+		return fmt.Errorf("landscape name %v is reserved", name)
+	}
+	return nil
+}
+
+func (b *Broker) adminVersionsGetHandler(w http.ResponseWriter, r *http.Request) {
+	versions, err := b.store.LandscapeVersions()
+	if err != nil {
+		handleHTTPError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	handleJSON(w, http.StatusOK, versions)
+}
+
+func (b *Broker) landscapeVersion(w http.ResponseWriter, r *http.Request) (*store.LandscapeVersion, bool) {
+	number, _ := strconv.Atoi(mux.Vars(r)["version"])
+	if number == 0 {
+		handleHTTPError(w, http.StatusNotFound, fmt.Errorf("landscape version %v not found", number))
+		return nil, false
+	}
+
+	version, err := b.store.LandscapeVersion(number)
+	if err == store.ErrNotFound {
+		handleHTTPError(w, http.StatusNotFound, fmt.Errorf("landscape version %v not found", number))
+		return nil, false
+	}
+	if err != nil {
+		handleHTTPError(w, http.StatusInternalServerError, err)
+		return nil, false
+	}
+	return version, true
+}
+
+func (b *Broker) adminVersionGetHandler(w http.ResponseWriter, r *http.Request) {
+	version, ok := b.landscapeVersion(w, r)
+	if !ok {
+		return
+	}
+
+	handleJSON(w, http.StatusOK, version)
+}
+
+func (b *Broker) adminVersionRollbackHandler(w http.ResponseWriter, r *http.Request) {
+	b.landscapesMutex.Lock()
+	defer b.landscapesMutex.Unlock()
+
+	version, ok := b.landscapeVersion(w, r)
+	if !ok {
+		return
+	}
+
+	b.saveLandscapes(w, r, http.StatusOK, version.Document.Clone(), fmt.Sprintf("rollback to version %v", version.Number))
+}
+
+func (b *Broker) adminRevisionsGetHandler(w http.ResponseWriter, r *http.Request) {
+	revisions, err := b.store.LandscapeRevisions()
+	if err != nil {
+		handleHTTPError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	handleJSON(w, http.StatusOK, revisions)
+}
+
+func (b *Broker) adminRevisionDiffHandler(w http.ResponseWriter, r *http.Request) {
+	number, _ := strconv.ParseInt(mux.Vars(r)["revision"], 10, 64)
+	if number == 0 {
+		handleHTTPError(w, http.StatusNotFound, fmt.Errorf("landscape revision %v not found", number))
+		return
+	}
+
+	revision, err := b.store.LandscapeRevision(number)
+	if err == store.ErrNotFound {
+		handleHTTPError(w, http.StatusNotFound, fmt.Errorf("landscape revision %v not found", number))
+		return
+	}
+	if err != nil {
+		handleHTTPError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	revision.Landscapes = nil
+	if revision.Changes == nil {
+		revision.Changes = []landscape.Change{}
+	}
+	handleJSON(w, http.StatusOK, revision)
+}
+
+func (b *Broker) adminConfigGetHandler(w http.ResponseWriter, r *http.Request) {
+	if b.config == nil {
+		handleHTTPError(w, http.StatusNotFound, errors.New("no configuration available"))
+		return
+	}
+
+	handleJSON(w, http.StatusOK, map[string]interface{}{
+		"file":     b.config.File,
+		"settings": b.config.Settings(),
+	})
+}
+
+func (b *Broker) adminWebhooksGetHandler(w http.ResponseWriter, r *http.Request) {
+	bindings, err := b.store.Bindings()
+	if err != nil {
+		handleHTTPError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	webhooks := []store.Binding{}
+	for _, binding := range bindings {
+		if binding.Webhook != nil {
+			binding.Webhook = &store.Webhook{URL: binding.Webhook.URL}
+			binding.Parameters = withoutWebhookSecret(binding.Parameters)
+			webhooks = append(webhooks, binding)
+		}
+	}
+
+	handleJSON(w, http.StatusOK, webhooks)
+}
+
+// withoutWebhookSecret returns a copy of the binding parameters without the
+// secret of the webhook parameter
+func withoutWebhookSecret(parameters map[string]interface{}) map[string]interface{} {
+	object, ok := parameters[parameterWebhook].(map[string]interface{})
+	if !ok {
+		return parameters
+	}
+
+	hook := map[string]interface{}{}
+	for key, value := range object {
+		if key != "secret" {
+			hook[key] = value
+		}
+	}
+	redacted := map[string]interface{}{}
+	for key, value := range parameters {
+		redacted[key] = value
+	}
+	redacted[parameterWebhook] = hook
+	return redacted
+}
+
+func (b *Broker) adminDeliveriesGetHandler(w http.ResponseWriter, r *http.Request) {
+	deliveries, err := b.store.Deliveries()
+	if err != nil {
+		handleHTTPError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	handleJSON(w, http.StatusOK, deliveries)
+}
+
+func (b *Broker) adminStoreBackupHandler(w http.ResponseWriter, r *http.Request) {
+	backuper, ok := b.store.(store.Backuper)
+	if !ok {
+		handleHTTPError(w, http.StatusNotImplemented, errors.New("the store does not support backups"))
+		return
+	}
+
+	w.Header().Set(headerContentType, contentTypeBinary)
+	w.Header().Set(headerContentDisposition, `attachment; filename="lookup-broker.db"`)
+	if _, err := backuper.Backup(w); err != nil {
+		// the response is already started, so the client only sees a truncated backup
+		log.Printf("Error: backup failed: %v", err)
+	}
+}
+
+func (b *Broker) adminStoreCompactHandler(w http.ResponseWriter, r *http.Request) {
+	compacter, ok := b.store.(store.Compacter)
+	if !ok {
+		handleHTTPError(w, http.StatusNotImplemented, errors.New("the store does not support compaction"))
+		return
+	}
+
+	if err := compacter.Compact(); err != nil {
+		log.Printf("Error: %v", err)
+		handleHTTPError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (b *Broker) adminStoreExportHandler(w http.ResponseWriter, r *http.Request) {
+	archive, err := store.Export(b.store)
+	if err != nil {
+		log.Printf("Error: %v", err)
+		handleHTTPError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set(headerContentDisposition, `attachment; filename="lookup-broker.json"`)
+	handleJSON(w, http.StatusOK, archive)
+}
+
+// adminStoreImportHandler imports an archive of export-store or the export
+// endpoint, it responds with 409 and imports nothing if entries conflict. Its
+// body is limited by the import size instead of the body size.
+func (b *Broker) adminStoreImportHandler(w http.ResponseWriter, r *http.Request) {
+	if !b.limitBody(w, r, b.maxImportSize) {
+		return
+	}
+
+	b.landscapesMutex.Lock()
+	defer b.landscapesMutex.Unlock()
+
+	dryRun := false
+	if value := r.URL.Query().Get("dry_run"); value != "" {
+		var err error
+		if dryRun, err = strconv.ParseBool(value); err != nil {
+			handleHTTPError(w, http.StatusBadRequest, fmt.Errorf("invalid dry_run %q", value))
+			return
+		}
+	}
+
+	var archive store.Archive
+
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&archive); err != nil {
+		log.Printf("Error: %v", err)
+		handleHTTPError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	result, err := store.Import(b.store, &archive, dryRun)
+	if err != nil {
+		log.Printf("Error: %v", err)
+		handleHTTPError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	if len(result.Conflicts) > 0 {
+		handleJSON(w, http.StatusConflict, result)
+		return
+	}
+
+	if !dryRun && result.Imported.LandscapeVersions > 0 {
+		if err := b.registry.Reload(); err != nil {
+			log.Printf("Error: %v", err)
+		}
+	}
+	log.Printf("store import (dry run %v): %+v", dryRun, result.Imported)
+	handleJSON(w, http.StatusOK, result)
+}
+
+func (b *Broker) adminOrphansGetHandler(w http.ResponseWriter, r *http.Request) {
+	orphans, err := store.FindOrphans(b.store, b.orphanAge, time.Now().UTC())
+	if err != nil {
+		log.Printf("Error: %v", err)
+		handleHTTPError(w, http.StatusInternalServerError, err)
+		return
+	}
+	handleJSON(w, http.StatusOK, orphans)
+}
+
+// adminOrphansPurgeHandler deletes the orphans found right now, orphans of
+// an instance with an operation in progress are left to the next purge
+func (b *Broker) adminOrphansPurgeHandler(w http.ResponseWriter, r *http.Request) {
+	orphans, err := store.FindOrphans(b.store, b.orphanAge, time.Now().UTC())
+	if err != nil {
+		log.Printf("Error: %v", err)
+		handleHTTPError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	purged, err := store.PurgeOrphans(b.store, orphans, b.orphanAge, LockOwner(), b.operationTimeout)
+	for _, orphan := range purged {
+		log.Printf("purged orphan %+v", orphan)
+	}
+	if err != nil {
+		log.Printf("Error: %v", err)
+		handleHTTPError(w, http.StatusInternalServerError, err)
+		return
+	}
+	handleJSON(w, http.StatusOK, purged)
+}
@@ -0,0 +1,397 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sklevenz/lookup-broker/config"
+	"github.com/sklevenz/lookup-broker/landscape"
+	"github.com/sklevenz/lookup-broker/store"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	adminUsername = "admin"
+	adminPassword = "secret"
+)
+
+func adminRequest(method string, target string, body io.Reader) *http.Request {
+	request, _ := http.NewRequest(method, target, body)
+	request.SetBasicAuth(adminUsername, adminPassword)
+	if body != nil {
+		request.Header.Set(headerContentType, contentTypeJSON)
+	}
+	return request
+}
+
+func newAdminBroker() *Broker {
+	return New(withLandscapes(landscapes), WithAdminCredentials(adminUsername, adminPassword))
+}
+
+func TestAdminAuthentication(t *testing.T) {
+	request, _ := http.NewRequest(http.MethodGet, "/admin/landscapes", nil)
+	response := httptest.NewRecorder()
+	New().ServeHTTP(response, request)
+	assert.Equal(t, http.StatusForbidden, response.Result().StatusCode)
+
+	response = httptest.NewRecorder()
+	newAdminBroker().ServeHTTP(response, request)
+	assert.Equal(t, http.StatusUnauthorized, response.Result().StatusCode)
+	assert.NotEmpty(t, response.Header().Get(headerWWWAuthenticate))
+
+	request.SetBasicAuth(adminUsername, "wrong")
+	response = httptest.NewRecorder()
+	newAdminBroker().ServeHTTP(response, request)
+	assert.Equal(t, http.StatusUnauthorized, response.Result().StatusCode)
+
+	response = httptest.NewRecorder()
+	newAdminBroker().ServeHTTP(response, adminRequest(http.MethodGet, "/admin/landscapes", nil))
+	assert.Equal(t, http.StatusOK, response.Result().StatusCode)
+}
+
+func TestProvenanceGetHandler(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "landscapes")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "team.json")
+	ioutil.WriteFile(path, []byte(`{"cf-eu10": {"cloudcontroller": "https://api.example.com"}}`), 0644)
+
+	registry := landscape.NewRegistry(landscape.DocumentSource{Origin: "env:LANDSCAPES", Data: []byte(landscapes)}, landscape.FileSource{Path: path})
+	assert.Nil(t, registry.Reload())
+
+	response := httptest.NewRecorder()
+
+	New(WithRegistry(registry), WithAdminCredentials(adminUsername, adminPassword)).ServeHTTP(response, adminRequest(http.MethodGet, "/admin/landscapes/provenance", nil))
+
+	assert.Equal(t, http.StatusOK, response.Result().StatusCode)
+	assert.Equal(t, contentTypeJSON, response.Header().Get(headerContentType))
+
+	var responseContent struct {
+		Origins    []string             `json:"origins"`
+		Provenance map[string]string    `json:"provenance"`
+		Conflicts  []landscape.Conflict `json:"conflicts"`
+	}
+	err := json.NewDecoder(response.Body).Decode(&responseContent)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"env:LANDSCAPES", "file:" + path}, responseContent.Origins)
+	assert.Equal(t, "file:"+path, responseContent.Provenance["cf-eu10"])
+	assert.Equal(t, "env:LANDSCAPES", responseContent.Provenance["cf-eu10-001"])
+	assert.Equal(t, []landscape.Conflict{{Landscape: "cf-eu10", Origin: "file:" + path, Overridden: "env:LANDSCAPES"}}, responseContent.Conflicts)
+}
+
+func TestAdminLandscapeCRUD(t *testing.T) {
+	broker := newAdminBroker()
+
+	response := httptest.NewRecorder()
+	broker.ServeHTTP(response, adminRequest(http.MethodPut, "/admin/landscapes/cf-team", strings.NewReader(`{"extends": "cf-eu10", "labels": ["team"]}`)))
+	assert.Equal(t, http.StatusCreated, response.Result().StatusCode)
+	assert.Contains(t, response.Body.String(), `"number":1`)
+	assert.Contains(t, response.Body.String(), `"author":"admin"`)
+
+	assert.Equal(t, "https://api.cf.eu10.hana.ondemand.com", broker.registry.Landscapes()["cf-team"].CloudController)
+	assert.Equal(t, "store:version/1", broker.registry.Current().Provenance["cf-team"])
+
+	response = httptest.NewRecorder()
+	broker.ServeHTTP(response, adminRequest(http.MethodGet, "/admin/landscapes/cf-team", nil))
+	assert.Equal(t, http.StatusOK, response.Result().StatusCode)
+	assert.JSONEq(t, `{"extends": "cf-eu10", "labels": ["team"]}`, response.Body.String())
+
+	response = httptest.NewRecorder()
+	broker.ServeHTTP(response, adminRequest(http.MethodPut, "/admin/landscapes/cf-team", strings.NewReader(`{"cloudcontroller": "https://api.example.com"}`)))
+	assert.Equal(t, http.StatusOK, response.Result().StatusCode)
+	assert.Equal(t, "https://api.example.com", broker.registry.Landscapes()["cf-team"].CloudController)
+
+	response = httptest.NewRecorder()
+	broker.ServeHTTP(response, adminRequest(http.MethodDelete, "/admin/landscapes/cf-team", nil))
+	assert.Equal(t, http.StatusOK, response.Result().StatusCode)
+	assert.NotContains(t, broker.registry.Landscapes(), "cf-team")
+
+	response = httptest.NewRecorder()
+	broker.ServeHTTP(response, adminRequest(http.MethodDelete, "/admin/landscapes/cf-team", nil))
+	assert.Equal(t, http.StatusNotFound, response.Result().StatusCode)
+
+	response = httptest.NewRecorder()
+	broker.ServeHTTP(response, adminRequest(http.MethodGet, "/admin/landscapes/cf-team", nil))
+	assert.Equal(t, http.StatusNotFound, response.Result().StatusCode)
+}
+
+func TestAdminLandscapeValidation(t *testing.T) {
+	broker := newAdminBroker()
+
+	response := httptest.NewRecorder()
+	broker.ServeHTTP(response, adminRequest(http.MethodPut, "/admin/landscapes/cf-team", strings.NewReader(`{"extends": "cf-unknown"}`)))
+	assert.Equal(t, http.StatusUnprocessableEntity, response.Result().StatusCode)
+	assert.Contains(t, response.Body.String(), "extends unknown landscape cf-unknown")
+
+	response = httptest.NewRecorder()
+	broker.ServeHTTP(response, adminRequest(http.MethodPut, "/admin/landscapes/cf-team", strings.NewReader(`{"url": "https://api.example.com"}`)))
+	assert.Equal(t, http.StatusBadRequest, response.Result().StatusCode)
+
+	for _, name := range []string{"provenance", "versions", "revisions"} {
+		response = httptest.NewRecorder()
+		broker.ServeHTTP(response, adminRequest(http.MethodPut, "/admin/landscapes/"+name, strings.NewReader(`{"extends": "cf-eu10"}`)))
+		assert.Equal(t, http.StatusBadRequest, response.Result().StatusCode, name)
+		assert.Contains(t, response.Body.String(), "landscape name "+name+" is reserved")
+
+		response = httptest.NewRecorder()
+		broker.ServeHTTP(response, adminRequest(http.MethodDelete, "/admin/landscapes/"+name, nil))
+		assert.Equal(t, http.StatusBadRequest, response.Result().StatusCode, name)
+	}
+
+	versions, err := broker.store.LandscapeVersions()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(versions))
+}
+
+func TestAdminLandscapeRollback(t *testing.T) {
+	s := store.NewMemoryStore()
+	broker := New(withLandscapes(landscapes), WithStore(s), WithAdminCredentials(adminUsername, adminPassword))
+
+	for _, payload := range []string{`{"cloudcontroller": "https://api.v1.example.com"}`, `{"cloudcontroller": "https://api.v2.example.com"}`} {
+		response := httptest.NewRecorder()
+		broker.ServeHTTP(response, adminRequest(http.MethodPut, "/admin/landscapes/cf-team", strings.NewReader(payload)))
+		assert.Contains(t, []int{http.StatusCreated, http.StatusOK}, response.Result().StatusCode)
+	}
+	assert.Equal(t, "https://api.v2.example.com", broker.registry.Landscapes()["cf-team"].CloudController)
+
+	response := httptest.NewRecorder()
+	broker.ServeHTTP(response, adminRequest(http.MethodPost, "/admin/landscapes/versions/1/rollback", nil))
+	assert.Equal(t, http.StatusOK, response.Result().StatusCode)
+	assert.Contains(t, response.Body.String(), `"number":3`)
+	assert.Contains(t, response.Body.String(), "rollback to version 1")
+	assert.Equal(t, "https://api.v1.example.com", broker.registry.Landscapes()["cf-team"].CloudController)
+
+	response = httptest.NewRecorder()
+	broker.ServeHTTP(response, adminRequest(http.MethodGet, "/admin/landscapes/versions", nil))
+	assert.Equal(t, http.StatusOK, response.Result().StatusCode)
+
+	var versions []store.LandscapeVersion
+	assert.Nil(t, json.NewDecoder(response.Body).Decode(&versions))
+	assert.Equal(t, 3, len(versions))
+
+	response = httptest.NewRecorder()
+	broker.ServeHTTP(response, adminRequest(http.MethodGet, "/admin/landscapes/versions/2", nil))
+	assert.Equal(t, http.StatusOK, response.Result().StatusCode)
+	assert.Contains(t, response.Body.String(), "https://api.v2.example.com")
+
+	response = httptest.NewRecorder()
+	broker.ServeHTTP(response, adminRequest(http.MethodPost, "/admin/landscapes/versions/9/rollback", nil))
+	assert.Equal(t, http.StatusNotFound, response.Result().StatusCode)
+}
+
+func TestAdminRevisions(t *testing.T) {
+	s := store.NewMemoryStore()
+	broker := New(withLandscapes(landscapes), WithStore(s), WithAdminCredentials(adminUsername, adminPassword))
+	other := New(withLandscapes(landscapes), WithStore(s))
+
+	response := httptest.NewRecorder()
+	broker.ServeHTTP(response, adminRequest(http.MethodPut, "/admin/landscapes/cf-eu10", strings.NewReader(`{"cloudcontroller": "https://api.example.com"}`)))
+	assert.Equal(t, http.StatusCreated, response.Result().StatusCode)
+
+	// a broker sharing the store records the same change only once
+	assert.Nil(t, other.registry.Reload())
+	assert.Equal(t, int64(2), other.registry.Current().Revision)
+
+	response = httptest.NewRecorder()
+	broker.ServeHTTP(response, adminRequest(http.MethodGet, "/admin/landscapes/revisions", nil))
+	assert.Equal(t, http.StatusOK, response.Result().StatusCode)
+
+	var revisions []landscape.Revision
+	assert.Nil(t, json.NewDecoder(response.Body).Decode(&revisions))
+	assert.Equal(t, 2, len(revisions))
+	assert.Equal(t, int64(2), revisions[1].Number)
+	assert.Equal(t, []string{"store:version/1"}, revisions[1].Sources)
+	assert.Nil(t, revisions[1].Changes)
+
+	response = httptest.NewRecorder()
+	broker.ServeHTTP(response, adminRequest(http.MethodGet, "/admin/landscapes/revisions/2/diff", nil))
+	assert.Equal(t, http.StatusOK, response.Result().StatusCode)
+
+	var revision landscape.Revision
+	assert.Nil(t, json.NewDecoder(response.Body).Decode(&revision))
+	assert.Nil(t, revision.Landscapes)
+	assert.Equal(t, 1, len(revision.Changes))
+	assert.Equal(t, landscape.Modified, revision.Changes[0].Type)
+	assert.Equal(t, "store:version/1", revision.Changes[0].Origin)
+	assert.Equal(t, landscape.FieldChange{Field: "cloudcontroller", Before: "https://api.cf.eu10.hana.ondemand.com", After: "https://api.example.com"}, revision.Changes[0].Fields[0])
+
+	response = httptest.NewRecorder()
+	broker.ServeHTTP(response, adminRequest(http.MethodGet, "/admin/landscapes/revisions/9/diff", nil))
+	assert.Equal(t, http.StatusNotFound, response.Result().StatusCode)
+
+	restarted := New(withLandscapes(landscapes), WithStore(s), WithAdminCredentials(adminUsername, adminPassword))
+	assert.Equal(t, int64(2), restarted.registry.Current().Revision)
+}
+
+func TestAdminConfig(t *testing.T) {
+	response := httptest.NewRecorder()
+	New(WithAdminCredentials(adminUsername, adminPassword)).ServeHTTP(response, adminRequest(http.MethodGet, "/admin/config", nil))
+	assert.Equal(t, http.StatusNotFound, response.Result().StatusCode)
+
+	c, err := config.Load("test", []string{"-admin-username", adminUsername, "-admin-password", adminPassword})
+	assert.Nil(t, err)
+
+	response = httptest.NewRecorder()
+	New(WithConfig(c), WithAdminCredentials(c.AdminUsername, c.AdminPassword)).ServeHTTP(response, adminRequest(http.MethodGet, "/admin/config", nil))
+	assert.Equal(t, http.StatusOK, response.Result().StatusCode)
+	assert.Contains(t, response.Body.String(), `{"name":"ADMIN_PASSWORD","flag":"admin-password","value":"*****","source":"flag"}`)
+	assert.NotContains(t, response.Body.String(), adminPassword)
+}
+
+func TestAdminStore(t *testing.T) {
+	response := httptest.NewRecorder()
+	newAdminBroker().ServeHTTP(response, adminRequest(http.MethodGet, "/admin/store/backup", nil))
+	assert.Equal(t, http.StatusNotImplemented, response.Result().StatusCode)
+
+	dir, _ := ioutil.TempDir("", "store")
+	defer os.RemoveAll(dir)
+	s, err := store.NewBoltStore(filepath.Join(dir, "broker.db"))
+	assert.Nil(t, err)
+	defer s.Close()
+	assert.Nil(t, s.SaveBinding(&store.Binding{InstanceID: "1", BindingID: "2"}))
+
+	broker := New(WithStore(s), WithAdminCredentials(adminUsername, adminPassword))
+
+	response = httptest.NewRecorder()
+	broker.ServeHTTP(response, adminRequest(http.MethodGet, "/admin/store/backup", nil))
+	assert.Equal(t, http.StatusOK, response.Result().StatusCode)
+	assert.Equal(t, contentTypeBinary, response.Header().Get(headerContentType))
+
+	backup := filepath.Join(dir, "backup.db")
+	assert.Nil(t, ioutil.WriteFile(backup, response.Body.Bytes(), 0600))
+	restored, err := store.NewBoltStore(backup)
+	assert.Nil(t, err)
+	_, err = restored.Binding("1", "2")
+	assert.Nil(t, err)
+	restored.Close()
+
+	response = httptest.NewRecorder()
+	broker.ServeHTTP(response, adminRequest(http.MethodPost, "/admin/store/compact", nil))
+	assert.Equal(t, http.StatusNoContent, response.Result().StatusCode)
+}
+
+func TestAdminStoreExportImport(t *testing.T) {
+	source := newAdminBroker()
+	source.store.SaveInstance(&store.Instance{InstanceID: "1", ServiceID: "1", PlanID: "1.1", Parameters: map[string]interface{}{"selector": "aws"}})
+	source.store.SaveBinding(&store.Binding{InstanceID: "1", BindingID: "2", Selector: "aws"})
+
+	response := httptest.NewRecorder()
+	source.ServeHTTP(response, adminRequest(http.MethodGet, "/admin/store/export", nil))
+	assert.Equal(t, http.StatusOK, response.Result().StatusCode)
+	assert.Contains(t, response.Header().Get(headerContentDisposition), "attachment")
+	archive := response.Body.String()
+
+	target := newAdminBroker()
+
+	response = httptest.NewRecorder()
+	target.ServeHTTP(response, adminRequest(http.MethodPost, "/admin/store/import?dry_run=true", strings.NewReader(archive)))
+	assert.Equal(t, http.StatusOK, response.Result().StatusCode)
+	assert.Contains(t, response.Body.String(), `"dry_run":true`)
+	assert.Contains(t, response.Body.String(), `"imported":{"instances":1,"bindings":1`)
+	_, err := target.store.Instance("1")
+	assert.Equal(t, store.ErrNotFound, err)
+
+	response = httptest.NewRecorder()
+	target.ServeHTTP(response, adminRequest(http.MethodPost, "/admin/store/import", strings.NewReader(archive)))
+	assert.Equal(t, http.StatusOK, response.Result().StatusCode)
+	instance, err := target.store.Instance("1")
+	assert.Nil(t, err)
+	assert.Equal(t, "aws", instance.Parameters["selector"])
+
+	target.store.SaveInstance(&store.Instance{InstanceID: "1", ServiceID: "1", PlanID: "1.2"})
+	response = httptest.NewRecorder()
+	target.ServeHTTP(response, adminRequest(http.MethodPost, "/admin/store/import", strings.NewReader(archive)))
+	assert.Equal(t, http.StatusConflict, response.Result().StatusCode)
+	assert.Contains(t, response.Body.String(), `{"type":"instance","id":"1","reason":"exists with different content"}`)
+
+	response = httptest.NewRecorder()
+	target.ServeHTTP(response, adminRequest(http.MethodPost, "/admin/store/import?dry_run=maybe", strings.NewReader(archive)))
+	assert.Equal(t, http.StatusBadRequest, response.Result().StatusCode)
+
+	response = httptest.NewRecorder()
+	target.ServeHTTP(response, adminRequest(http.MethodPost, "/admin/store/import", strings.NewReader(`{"version": 2}`)))
+	assert.Equal(t, http.StatusUnprocessableEntity, response.Result().StatusCode)
+}
+
+func TestAdminOrphans(t *testing.T) {
+	broker := New(withLandscapes(landscapes), WithAdminCredentials(adminUsername, adminPassword), WithOrphanAge(time.Hour))
+	old := time.Now().UTC().Add(-2 * time.Hour)
+	broker.store.SaveInstance(&store.Instance{InstanceID: "idle", Created: old})
+	broker.store.SaveInstance(&store.Instance{InstanceID: "active", Created: time.Now().UTC()})
+	broker.store.SaveBinding(&store.Binding{InstanceID: "gone", BindingID: "1", Created: time.Now().UTC()})
+
+	response := httptest.NewRecorder()
+	broker.ServeHTTP(response, adminRequest(http.MethodGet, "/admin/orphans", nil))
+	assert.Equal(t, http.StatusOK, response.Result().StatusCode)
+	var orphans []store.Orphan
+	assert.Nil(t, json.Unmarshal(response.Body.Bytes(), &orphans))
+	assert.Equal(t, 2, len(orphans))
+	assert.Equal(t, store.OrphanInstanceMissing, orphans[0].Reason)
+	assert.Equal(t, store.OrphanUntouched, orphans[1].Reason)
+
+	response = httptest.NewRecorder()
+	broker.ServeHTTP(response, adminRequest(http.MethodPost, "/admin/orphans/purge", nil))
+	assert.Equal(t, http.StatusOK, response.Result().StatusCode)
+	assert.Nil(t, json.Unmarshal(response.Body.Bytes(), &orphans))
+	assert.Equal(t, 2, len(orphans))
+
+	_, err := broker.store.Instance("idle")
+	assert.Equal(t, store.ErrNotFound, err)
+	_, err = broker.store.Instance("active")
+	assert.Nil(t, err)
+
+	response = httptest.NewRecorder()
+	broker.ServeHTTP(response, adminRequest(http.MethodGet, "/admin/orphans", nil))
+	assert.Equal(t, "[]", response.Body.String())
+}
+
+func TestAdminWebhooks(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	consumer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r
+	}))
+	defer consumer.Close()
+
+	broker := newAdminBroker()
+	broker.store.SaveBinding(&store.Binding{
+		InstanceID: "123",
+		BindingID:  "456",
+		Selector:   "team",
+		Parameters: map[string]interface{}{"selector": "team", "webhook": map[string]interface{}{"url": consumer.URL, "secret": "secret"}},
+		Webhook:    &store.Webhook{URL: consumer.URL, Secret: "secret"},
+	})
+
+	response := httptest.NewRecorder()
+	broker.ServeHTTP(response, adminRequest(http.MethodGet, "/admin/webhooks", nil))
+	assert.Equal(t, http.StatusOK, response.Result().StatusCode)
+	assert.Contains(t, response.Body.String(), consumer.URL)
+	assert.NotContains(t, response.Body.String(), "secret")
+	binding, _ := broker.store.Binding("123", "456")
+	assert.Equal(t, "secret", binding.Parameters["webhook"].(map[string]interface{})["secret"])
+
+	response = httptest.NewRecorder()
+	broker.ServeHTTP(response, adminRequest(http.MethodPut, "/admin/landscapes/cf-team", strings.NewReader(`{"extends": "cf-eu10", "labels": ["team"]}`)))
+	assert.Equal(t, http.StatusCreated, response.Result().StatusCode)
+
+	request := <-received
+	assert.Equal(t, http.MethodPost, request.Method)
+	broker.notifier.Close()
+
+	response = httptest.NewRecorder()
+	broker.ServeHTTP(response, adminRequest(http.MethodGet, "/admin/webhooks/deliveries", nil))
+	assert.Equal(t, http.StatusOK, response.Result().StatusCode)
+
+	var deliveries []store.Delivery
+	assert.Nil(t, json.NewDecoder(response.Body).Decode(&deliveries))
+	assert.Equal(t, 1, len(deliveries))
+	assert.Equal(t, "456", deliveries[0].BindingID)
+	assert.Equal(t, http.StatusOK, deliveries[0].Status)
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sklevenz/lookup-broker/landscape"
+)
+
+const (
+	querySelector string = "selector"
+
+	headerCacheControl string = "Cache-Control"
+	headerLastEventID  string = "Last-Event-ID"
+
+	contentTypeEventStream string = "text/event-stream"
+
+	eventSnapshot string = "snapshot"
+
+	keepAliveInterval = 30 * time.Second
+)
+
+func (b *Broker) landscapesGetHandler(w http.ResponseWriter, r *http.Request) {
+	selector, err := landscape.ParseSelector(r.URL.Query().Get(querySelector))
+	if err != nil {
+		log.Printf("Error: %v", err)
+		handleHTTPError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	js, err := json.Marshal(b.registry.Landscapes().Filter(selector))
+	if err != nil {
+		handleHTTPError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set(headerContentType, contentTypeJSON)
+	w.Header().Set(headerETag, eTag(js))
+	w.Write(js)
+}
+
+func writeEvent(w io.Writer, event string, id string, data interface{}) error {
+	js, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	if id != "" {
+		_, err = fmt.Fprintf(w, "id: %v\nevent: %v\ndata: %s\n\n", id, event, js)
+	} else {
+		_, err = fmt.Fprintf(w, "event: %v\ndata: %s\n\n", event, js)
+	}
+	return err
+}
+
+func writeSnapshot(w io.Writer, set *landscape.Set) error {
+	return writeEvent(w, eventSnapshot, strconv.FormatInt(set.Revision, 10), map[string]interface{}{
+		"revision":   set.Revision,
+		"landscapes": set.Landscapes,
+	})
+}
+
+// writeRevision writes an event per change, only the last event carries the
+// revision as id, so a client resumes after the complete revision
+func writeRevision(w io.Writer, revision landscape.Revision) error {
+	for i, change := range revision.Changes {
+		id := ""
+		if i == len(revision.Changes)-1 {
+			id = strconv.FormatInt(revision.Number, 10)
+		}
+
+		err := writeEvent(w, string(change.Type), id, map[string]interface{}{
+			"revision": revision.Number,
+			"name":     change.Name,
+			"before":   change.Before,
+			"after":    change.After,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// landscapesWatchHandler streams landscape changes as server-sent events. A
+// new client gets a snapshot of the landscapes first, a client resuming with
+// Last-Event-ID gets the missed revisions, or a snapshot if they are no longer
+// available.
+func (b *Broker) landscapesWatchHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		handleHTTPError(w, http.StatusInternalServerError, errors.New("streaming not supported"))
+		return
+	}
+
+	current, revisions, cancel := b.registry.Watch()
+	defer cancel()
+
+	// the stream outlives the write timeout of the server
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		log.Printf("Error: could not clear the write deadline of the landscape watch: %v", err)
+	}
+
+	w.Header().Set(headerContentType, contentTypeEventStream)
+	w.Header().Set(headerCacheControl, "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	var err error
+	sent := current.Revision
+
+	since, parseErr := strconv.ParseInt(r.Header.Get(headerLastEventID), 10, 64)
+	backlog, ok := b.registry.Revisions(since)
+	if parseErr != nil || !ok {
+		err = writeSnapshot(w, current)
+	} else {
+		for _, revision := range backlog {
+			if err = writeRevision(w, revision); err != nil {
+				break
+			}
+			sent = revision.Number
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+
+	for err == nil {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-b.draining:
+			return
+		case revision, open := <-revisions:
+			if !open {
+				return
+			}
+			if revision.Number <= sent {
+				continue
+			}
+			err = writeRevision(w, revision)
+			sent = revision.Number
+		case <-keepAlive.C:
+			_, err = io.WriteString(w, ": keep-alive\n\n")
+		}
+		flusher.Flush()
+	}
+
+	log.Printf("Error: %v", err)
+}
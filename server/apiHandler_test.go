@@ -0,0 +1,177 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sklevenz/lookup-broker/landscape"
+	"github.com/sklevenz/lookup-broker/openapi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLandscapesGetHandler(t *testing.T) {
+	request, _ := http.NewRequest(http.MethodGet, "/api/v1/landscapes?selector="+url.QueryEscape("aws && !master"), nil)
+	response := httptest.NewRecorder()
+
+	New(withLandscapes(landscapes)).ServeHTTP(response, request)
+
+	assert.Equal(t, http.StatusOK, response.Result().StatusCode)
+	assert.Equal(t, contentTypeJSON, response.Header().Get(headerContentType))
+
+	var responseContent landscape.Landscapes
+	err := json.NewDecoder(response.Body).Decode(&responseContent)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(responseContent))
+	assert.NotContains(t, responseContent, "cf-eu10")
+}
+
+func TestLandscapesGetHandlerWrongSelector(t *testing.T) {
+	request, _ := http.NewRequest(http.MethodGet, "/api/v1/landscapes?selector="+url.QueryEscape("aws &&"), nil)
+	response := httptest.NewRecorder()
+
+	New(withLandscapes(landscapes)).ServeHTTP(response, request)
+
+	assert.Equal(t, http.StatusBadRequest, response.Result().StatusCode)
+	assert.Equal(t, contentTypeJSON, response.Header().Get(headerContentType))
+
+	var responseContent openapi.Error
+	err := json.NewDecoder(response.Body).Decode(&responseContent)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusText(http.StatusBadRequest), responseContent.Error)
+	assert.Contains(t, responseContent.Description, "selector syntax error at position 6")
+}
+
+type sseEvent struct {
+	id    string
+	event string
+	data  map[string]interface{}
+}
+
+func readEvent(t *testing.T, reader *bufio.Reader) sseEvent {
+	event := sseEvent{}
+	for {
+		line, err := reader.ReadString('\n')
+		assert.Nil(t, err)
+
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			return event
+		case strings.HasPrefix(line, "id: "):
+			event.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			event.event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			assert.Nil(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event.data))
+		}
+	}
+}
+
+func watch(t *testing.T, url string, lastEventID string) (*bufio.Reader, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	request, _ := http.NewRequestWithContext(ctx, http.MethodGet, url+"/api/v1/landscapes/watch", nil)
+	if lastEventID != "" {
+		request.Header.Set(headerLastEventID, lastEventID)
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, contentTypeEventStream, response.Header.Get(headerContentType))
+
+	return bufio.NewReader(response.Body), func() {
+		cancel()
+		response.Body.Close()
+	}
+}
+
+func TestLandscapesWatchHandler(t *testing.T) {
+	source := &landscape.DocumentSource{Origin: "env:LANDSCAPES", Data: []byte(landscapes)}
+	registry := landscape.NewRegistry(source)
+	assert.Nil(t, registry.Reload())
+
+	server := httptest.NewServer(New(WithRegistry(registry)))
+	defer server.Close()
+
+	reader, cancel := watch(t, server.URL, "")
+	defer cancel()
+
+	event := readEvent(t, reader)
+	assert.Equal(t, "snapshot", event.event)
+	assert.Equal(t, "1", event.id)
+	assert.Equal(t, 3, len(event.data["landscapes"].(map[string]interface{})))
+
+	source.Data = []byte(`{
+		"cf-eu10": {"cloudcontroller": "https://api.example.com"},
+		"cf-eu10-001": {"cloudcontroller": "https://api.cf.eu10-001.hana.ondemand.com", "uaa": "https://uaa.cf.eu10-001.hana.ondemand.com", "labels": ["scaleout", "aws"]},
+		"cf-eu20": {"cloudcontroller": "https://api.cf.eu20.hana.ondemand.com"}
+	}`)
+	assert.Nil(t, registry.Reload())
+
+	expected := []struct{ event, name, id string }{
+		{"modified", "cf-eu10", ""},
+		{"removed", "cf-eu10-002", ""},
+		{"added", "cf-eu20", "2"},
+	}
+	for _, e := range expected {
+		event = readEvent(t, reader)
+		assert.Equal(t, e.event, event.event)
+		assert.Equal(t, e.name, event.data["name"])
+		assert.Equal(t, e.id, event.id)
+		assert.Equal(t, float64(2), event.data["revision"])
+	}
+	assert.Nil(t, event.data["before"])
+
+	resumed, cancelResumed := watch(t, server.URL, "1")
+	defer cancelResumed()
+
+	event = readEvent(t, resumed)
+	assert.Equal(t, "modified", event.event)
+	assert.Equal(t, "https://api.cf.eu10.hana.ondemand.com", event.data["before"].(map[string]interface{})["cloudcontroller"])
+	assert.Equal(t, "https://api.example.com", event.data["after"].(map[string]interface{})["cloudcontroller"])
+
+	unknown, cancelUnknown := watch(t, server.URL, "42")
+	defer cancelUnknown()
+
+	event = readEvent(t, unknown)
+	assert.Equal(t, "snapshot", event.event)
+	assert.Equal(t, "2", event.id)
+}
+
+func TestLandscapesWatchHandlerShutdown(t *testing.T) {
+	source := &landscape.DocumentSource{Origin: "env:LANDSCAPES", Data: []byte(landscapes)}
+	registry := landscape.NewRegistry(source)
+	assert.Nil(t, registry.Reload())
+
+	broker := New(WithRegistry(registry))
+	server := httptest.NewUnstartedServer(broker)
+	server.Config.WriteTimeout = 50 * time.Millisecond
+	server.Config.RegisterOnShutdown(broker.Drain)
+	server.Start()
+	defer server.Close()
+
+	reader, cancel := watch(t, server.URL, "")
+	defer cancel()
+	assert.Equal(t, "snapshot", readEvent(t, reader).event)
+
+	time.Sleep(100 * time.Millisecond)
+	source.Data = []byte(`{"cf-eu10": {"cloudcontroller": "https://api.example.com"}}`)
+	assert.Nil(t, registry.Reload())
+	assert.Equal(t, "modified", readEvent(t, reader).event)
+
+	ctx, cancelShutdown := context.WithTimeout(context.Background(), time.Second)
+	defer cancelShutdown()
+	assert.Nil(t, server.Config.Shutdown(ctx))
+
+	_, err := ioutil.ReadAll(reader)
+	assert.Nil(t, err)
+}
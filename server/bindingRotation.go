@@ -0,0 +1,73 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sklevenz/lookup-broker/openapi"
+	"github.com/sklevenz/lookup-broker/store"
+)
+
+// predecessorBinding returns the binding rotated by request, whose parameters
+// and thus label filter and webhook are copied to the new binding
+func (b *Broker) predecessorBinding(instanceID string, bindingID string, request *openapi.ServiceBindingRequest) (*store.Binding, error) {
+	predecessorID := request.PredecessorBindingId
+	if predecessorID == bindingID {
+		return nil, badRequest(errors.New("a binding cannot be its own predecessor"))
+	}
+	if len(request.Parameters) > 0 {
+		return nil, badRequest(errors.New("parameters are copied from the predecessor binding and must not be given"))
+	}
+
+	predecessor, err := b.store.Binding(instanceID, predecessorID)
+	if err == store.ErrNotFound || err == nil && predecessor.Incomplete {
+		return nil, badRequest(fmt.Errorf("predecessor binding %v of service instance %v does not exist", predecessorID, instanceID))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return predecessor, nil
+}
+
+// bindingLifetime returns the lifetime of the credentials of plan, zero if
+// they do not expire
+func (b *Broker) bindingLifetime(planID string) time.Duration {
+	if lifetime, ok := b.bindingLifetimes[planID]; ok {
+		return lifetime
+	}
+	for _, service := range Catalog().Services {
+		for _, plan := range service.Plans {
+			if plan.Id == planID {
+				return b.bindingLifetimes[plan.Name]
+			}
+		}
+	}
+	return 0
+}
+
+// setBindingExpiry sets the expiry of binding by the lifetime of its plan.
+// Platforms are asked to renew it in the last fifth of its lifetime.
+func (b *Broker) setBindingExpiry(binding *store.Binding) {
+	lifetime := b.bindingLifetime(binding.PlanID)
+	if lifetime == 0 {
+		return
+	}
+
+	expiresAt := binding.Created.Add(lifetime)
+	renewBefore := expiresAt.Add(-lifetime / 5)
+	binding.ExpiresAt = &expiresAt
+	binding.RenewBefore = &renewBefore
+}
+
+// bindingMetadata returns the expiry of binding in the format of the OSB API
+func bindingMetadata(binding *store.Binding) openapi.ServiceBindingMetadata {
+	metadata := openapi.ServiceBindingMetadata{}
+	if binding.ExpiresAt != nil {
+		metadata.ExpiresAt = binding.ExpiresAt.UTC().Format(time.RFC3339)
+	}
+	if binding.RenewBefore != nil {
+		metadata.RenewBefore = binding.RenewBefore.UTC().Format(time.RFC3339)
+	}
+	return metadata
+}
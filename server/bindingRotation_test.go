@@ -0,0 +1,120 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sklevenz/lookup-broker/openapi"
+	"github.com/sklevenz/lookup-broker/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func putBinding(broker *Broker, bindingID string, payload string) *httptest.ResponseRecorder {
+	request, _ := http.NewRequest(http.MethodPut, "/v2/service_instances/123/service_bindings/"+bindingID, strings.NewReader(payload))
+	request.Header.Set(headerAPIVersion, supportedAPIVersionValue)
+	request.Header.Set(headerContentType, contentTypeJSON)
+
+	response := httptest.NewRecorder()
+	broker.ServeHTTP(response, request)
+	return response
+}
+
+func TestBindingRotation(t *testing.T) {
+	broker := New()
+
+	response := putBinding(broker, "1", `{"service_id": "1", "plan_id": "1.1", "parameters": {"selector": "aws", "webhook": {"url": "https://example.com/hook"}}}`)
+	assert.Equal(t, http.StatusCreated, response.Code)
+
+	response = putBinding(broker, "2", `{"service_id": "1", "plan_id": "1.1", "predecessor_binding_id": "1"}`)
+	assert.Equal(t, http.StatusCreated, response.Code)
+	response = putBinding(broker, "3", `{"service_id": "1", "plan_id": "1.1", "predecessor_binding_id": "2"}`)
+	assert.Equal(t, http.StatusCreated, response.Code)
+
+	first, _ := broker.store.Binding("123", "1")
+	rotated, err := broker.store.Binding("123", "3")
+	assert.Nil(t, err)
+	assert.Equal(t, "aws", rotated.Selector)
+	assert.Equal(t, first.Parameters, rotated.Parameters)
+	assert.Equal(t, "https://example.com/hook", rotated.Webhook.URL)
+	assert.NotEqual(t, first.Webhook.Secret, rotated.Webhook.Secret)
+	assert.Equal(t, []string{"1", "2"}, rotated.Lineage)
+	assert.Nil(t, rotated.ExpiresAt)
+}
+
+func TestBindingRotationErrors(t *testing.T) {
+	broker := New()
+	broker.store.SaveBinding(&store.Binding{InstanceID: "123", BindingID: "1"})
+	broker.store.SaveBinding(&store.Binding{InstanceID: "123", BindingID: "incomplete", Incomplete: true})
+
+	for _, payload := range []string{
+		`{"service_id": "1", "plan_id": "1.1", "predecessor_binding_id": "2"}`,
+		`{"service_id": "1", "plan_id": "1.1", "predecessor_binding_id": "missing"}`,
+		`{"service_id": "1", "plan_id": "1.1", "predecessor_binding_id": "incomplete"}`,
+		`{"service_id": "1", "plan_id": "1.1", "predecessor_binding_id": "1", "parameters": {"selector": "aws"}}`,
+	} {
+		response := putBinding(broker, "2", payload)
+		assert.Equal(t, http.StatusBadRequest, response.Code, payload)
+	}
+
+	_, err := broker.store.Binding("123", "2")
+	assert.Equal(t, store.ErrNotFound, err)
+}
+
+func TestBindingExpiry(t *testing.T) {
+	broker := New(WithBindingLifetimes(map[string]time.Duration{"extension": 100 * time.Hour}))
+
+	before := time.Now().UTC().Truncate(time.Second)
+	response := putBinding(broker, "1", `{"service_id": "1", "plan_id": "1.1"}`)
+	assert.Equal(t, http.StatusCreated, response.Code)
+
+	var content openapi.ServiceBindingResponse
+	assert.Nil(t, json.Unmarshal(response.Body.Bytes(), &content))
+	expiresAt, err := time.Parse(time.RFC3339, content.Metadata.ExpiresAt)
+	assert.Nil(t, err)
+	renewBefore, err := time.Parse(time.RFC3339, content.Metadata.RenewBefore)
+	assert.Nil(t, err)
+	assert.WithinDuration(t, before.Add(100*time.Hour), expiresAt, 2*time.Second)
+	assert.Equal(t, 20*time.Hour, expiresAt.Sub(renewBefore))
+
+	assert.Equal(t, 100*time.Hour, broker.bindingLifetime("1.1"))
+	assert.Equal(t, time.Duration(0), broker.bindingLifetime("other"))
+	assert.Equal(t, time.Duration(0), New().bindingLifetime("1.1"))
+}
+
+func TestBindingGetExpiry(t *testing.T) {
+	broker := New(WithBindingLifetimes(map[string]time.Duration{"1.1": time.Hour}))
+	response := putBinding(broker, "1", `{"service_id": "1", "plan_id": "1.1"}`)
+	assert.Equal(t, http.StatusCreated, response.Code)
+	var created openapi.ServiceBindingResponse
+	assert.Nil(t, json.Unmarshal(response.Body.Bytes(), &created))
+
+	request, _ := http.NewRequest(http.MethodGet, "/v2/service_instances/123/service_bindings/1", nil)
+	request.Header.Set(headerAPIVersion, supportedAPIVersionValue)
+	response = httptest.NewRecorder()
+	broker.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusOK, response.Code)
+	var fetched openapi.ServiceBindingResource
+	assert.Nil(t, json.Unmarshal(response.Body.Bytes(), &fetched))
+	assert.Equal(t, created.Metadata, fetched.Metadata)
+
+	binding, _ := broker.store.Binding("123", "1")
+	expired := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	binding.ExpiresAt = &expired
+	broker.store.SaveBinding(binding)
+
+	response = httptest.NewRecorder()
+	broker.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusGone, response.Code)
+	var osbError openapi.Error
+	assert.Nil(t, json.Unmarshal(response.Body.Bytes(), &osbError))
+	assert.Equal(t, errorBindingExpired, osbError.Error)
+	assert.Equal(t, "service binding 1 expired at 2021-03-01T12:00:00Z, rotate it", osbError.Description)
+
+	// an expired binding is rotated
+	response = putBinding(broker, "2", `{"service_id": "1", "plan_id": "1.1", "predecessor_binding_id": "1"}`)
+	assert.Equal(t, http.StatusCreated, response.Code)
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sklevenz/lookup-broker/store"
+)
+
+// defaultOperationTimeout expires the lock of an operation whose broker
+// instance died before releasing it
+const defaultOperationTimeout = time.Minute
+
+// LockOwner returns a unique owner of instance locks, which identifies an
+// operation across broker instances and commands sharing a store
+func LockOwner() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%v/%v", host, hex.EncodeToString(b))
+}
+
+// instanceLock serializes the operations on a service instance and its
+// bindings, so an instance is not deleted while it is bound. An operation on
+// an instance with another operation in progress is rejected with a
+// ConcurrencyError, as the OSB API demands.
+func (b *Broker) instanceLock(next osbHandler) osbHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		now := time.Now().UTC()
+		lock := &store.InstanceLock{
+			InstanceID: mux.Vars(r)["iid"],
+			Owner:      LockOwner(),
+			Operation:  r.Method,
+			Acquired:   now,
+			Expires:    now.Add(b.operationTimeout),
+		}
+
+		err := b.store.LockInstance(lock)
+		if err == store.ErrLocked {
+			err = fmt.Errorf("another operation on service instance %v is in progress", lock.InstanceID)
+			return newOSBError(http.StatusUnprocessableEntity, errorConcurrency, err)
+		}
+		if err != nil {
+			return err
+		}
+
+		defer func() {
+			if err := b.store.UnlockInstance(lock.InstanceID, lock.Owner); err != nil {
+				log.Printf("Error: could not unlock service instance %v: %v", lock.InstanceID, err)
+			}
+		}()
+		return next(w, r)
+	}
+}
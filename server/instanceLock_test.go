@@ -0,0 +1,41 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/sklevenz/lookup-broker/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInstanceLock(t *testing.T) {
+	const payload = `{"service_id": "1", "plan_id": "1.1", "organization_guid": "org", "space_guid": "space"}`
+
+	// a broker instance sharing the store runs an operation on instance 123
+	s := store.NewMemoryStore()
+	now := time.Now().UTC()
+	assert.Nil(t, s.LockInstance(&store.InstanceLock{InstanceID: "123", Owner: "other", Operation: http.MethodPut, Acquired: now, Expires: now.Add(time.Minute)}))
+
+	broker := New(WithStore(s))
+	code, osbError := putInstance(broker, payload)
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+	assert.Equal(t, errorConcurrency, osbError.Error)
+	assert.Equal(t, "another operation on service instance 123 is in progress", osbError.Description)
+
+	assert.Nil(t, s.UnlockInstance("123", "other"))
+	code, _ = putInstance(broker, payload)
+	assert.Equal(t, http.StatusCreated, code)
+
+	// the lock is released after the operation
+	assert.Nil(t, s.LockInstance(&store.InstanceLock{InstanceID: "123", Owner: "other", Acquired: now, Expires: now.Add(time.Minute)}))
+}
+
+func TestInstanceLockExpired(t *testing.T) {
+	s := store.NewMemoryStore()
+	past := time.Now().UTC().Add(-time.Hour)
+	assert.Nil(t, s.LockInstance(&store.InstanceLock{InstanceID: "123", Owner: "crashed", Acquired: past, Expires: past.Add(time.Minute)}))
+
+	code, _ := putInstance(New(WithStore(s)), `{"service_id": "1", "plan_id": "1.1", "organization_guid": "org", "space_guid": "space"}`)
+	assert.Equal(t, http.StatusCreated, code)
+}
@@ -0,0 +1,220 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	headerRetryAfter   string = "Retry-After"
+	headerForwardedFor string = "X-Forwarded-For"
+
+	// defaultMaxBodySize limits request bodies if not configured otherwise
+	defaultMaxBodySize int64 = 1 << 20
+
+	// defaultMaxImportSize limits the body of a store import if not
+	// configured otherwise
+	defaultMaxImportSize int64 = 64 << 20
+
+	// importPath is limited by the import size after the admin credentials
+	// are verified instead of the body size
+	importPath = "/admin/store/import"
+
+	// bucketExpiry removes the buckets of clients idle for this duration
+	bucketExpiry = 10 * time.Minute
+
+	// maxBuckets limits the number of clients tracked at once, further
+	// clients share the overflow bucket until idle buckets expire
+	maxBuckets = 10000
+
+	overflowClient = "overflow"
+)
+
+// bucket is a token bucket of a single client
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter limits the requests per client with a token bucket refilled
+// by rate tokens per second up to burst tokens
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mutex      sync.Mutex
+	buckets    map[string]*bucket
+	maxBuckets int
+	swept      time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = int(math.Max(1, math.Ceil(rate)))
+	}
+	return &rateLimiter{rate: rate, burst: float64(burst), buckets: map[string]*bucket{}, maxBuckets: maxBuckets, swept: time.Now()}
+}
+
+// allow takes a token of client. If none is left, it returns the duration
+// until the next token is available.
+func (l *rateLimiter) allow(client string, now time.Time) (bool, time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if now.Sub(l.swept) > bucketExpiry {
+		l.sweep(now)
+	}
+
+	b, ok := l.buckets[client]
+	if !ok && len(l.buckets) >= l.maxBuckets {
+		l.sweep(now)
+		if len(l.buckets) >= l.maxBuckets {
+			client = overflowClient
+			b, ok = l.buckets[client]
+		}
+	}
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweep removes the buckets of clients idle for longer than bucketExpiry
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > bucketExpiry {
+			delete(l.buckets, key)
+		}
+	}
+	l.swept = now
+}
+
+func (l *rateLimiter) clients() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return len(l.buckets)
+}
+
+// clientKey identifies the client of a request by the admin user if it is
+// authenticated, otherwise by its remote address. Unverified usernames and
+// headers are ignored, they are chosen freely by the client. The address of a
+// trusted proxy is replaced by the last address it forwarded the request for
+// which is no trusted proxy.
+func (b *Broker) clientKey(r *http.Request) string {
+	if b.adminAuthenticated(r) {
+		return "user:" + b.adminUsername
+	}
+	return "address:" + remoteAddress(r, b.trustedProxies)
+}
+
+// remoteAddress returns the address of the client of r, resolved through
+// trustedProxies
+func remoteAddress(r *http.Request, trustedProxies []*net.IPNet) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	if inNetworks(host, trustedProxies) {
+		forwarded := strings.Split(strings.Join(r.Header.Values(headerForwardedFor), ","), ",")
+		for i := len(forwarded) - 1; i >= 0; i-- {
+			address := strings.TrimSpace(forwarded[i])
+			if net.ParseIP(address) == nil {
+				break
+			}
+			host = address
+			if !inNetworks(address, trustedProxies) {
+				break
+			}
+		}
+	}
+	return host
+}
+
+// inNetworks reports whether address is an IP address in one of networks
+func inNetworks(address string, networks []*net.IPNet) bool {
+	ip := net.ParseIP(address)
+	for _, network := range networks {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// limitHandler enforces the rate limit per client and the maximum body size.
+// Health checks and metrics scrapes are not rate limited.
+func (b *Broker) limitHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b.metrics.requests.inc()
+
+		if b.rateLimiter != nil && r.URL.Path != "/health" && r.URL.Path != "/metrics" {
+			if ok, wait := b.rateLimiter.allow(b.clientKey(r), time.Now()); !ok {
+				b.metrics.rateLimited.inc()
+				err := fmt.Errorf("rate limit of %v requests per second exceeded", b.rateLimiter.rate)
+				log.Printf("Error: %v", err)
+				w.Header().Set(headerRetryAfter, strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				handleHTTPError(w, http.StatusTooManyRequests, err)
+				return
+			}
+		}
+
+		if r.URL.Path != importPath && !b.limitBody(w, r, b.maxBodySize) {
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitBody reads the body of r up to limit bytes, 0 disables the limit. It
+// responds with an error and returns false if the body is larger or cannot
+// be read.
+func (b *Broker) limitBody(w http.ResponseWriter, r *http.Request, limit int64) bool {
+	if limit <= 0 || r.Body == nil || r.Body == http.NoBody {
+		return true
+	}
+	if r.ContentLength > limit {
+		b.bodyTooLarge(w, limit)
+		return false
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	if err != nil {
+		if int64(len(body)) >= limit {
+			b.bodyTooLarge(w, limit)
+			return false
+		}
+		log.Printf("Error: %v", err)
+		handleHTTPError(w, http.StatusBadRequest, err)
+		return false
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return true
+}
+
+func (b *Broker) bodyTooLarge(w http.ResponseWriter, limit int64) {
+	b.metrics.bodyTooLarge.inc()
+	err := fmt.Errorf("request body exceeds %v bytes", limit)
+	log.Printf("Error: %v", err)
+	handleHTTPError(w, http.StatusRequestEntityTooLarge, err)
+}
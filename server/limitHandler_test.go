@@ -0,0 +1,185 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sklevenz/lookup-broker/openapi"
+	"github.com/sklevenz/lookup-broker/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := newRateLimiter(2, 3)
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		ok, _ := limiter.allow("a", now)
+		assert.True(t, ok)
+	}
+	ok, wait := limiter.allow("a", now)
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, wait)
+
+	ok, _ = limiter.allow("b", now)
+	assert.True(t, ok)
+
+	ok, _ = limiter.allow("a", now.Add(500*time.Millisecond))
+	assert.True(t, ok)
+	assert.Equal(t, 2, limiter.clients())
+
+	ok, _ = limiter.allow("c", now.Add(time.Hour))
+	assert.True(t, ok)
+	assert.Equal(t, 1, limiter.clients())
+}
+
+func TestRateLimiterMaxBuckets(t *testing.T) {
+	limiter := newRateLimiter(1, 1)
+	limiter.maxBuckets = 2
+	now := time.Now()
+
+	ok, _ := limiter.allow("a", now)
+	assert.True(t, ok)
+	ok, _ = limiter.allow("b", now)
+	assert.True(t, ok)
+
+	// further clients share the overflow bucket
+	ok, _ = limiter.allow("c", now)
+	assert.True(t, ok)
+	ok, _ = limiter.allow("d", now)
+	assert.False(t, ok)
+	assert.Equal(t, 3, limiter.clients())
+
+	// idle buckets make room for new clients
+	ok, _ = limiter.allow("d", now.Add(time.Hour))
+	assert.True(t, ok)
+	assert.Equal(t, 1, limiter.clients())
+}
+
+func TestClientKey(t *testing.T) {
+	broker := New(WithAdminCredentials(adminUsername, adminPassword))
+
+	request, _ := http.NewRequest(http.MethodGet, "/v2/catalog", nil)
+	request.RemoteAddr = "10.0.0.1:4711"
+	assert.Equal(t, "address:10.0.0.1", broker.clientKey(request))
+
+	// the header of untrusted clients is ignored
+	request.Header.Set(headerForwardedFor, "203.0.113.7")
+	assert.Equal(t, "address:10.0.0.1", broker.clientKey(request))
+
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	broker.trustedProxies = []*net.IPNet{proxies}
+	assert.Equal(t, "address:203.0.113.7", broker.clientKey(request))
+
+	// addresses prepended by the client itself are ignored
+	request.Header.Set(headerForwardedFor, "198.51.100.1, 203.0.113.7, 10.0.0.2")
+	assert.Equal(t, "address:203.0.113.7", broker.clientKey(request))
+	request.Header.Set(headerForwardedFor, "not an address")
+	assert.Equal(t, "address:10.0.0.1", broker.clientKey(request))
+
+	// unverified identities and usernames are ignored
+	request.Header.Set(headerAPIOrginatingIdentity, "cloudfoundry eyJ1c2VyX2lkIjogIjEifQ==")
+	assert.Equal(t, "address:10.0.0.1", broker.clientKey(request))
+	request.SetBasicAuth(adminUsername, "wrong")
+	assert.Equal(t, "address:10.0.0.1", broker.clientKey(request))
+
+	request.SetBasicAuth(adminUsername, adminPassword)
+	assert.Equal(t, "user:"+adminUsername, broker.clientKey(request))
+}
+
+func TestRateLimitHandler(t *testing.T) {
+	broker := New(WithRateLimit(1, 2))
+
+	get := func(address string, user string) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest(http.MethodGet, "/v2/catalog", nil)
+		request.RemoteAddr = address + ":4711"
+		request.Header.Set(headerAPIVersion, supportedAPIVersionValue)
+		request.SetBasicAuth(user, "secret")
+		response := httptest.NewRecorder()
+		broker.ServeHTTP(response, request)
+		return response
+	}
+
+	assert.Equal(t, http.StatusOK, get("10.0.0.1", "a").Code)
+	assert.Equal(t, http.StatusOK, get("10.0.0.1", "b").Code)
+
+	// changing the username does not escape the limit
+	response := get("10.0.0.1", "c")
+	assert.Equal(t, http.StatusTooManyRequests, response.Code)
+	assert.Equal(t, "1", response.Header().Get(headerRetryAfter))
+
+	var osbError openapi.Error
+	assert.Nil(t, json.NewDecoder(response.Body).Decode(&osbError))
+	assert.Equal(t, http.StatusText(http.StatusTooManyRequests), osbError.Error)
+
+	assert.Equal(t, http.StatusOK, get("10.0.0.2", "a").Code)
+
+	request, _ := http.NewRequest(http.MethodGet, "/health", nil)
+	request.RemoteAddr = "10.0.0.1:4711"
+	request.SetBasicAuth("a", "secret")
+	health := httptest.NewRecorder()
+	broker.ServeHTTP(health, request)
+	assert.Equal(t, http.StatusOK, health.Code)
+}
+
+func TestMaxBodySizeHandler(t *testing.T) {
+	broker := New(WithMaxBodySize(64))
+
+	put := func(payload string, contentLength int64) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest(http.MethodPut, "/v2/service_instances/123", strings.NewReader(payload))
+		request.Header.Set(headerAPIVersion, supportedAPIVersionValue)
+		request.Header.Set(headerContentType, contentTypeJSON)
+		request.ContentLength = contentLength
+		response := httptest.NewRecorder()
+		broker.ServeHTTP(response, request)
+		return response
+	}
+
+	payload := `{"service_id": "1", "plan_id": "1.1"}`
+	assert.Equal(t, http.StatusCreated, put(payload, int64(len(payload))).Code)
+	assert.Equal(t, http.StatusOK, put(payload, -1).Code)
+
+	payload = `{"service_id": "1", "plan_id": "1.1", "parameters": {"padding": "` + strings.Repeat("x", 64) + `"}}`
+	response := put(payload, int64(len(payload)))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, response.Code)
+
+	var osbError openapi.Error
+	assert.Nil(t, json.NewDecoder(response.Body).Decode(&osbError))
+	assert.Equal(t, "request body exceeds 64 bytes", osbError.Description)
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, put(payload, -1).Code)
+}
+
+func TestMaxImportSizeHandler(t *testing.T) {
+	source := newAdminBroker()
+	source.store.SaveInstance(&store.Instance{InstanceID: "1", ServiceID: "1", PlanID: "1.1"})
+	response := httptest.NewRecorder()
+	source.ServeHTTP(response, adminRequest(http.MethodGet, "/admin/store/export", nil))
+	archive := response.Body.String()
+
+	size := int64(len(archive))
+	broker := New(withLandscapes(landscapes), WithAdminCredentials(adminUsername, adminPassword), WithMaxBodySize(64), WithMaxImportSize(size))
+
+	// the import is not limited by the body size
+	response = httptest.NewRecorder()
+	broker.ServeHTTP(response, adminRequest(http.MethodPost, "/admin/store/import", strings.NewReader(archive)))
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	response = httptest.NewRecorder()
+	broker.ServeHTTP(response, adminRequest(http.MethodPost, "/admin/store/import", strings.NewReader(archive+" ")))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, response.Code)
+	assert.Contains(t, response.Body.String(), fmt.Sprintf("request body exceeds %v bytes", size))
+
+	// the body is not read without admin credentials
+	request := adminRequest(http.MethodPost, "/admin/store/import", strings.NewReader(archive+" "))
+	request.SetBasicAuth(adminUsername, "wrong")
+	response = httptest.NewRecorder()
+	broker.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+const contentTypeMetrics string = "text/plain; version=0.0.4"
+
+type counter int64
+
+func (c *counter) inc() {
+	atomic.AddInt64((*int64)(c), 1)
+}
+
+func (c *counter) value() int64 {
+	return atomic.LoadInt64((*int64)(c))
+}
+
+// metrics counts the requests of the broker
+type metrics struct {
+	requests     counter
+	rateLimited  counter
+	bodyTooLarge counter
+}
+
+// metricsHandler publishes the metrics in the Prometheus text format
+func (b *Broker) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	clients := 0
+	if b.rateLimiter != nil {
+		clients = b.rateLimiter.clients()
+	}
+
+	w.Header().Set(headerContentType, contentTypeMetrics)
+	fmt.Fprintln(w, "# HELP lookup_broker_http_requests_total Number of HTTP requests received.")
+	fmt.Fprintln(w, "# TYPE lookup_broker_http_requests_total counter")
+	fmt.Fprintf(w, "lookup_broker_http_requests_total %v\n", b.metrics.requests.value())
+	fmt.Fprintln(w, "# HELP lookup_broker_http_requests_rejected_total Number of HTTP requests rejected by limits.")
+	fmt.Fprintln(w, "# TYPE lookup_broker_http_requests_rejected_total counter")
+	fmt.Fprintf(w, "lookup_broker_http_requests_rejected_total{reason=\"rate_limit\"} %v\n", b.metrics.rateLimited.value())
+	fmt.Fprintf(w, "lookup_broker_http_requests_rejected_total{reason=\"body_size\"} %v\n", b.metrics.bodyTooLarge.value())
+	fmt.Fprintln(w, "# HELP lookup_broker_rate_limit_clients Number of clients tracked by the rate limit.")
+	fmt.Fprintln(w, "# TYPE lookup_broker_rate_limit_clients gauge")
+	fmt.Fprintf(w, "lookup_broker_rate_limit_clients %v\n", clients)
+}
@@ -0,0 +1,34 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	broker := New(WithRateLimit(1, 1), WithMaxBodySize(8))
+
+	for i := 0; i < 2; i++ {
+		request, _ := http.NewRequest(http.MethodGet, "/", nil)
+		broker.ServeHTTP(httptest.NewRecorder(), request)
+	}
+	request, _ := http.NewRequest(http.MethodPut, "/admin/landscapes/cf-eu10", strings.NewReader(landscapes))
+	request.Header.Set(headerContentType, contentTypeJSON)
+	request.RemoteAddr = "10.0.0.2:4711"
+	broker.ServeHTTP(httptest.NewRecorder(), request)
+
+	request, _ = http.NewRequest(http.MethodGet, "/metrics", nil)
+	response := httptest.NewRecorder()
+	broker.ServeHTTP(response, request)
+
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, contentTypeMetrics, response.Header().Get(headerContentType))
+	assert.Contains(t, response.Body.String(), "lookup_broker_http_requests_total 4\n")
+	assert.Contains(t, response.Body.String(), `lookup_broker_http_requests_rejected_total{reason="rate_limit"} 1`+"\n")
+	assert.Contains(t, response.Body.String(), `lookup_broker_http_requests_rejected_total{reason="body_size"} 1`+"\n")
+	assert.Contains(t, response.Body.String(), "lookup_broker_rate_limit_clients 2\n")
+}
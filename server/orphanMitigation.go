@@ -0,0 +1,26 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// trackOperation runs a provision or bind whose entry is saved by save. The
+// entry is saved as incomplete before work and completed once work is done.
+// If work or saving fails, the incomplete entry stays until the orphan
+// mitigation DELETE of the platform, which the OSB API demands after a failed
+// provision or bind. Nothing is saved for a request the platform already gave
+// up on, e.g. by a timeout.
+func trackOperation(r *http.Request, save func(incomplete bool) error, work func() error) error {
+	if err := r.Context().Err(); err != nil {
+		return fmt.Errorf("%v %v aborted by the platform: %v", r.Method, r.URL.Path, err)
+	}
+
+	if err := save(true); err != nil {
+		return err
+	}
+	if err := work(); err != nil {
+		return err
+	}
+	return save(false)
+}
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sklevenz/lookup-broker/store"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	mitigationInstancePayload = `{"service_id": "1", "plan_id": "1.1", "organization_guid": "org", "space_guid": "space"}`
+	mitigationBindingPayload  = `{"service_id": "1", "plan_id": "1.1", "parameters": {"selector": "aws"}}`
+)
+
+// interruptingStore calls interrupt on every save of an incomplete entry
+type interruptingStore struct {
+	store.Store
+	interrupt func() error
+}
+
+func (s *interruptingStore) SaveInstance(instance *store.Instance) error {
+	if err := s.Store.SaveInstance(instance); err != nil || !instance.Incomplete {
+		return err
+	}
+	return s.interrupt()
+}
+
+func (s *interruptingStore) SaveBinding(binding *store.Binding) error {
+	if err := s.Store.SaveBinding(binding); err != nil || !binding.Incomplete {
+		return err
+	}
+	return s.interrupt()
+}
+
+func mitigationRequest(ctx context.Context, method string, target string, payload string) *http.Request {
+	request, _ := http.NewRequestWithContext(ctx, method, target, strings.NewReader(payload))
+	request.Header.Set(headerAPIVersion, supportedAPIVersionValue)
+	if payload != "" {
+		request.Header.Set(headerContentType, contentTypeJSON)
+	}
+	return request
+}
+
+func serveMitigation(broker *Broker, request *http.Request) int {
+	response := httptest.NewRecorder()
+	broker.ServeHTTP(response, request)
+	return response.Code
+}
+
+func TestProvisionTimeout(t *testing.T) {
+	s := store.NewMemoryStore()
+	broker := New(WithStore(s))
+
+	// the platform gave up before the broker got to the provision
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	code := serveMitigation(broker, mitigationRequest(ctx, http.MethodPut, "/v2/service_instances/123", mitigationInstancePayload))
+	assert.Equal(t, http.StatusInternalServerError, code)
+	_, err := s.Instance("123")
+	assert.Equal(t, store.ErrNotFound, err)
+
+	code = serveMitigation(broker, mitigationRequest(context.Background(), http.MethodDelete, "/v2/service_instances/123", ""))
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestProvisionFailure(t *testing.T) {
+	s := &interruptingStore{Store: store.NewMemoryStore(), interrupt: func() error {
+		return errors.New("connection lost")
+	}}
+	broker := New(WithStore(s))
+
+	code := serveMitigation(broker, mitigationRequest(context.Background(), http.MethodPut, "/v2/service_instances/123", mitigationInstancePayload))
+	assert.Equal(t, http.StatusInternalServerError, code)
+	instance, err := s.Instance("123")
+	assert.Nil(t, err)
+	assert.True(t, instance.Incomplete)
+
+	orphans, err := store.FindOrphans(s, 0, time.Now().UTC())
+	assert.Nil(t, err)
+	assert.Equal(t, store.OrphanIncomplete, orphans[0].Reason)
+
+	code = serveMitigation(broker, mitigationRequest(context.Background(), http.MethodDelete, "/v2/service_instances/123", ""))
+	assert.Equal(t, http.StatusOK, code)
+	_, err = s.Instance("123")
+	assert.Equal(t, store.ErrNotFound, err)
+}
+
+func TestProvisionRetry(t *testing.T) {
+	s := store.NewMemoryStore()
+	s.SaveInstance(&store.Instance{InstanceID: "123", ServiceID: "1", PlanID: "1.2", Incomplete: true})
+	broker := New(WithStore(s))
+
+	code := serveMitigation(broker, mitigationRequest(context.Background(), http.MethodPut, "/v2/service_instances/123", mitigationInstancePayload))
+	assert.Equal(t, http.StatusCreated, code)
+	instance, err := s.Instance("123")
+	assert.Nil(t, err)
+	assert.False(t, instance.Incomplete)
+	assert.Equal(t, "1.1", instance.PlanID)
+}
+
+func TestBindTimeout(t *testing.T) {
+	s := store.NewMemoryStore()
+	broker := New(WithStore(s))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	code := serveMitigation(broker, mitigationRequest(ctx, http.MethodPut, "/v2/service_instances/123/service_bindings/456", mitigationBindingPayload))
+	assert.Equal(t, http.StatusInternalServerError, code)
+	_, err := s.Binding("123", "456")
+	assert.Equal(t, store.ErrNotFound, err)
+
+	code = serveMitigation(broker, mitigationRequest(context.Background(), http.MethodDelete, "/v2/service_instances/123/service_bindings/456", ""))
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestBindRepeated(t *testing.T) {
+	interrupted := false
+	s := &interruptingStore{Store: store.NewMemoryStore(), interrupt: func() error {
+		interrupted = true
+		return nil
+	}}
+	broker := New(WithStore(s))
+
+	code := serveMitigation(broker, mitigationRequest(context.Background(), http.MethodPut, "/v2/service_instances/123/service_bindings/456", mitigationBindingPayload))
+	assert.Equal(t, http.StatusCreated, code)
+	created, _ := s.Binding("123", "456")
+
+	// a repeated bind does not touch the complete binding, even if the
+	// platform gives up on it
+	interrupted = false
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	response := httptest.NewRecorder()
+	broker.ServeHTTP(response, mitigationRequest(ctx, http.MethodPut, "/v2/service_instances/123/service_bindings/456", mitigationBindingPayload))
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Contains(t, response.Body.String(), `"landscapes"`)
+	assert.False(t, interrupted)
+
+	code = serveMitigation(broker, mitigationRequest(context.Background(), http.MethodPut, "/v2/service_instances/123/service_bindings/456", `{"service_id": "1", "plan_id": "1.1", "parameters": {"selector": "azure"}}`))
+	assert.Equal(t, http.StatusConflict, code)
+	assert.False(t, interrupted)
+
+	binding, err := s.Binding("123", "456")
+	assert.Nil(t, err)
+	assert.Equal(t, created, binding)
+	assert.False(t, binding.Incomplete)
+}
+
+func TestBindFailure(t *testing.T) {
+	s := &interruptingStore{Store: store.NewMemoryStore(), interrupt: func() error {
+		return errors.New("connection lost")
+	}}
+	broker := New(WithStore(s))
+
+	code := serveMitigation(broker, mitigationRequest(context.Background(), http.MethodPut, "/v2/service_instances/123/service_bindings/456", mitigationBindingPayload))
+	assert.Equal(t, http.StatusInternalServerError, code)
+	binding, err := s.Binding("123", "456")
+	assert.Nil(t, err)
+	assert.True(t, binding.Incomplete)
+
+	// the incomplete binding is not handed out
+	response := httptest.NewRecorder()
+	broker.ServeHTTP(response, mitigationRequest(context.Background(), http.MethodGet, "/v2/service_instances/123/service_bindings/456", ""))
+	assert.NotContains(t, response.Body.String(), `"selector":"aws"`)
+
+	code = serveMitigation(broker, mitigationRequest(context.Background(), http.MethodDelete, "/v2/service_instances/123/service_bindings/456", ""))
+	assert.Equal(t, http.StatusOK, code)
+	_, err = s.Binding("123", "456")
+	assert.Equal(t, store.ErrNotFound, err)
+}
+
+func TestBindMitigationInProgress(t *testing.T) {
+	s := store.NewMemoryStore()
+	s.SaveInstance(&store.Instance{InstanceID: "123", ServiceID: "1", PlanID: "1.1"})
+	now := time.Now().UTC()
+	// another broker instance binds to instance 123
+	assert.Nil(t, s.LockInstance(&store.InstanceLock{InstanceID: "123", Owner: "other", Operation: http.MethodPut, Acquired: now, Expires: now.Add(time.Minute)}))
+	broker := New(WithStore(s))
+
+	// the mitigation DELETE waits for the bind still in progress
+	response := httptest.NewRecorder()
+	broker.ServeHTTP(response, mitigationRequest(context.Background(), http.MethodDelete, "/v2/service_instances/123/service_bindings/456", ""))
+	assert.Equal(t, http.StatusUnprocessableEntity, response.Code)
+	assert.Contains(t, response.Body.String(), "another operation on service instance 123 is in progress")
+
+	// the instance is not deleted while it is bound
+	response = httptest.NewRecorder()
+	broker.ServeHTTP(response, mitigationRequest(context.Background(), http.MethodDelete, "/v2/service_instances/123?service_id=1&plan_id=1.1", ""))
+	assert.Equal(t, http.StatusUnprocessableEntity, response.Code)
+	_, err := s.Instance("123")
+	assert.Nil(t, err)
+}
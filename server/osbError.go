@@ -0,0 +1,160 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/sklevenz/lookup-broker/openapi"
+)
+
+// Error codes defined by the OSB API for the error field of openapi.Error
+const (
+	errorConcurrency             string = "ConcurrencyError"
+	errorMaintenanceInfoConflict string = "MaintenanceInfoConflict"
+	// errorBindingExpired is no code of the OSB API, it tells platforms to
+	// rotate a binding whose credentials expired
+	errorBindingExpired string = "BindingExpired"
+)
+
+// UnknownFieldPolicy defines how the OSB API treats unknown fields of a request body
+type UnknownFieldPolicy string
+
+const (
+	// UnknownFieldsIgnore logs unknown fields and ignores them as the OSB API demands
+	UnknownFieldsIgnore UnknownFieldPolicy = "ignore"
+	// UnknownFieldsReject rejects requests with unknown fields
+	UnknownFieldsReject UnknownFieldPolicy = "reject"
+)
+
+// osbError is an error of the OSB API with its HTTP status and the OSB error
+// code, the status text is used if the OSB API does not define a code
+type osbError struct {
+	status           int
+	code             string
+	err              error
+	instanceUsable   bool
+	updateRepeatable bool
+}
+
+func (e *osbError) Error() string {
+	return e.err.Error()
+}
+
+func newOSBError(status int, code string, err error) *osbError {
+	return &osbError{status: status, code: code, err: err}
+}
+
+func badRequest(err error) *osbError {
+	return newOSBError(http.StatusBadRequest, "", err)
+}
+
+// osbHandler is a handler of the OSB API reporting errors by its result
+type osbHandler func(w http.ResponseWriter, r *http.Request) error
+
+// ServeHTTP responds with the error of the handler, if any
+func (h osbHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := h(w, r); err != nil {
+		handleV2Error(w, err)
+	}
+}
+
+// handleV2Error maps err to an OSB error response, errors which are not an
+// osbError are internal server errors
+func handleV2Error(w http.ResponseWriter, err error) {
+	log.Printf("Error: %v", err)
+
+	var e *osbError
+	if !errors.As(err, &e) {
+		e = newOSBError(http.StatusInternalServerError, "", err)
+	}
+
+	code := e.code
+	if code == "" {
+		code = http.StatusText(e.status)
+	}
+	handleOSBError(w, e.status, openapi.Error{
+		Error:            code,
+		Description:      e.err.Error(),
+		InstanceUsable:   e.instanceUsable,
+		UpdateRepeatable: e.updateRepeatable,
+	})
+}
+
+// decodeRequest decodes the JSON object of the request body into v. Type
+// errors report the JSON path of the field, unknown fields are handled by
+// the unknown field policy of the broker.
+func (b *Broker) decodeRequest(r *http.Request, v interface{}) error {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return badRequest(err)
+	}
+
+	err = decodeStrict(body, v)
+	if err != nil && strings.HasPrefix(err.Error(), "json: unknown field ") && b.unknownFields != UnknownFieldsReject {
+		log.Printf("Ignoring %v", strings.TrimPrefix(err.Error(), "json: "))
+		err = json.Unmarshal(body, v)
+	}
+	if err != nil {
+		return badRequest(fmt.Errorf("invalid request body: %v", describeDecodeError(err)))
+	}
+	return nil
+}
+
+func decodeStrict(body []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return errors.New("unexpected data after JSON object")
+	}
+	return nil
+}
+
+func describeDecodeError(err error) string {
+	var syntaxError *json.SyntaxError
+	var typeError *json.UnmarshalTypeError
+
+	switch {
+	case err == io.EOF:
+		return "empty body"
+	case err == io.ErrUnexpectedEOF:
+		return "unexpected end of JSON"
+	case errors.As(err, &syntaxError):
+		return fmt.Sprintf("%v at offset %v", syntaxError, syntaxError.Offset)
+	case errors.As(err, &typeError):
+		if typeError.Field == "" {
+			return fmt.Sprintf("must be %v, got %v", jsonType(typeError.Type), typeError.Value)
+		}
+		return fmt.Sprintf("%v must be %v, got %v", typeError.Field, jsonType(typeError.Type), typeError.Value)
+	}
+	return strings.TrimPrefix(err.Error(), "json: ")
+}
+
+// jsonType names the JSON type decoded into t
+func jsonType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	case reflect.Map, reflect.Struct:
+		return "an object"
+	}
+	return t.String()
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sklevenz/lookup-broker/openapi"
+	"github.com/stretchr/testify/assert"
+)
+
+func putInstance(broker *Broker, payload string) (int, openapi.Error) {
+	request, _ := http.NewRequest(http.MethodPut, "/v2/service_instances/123", strings.NewReader(payload))
+	request.Header.Set(headerAPIVersion, supportedAPIVersionValue)
+	request.Header.Set(headerContentType, contentTypeJSON)
+
+	response := httptest.NewRecorder()
+	broker.ServeHTTP(response, request)
+
+	var osbError openapi.Error
+	json.NewDecoder(response.Body).Decode(&osbError)
+	return response.Code, osbError
+}
+
+func TestHandleV2Error(t *testing.T) {
+	response := httptest.NewRecorder()
+	handleV2Error(response, newOSBError(http.StatusUnprocessableEntity, errorConcurrency, errors.New("operation in progress")))
+	assert.Equal(t, http.StatusUnprocessableEntity, response.Code)
+	assert.JSONEq(t, `{"error": "ConcurrencyError", "description": "operation in progress"}`, response.Body.String())
+
+	response = httptest.NewRecorder()
+	handleV2Error(response, badRequest(errors.New("wrong")))
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	assert.JSONEq(t, `{"error": "Bad Request", "description": "wrong"}`, response.Body.String())
+
+	response = httptest.NewRecorder()
+	handleV2Error(response, errors.New("store failed"))
+	assert.Equal(t, http.StatusInternalServerError, response.Code)
+	assert.JSONEq(t, `{"error": "Internal Server Error", "description": "store failed"}`, response.Body.String())
+}
+
+func TestDecodeRequestErrors(t *testing.T) {
+	broker := New()
+
+	tests := []struct {
+		payload     string
+		description string
+	}{
+		{``, "invalid request body: empty body"},
+		{`{"service_id": "1",`, "invalid request body: unexpected end of JSON"},
+		{`{"service_id": "1"}}`, "invalid request body: unexpected data after JSON object"},
+		{`{"service_id" "1"}`, "invalid request body: invalid character '\"' after object key at offset 15"},
+		{`{"service_id": 1}`, "invalid request body: service_id must be a string, got number"},
+		{`{"service_id": "1", "maintenance_info": {"version": true}}`, "invalid request body: maintenance_info.version must be a string, got bool"},
+		{`{"service_id": "1", "context": []}`, "invalid request body: context must be an object, got array"},
+	}
+
+	for _, test := range tests {
+		code, osbError := putInstance(broker, test.payload)
+		assert.Equal(t, http.StatusBadRequest, code, test.payload)
+		assert.Equal(t, test.description, osbError.Description, test.payload)
+	}
+}
+
+func TestDecodeRequestUnknownFields(t *testing.T) {
+	const payload = `{"service_id": "1", "plan_id": "1.1", "organization_guid": "org", "space_guid": "space", "unknown": 1}`
+
+	code, _ := putInstance(New(), payload)
+	assert.Equal(t, http.StatusCreated, code)
+
+	code, osbError := putInstance(New(WithUnknownFields(UnknownFieldsReject)), payload)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, `invalid request body: unknown field "unknown"`, osbError.Description)
+}
+
+func TestMaintenanceInfoConflict(t *testing.T) {
+	code, osbError := putInstance(New(), `{"service_id": "1", "plan_id": "1.1", "organization_guid": "org", "space_guid": "space", "maintenance_info": {"version": "1.0.0"}}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+	assert.Equal(t, errorMaintenanceInfoConflict, osbError.Error)
+
+	code, _ = putInstance(New(), `{"service_id": "1", "plan_id": "1.1", "organization_guid": "org", "space_guid": "space", "maintenance_info": {"version": "0.0.0"}}`)
+	assert.Equal(t, http.StatusCreated, code)
+}
@@ -1,9 +1,18 @@
 package server
 
 import (
+	"log"
+	"net"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/sklevenz/lookup-broker/config"
+	"github.com/sklevenz/lookup-broker/jws"
+	"github.com/sklevenz/lookup-broker/landscape"
+	"github.com/sklevenz/lookup-broker/store"
+	"github.com/sklevenz/lookup-broker/webhook"
 )
 
 const (
@@ -17,27 +26,317 @@ const (
 	contentTypeJSON string = "application/json"
 )
 
-// New implements the routes defined by OSB v2.0 API
-func New() http.Handler {
+// Broker serves the OSB v2.0 API and the landscape lookup API
+type Broker struct {
+	router   *mux.Router
+	registry *landscape.Registry
+	store    store.Store
+	notifier *webhook.Notifier
+
+	adminUsername string
+	adminPassword string
+
+	clientCertificates bool
+	clientPlatforms    map[string][]string
+
+	config *config.Config
+
+	unknownFields    UnknownFieldPolicy
+	operationTimeout time.Duration
+	orphanAge        time.Duration
+	bindingLifetimes map[string]time.Duration
+	signer           *jws.Signer
+	issuer           string
+
+	webhookDeniedNetworks []*net.IPNet
+
+	rateLimiter    *rateLimiter
+	trustedProxies []*net.IPNet
+	maxBodySize    int64
+	maxImportSize  int64
+	metrics        metrics
+
+	// landscapesMutex serializes changes of the landscapes managed by the admin API
+	landscapesMutex sync.Mutex
+
+	// draining is closed on shutdown to end the landscape watch streams
+	draining  chan struct{}
+	drainOnce sync.Once
+}
+
+// Option configures a broker
+type Option func(*Broker)
+
+// WithRegistry sets the registry providing the landscapes. Changes of the
+// admin API only become active if the registry includes a
+// store.LandscapeSource of the broker's store.
+func WithRegistry(registry *landscape.Registry) Option {
+	return func(b *Broker) {
+		b.registry = registry
+	}
+}
+
+// WithStore sets the store persisting the state of the broker
+func WithStore(s store.Store) Option {
+	return func(b *Broker) {
+		b.store = s
+	}
+}
+
+// WithAdminCredentials enables the admin API for basic authentication with username and password
+func WithAdminCredentials(username, password string) Option {
+	return func(b *Broker) {
+		b.adminUsername = username
+		b.adminPassword = password
+	}
+}
+
+// WithClientCertificates requires a verified client certificate for the OSB
+// API. If platforms is not nil, it maps the common name or the subject of a
+// certificate to the platforms of the originating identity the client may
+// act for, "*" allows all platforms.
+func WithClientCertificates(platforms map[string][]string) Option {
+	return func(b *Broker) {
+		b.clientCertificates = true
+		b.clientPlatforms = platforms
+	}
+}
+
+// WithConfig publishes the effective configuration at the admin API
+func WithConfig(c *config.Config) Option {
+	return func(b *Broker) {
+		b.config = c
+	}
+}
+
+// WithUnknownFields sets the policy for unknown fields in request bodies of
+// the OSB API, they are ignored by default
+func WithUnknownFields(policy UnknownFieldPolicy) Option {
+	return func(b *Broker) {
+		b.unknownFields = policy
+	}
+}
+
+// WithOperationTimeout sets the duration after which the lock of an
+// operation on a service instance expires, the default is one minute
+func WithOperationTimeout(timeout time.Duration) Option {
+	return func(b *Broker) {
+		b.operationTimeout = timeout
+	}
+}
+
+// WithOrphanAge reports instances and bindings not touched for age as
+// orphans, without it only bindings of missing instances are reported
+func WithOrphanAge(age time.Duration) Option {
+	return func(b *Broker) {
+		b.orphanAge = age
+	}
+}
+
+// WithBindingLifetimes limits the lifetime of the credentials of bindings
+// by plan ID or name, bindings of other plans do not expire
+func WithBindingLifetimes(lifetimes map[string]time.Duration) Option {
+	return func(b *Broker) {
+		b.bindingLifetimes = lifetimes
+	}
+}
+
+// WithCredentialsSigner adds the JWS of the landscapes signed by signer to
+// the binding credentials and publishes its key at /.well-known/jwks.json
+func WithCredentialsSigner(signer *jws.Signer) Option {
+	return func(b *Broker) {
+		b.signer = signer
+	}
+}
+
+// WithCredentialsIssuer sets the iss claim of the signed credentials, the
+// default is lookup-broker
+func WithCredentialsIssuer(issuer string) Option {
+	return func(b *Broker) {
+		b.issuer = issuer
+	}
+}
+
+// WithRateLimit limits the requests of every client to rate requests per
+// second with bursts of up to burst requests. Clients are identified by
+// their basic authentication user, their originating identity or their
+// address. A rate of 0 disables the limit, which is the default.
+func WithRateLimit(rate float64, burst int) Option {
+	return func(b *Broker) {
+		b.rateLimiter = nil
+		if rate > 0 {
+			b.rateLimiter = newRateLimiter(rate, burst)
+		}
+	}
+}
+
+// WithTrustedProxies identifies the clients of requests from the proxies in
+// networks by the X-Forwarded-For header for the rate limit, the header of
+// other clients is ignored
+func WithTrustedProxies(networks []*net.IPNet) Option {
+	return func(b *Broker) {
+		b.trustedProxies = networks
+	}
+}
+
+// WithWebhookDeniedNetworks rejects bindings whose webhook host has an
+// address in networks, so webhooks cannot reach internal services. By
+// default all addresses are allowed.
+func WithWebhookDeniedNetworks(networks []*net.IPNet) Option {
+	return func(b *Broker) {
+		b.webhookDeniedNetworks = networks
+	}
+}
+
+// WithMaxBodySize rejects requests with a body larger than size bytes, 0
+// disables the limit. The default is 1 MiB.
+func WithMaxBodySize(size int64) Option {
+	return func(b *Broker) {
+		b.maxBodySize = size
+	}
+}
+
+// WithMaxImportSize rejects store imports with a body larger than size
+// bytes, 0 disables the limit. The default is 64 MiB.
+func WithMaxImportSize(size int64) Option {
+	return func(b *Broker) {
+		b.maxImportSize = size
+	}
+}
+
+// New implements the routes defined by OSB v2.0 API. Without options the
+// state is kept in memory, the landscapes are loaded from the store and the
+// sources of the configuration set by WithConfig, and the admin API is
+// disabled.
+func New(options ...Option) *Broker {
+	b := &Broker{draining: make(chan struct{}), unknownFields: UnknownFieldsIgnore, operationTimeout: defaultOperationTimeout, maxBodySize: defaultMaxBodySize, maxImportSize: defaultMaxImportSize, issuer: defaultCredentialsIssuer}
+	for _, option := range options {
+		option(b)
+	}
+
+	if b.store == nil {
+		b.store = store.NewMemoryStore()
+	}
+
+	reload := b.registry == nil
+	if reload {
+		var sources []landscape.Source
+		if b.config != nil {
+			sources = landscape.NewSources(b.config.LandscapeSources())
+		}
+		sources = append(sources, store.LandscapeSource{Store: b.store})
+		b.registry = landscape.NewRegistry(sources...)
+	}
+
+	b.notifier = webhook.NewNotifier(b.store, b.webhookDeniedNetworks)
+	b.restoreRevision()
+	b.registry.OnChange(b.recordRevision)
+
+	if reload {
+		if err := b.registry.Reload(); err != nil {
+			log.Printf("Error: %v", err)
+		}
+	}
+
 	router := mux.NewRouter()
 
 	v2Router := router.PathPrefix("/v2").Subrouter()
+	if b.clientCertificates {
+		v2Router.Use(b.clientCertificateHandler)
+	}
 	v2Router.Use(apiVersionHandler)
 	v2Router.Use(requestIdentityLogHandler)
 	v2Router.Use(originatingIdentityLogHandler)
-	v2Router.HandleFunc("/catalog", catalogHandler).Name("v2.catalog").Methods(http.MethodGet)
-	v2Router.HandleFunc("/service_instances/{iid}", instancePutHandler).Headers(headerContentType, contentTypeJSON).Name("v2.instance.put").Methods(http.MethodPut)
-	v2Router.HandleFunc("/service_instances/{iid}", instanceGetHandler).Name("v2.instance.get").Methods(http.MethodGet)
-	v2Router.HandleFunc("/service_instances/{iid}", instancePatchHandler).Headers(headerContentType, contentTypeJSON).Name("v2.instance.patch").Methods(http.MethodPatch)
-	v2Router.HandleFunc("/service_instances/{iid}", instanceDeleteHandler).Name("v2.instance.delete").Methods(http.MethodDelete)
-	v2Router.HandleFunc("/service_instances/{iid}/service_bindings/{bid}", bindingPutHandler).Headers(headerContentType, contentTypeJSON).Name("v2.binding.put").Methods(http.MethodPut)
-	v2Router.HandleFunc("/service_instances/{iid}/service_bindings/{bid}", bindingGetHandler).Name("v2.binding.get").Methods(http.MethodGet)
-	v2Router.HandleFunc("/service_instances/{iid}/service_bindings/{bid}", bindingDeleteHandler).Name("v2.binding.delete").Methods(http.MethodDelete)
-
-	router.HandleFunc("/health", healthHandler).Name("health").Methods(http.MethodGet)
+	v2Router.Handle("/catalog", osbHandler(catalogHandler)).Name("v2.catalog").Methods(http.MethodGet)
+	v2Router.Handle("/service_instances/{iid}", b.instanceLock(b.instancePutHandler)).Headers(headerContentType, contentTypeJSON).Name("v2.instance.put").Methods(http.MethodPut)
+	v2Router.Handle("/service_instances/{iid}", osbHandler(b.instanceGetHandler)).Name("v2.instance.get").Methods(http.MethodGet)
+	v2Router.Handle("/service_instances/{iid}", b.instanceLock(b.instancePatchHandler)).Headers(headerContentType, contentTypeJSON).Name("v2.instance.patch").Methods(http.MethodPatch)
+	v2Router.Handle("/service_instances/{iid}", b.instanceLock(b.instanceDeleteHandler)).Name("v2.instance.delete").Methods(http.MethodDelete)
+	v2Router.Handle("/service_instances/{iid}/service_bindings/{bid}", b.instanceLock(b.bindingPutHandler)).Headers(headerContentType, contentTypeJSON).Name("v2.binding.put").Methods(http.MethodPut)
+	v2Router.Handle("/service_instances/{iid}/service_bindings/{bid}", osbHandler(b.bindingGetHandler)).Name("v2.binding.get").Methods(http.MethodGet)
+	v2Router.Handle("/service_instances/{iid}/service_bindings/{bid}", b.instanceLock(b.bindingDeleteHandler)).Name("v2.binding.delete").Methods(http.MethodDelete)
+
+	apiRouter := router.PathPrefix("/api/v1").Subrouter()
+	apiRouter.HandleFunc("/landscapes", b.landscapesGetHandler).Name("api.landscapes.get").Methods(http.MethodGet)
+	apiRouter.HandleFunc("/landscapes/watch", b.landscapesWatchHandler).Name("api.landscapes.watch").Methods(http.MethodGet)
+
+	adminRouter := router.PathPrefix("/admin").Subrouter()
+	adminRouter.Use(b.adminAuthHandler)
+	adminRouter.HandleFunc("/landscapes", b.adminLandscapesGetHandler).Name("admin.landscapes.get").Methods(http.MethodGet)
+	adminRouter.HandleFunc("/landscapes/provenance", b.provenanceGetHandler).Name("admin.landscapes.provenance").Methods(http.MethodGet)
+	adminRouter.HandleFunc("/landscapes/versions", b.adminVersionsGetHandler).Name("admin.landscapes.versions").Methods(http.MethodGet)
+	adminRouter.HandleFunc("/landscapes/versions/{version:[0-9]+}", b.adminVersionGetHandler).Name("admin.landscapes.version.get").Methods(http.MethodGet)
+	adminRouter.HandleFunc("/landscapes/versions/{version:[0-9]+}/rollback", b.adminVersionRollbackHandler).Name("admin.landscapes.version.rollback").Methods(http.MethodPost)
+	adminRouter.HandleFunc("/landscapes/revisions", b.adminRevisionsGetHandler).Name("admin.landscapes.revisions").Methods(http.MethodGet)
+	adminRouter.HandleFunc("/landscapes/revisions/{revision:[0-9]+}/diff", b.adminRevisionDiffHandler).Name("admin.landscapes.revision.diff").Methods(http.MethodGet)
+	adminRouter.HandleFunc("/landscapes/{name}", b.adminLandscapeGetHandler).Name("admin.landscape.get").Methods(http.MethodGet)
+	adminRouter.HandleFunc("/landscapes/{name}", b.adminLandscapePutHandler).Headers(headerContentType, contentTypeJSON).Name("admin.landscape.put").Methods(http.MethodPut)
+	adminRouter.HandleFunc("/config", b.adminConfigGetHandler).Name("admin.config.get").Methods(http.MethodGet)
+	adminRouter.HandleFunc("/store/backup", b.adminStoreBackupHandler).Name("admin.store.backup").Methods(http.MethodGet)
+	adminRouter.HandleFunc("/store/compact", b.adminStoreCompactHandler).Name("admin.store.compact").Methods(http.MethodPost)
+	adminRouter.HandleFunc("/store/export", b.adminStoreExportHandler).Name("admin.store.export").Methods(http.MethodGet)
+	adminRouter.HandleFunc("/store/import", b.adminStoreImportHandler).Headers(headerContentType, contentTypeJSON).Name("admin.store.import").Methods(http.MethodPost)
+	adminRouter.HandleFunc("/orphans", b.adminOrphansGetHandler).Name("admin.orphans.get").Methods(http.MethodGet)
+	adminRouter.HandleFunc("/orphans/purge", b.adminOrphansPurgeHandler).Name("admin.orphans.purge").Methods(http.MethodPost)
+	adminRouter.HandleFunc("/webhooks", b.adminWebhooksGetHandler).Name("admin.webhooks.get").Methods(http.MethodGet)
+	adminRouter.HandleFunc("/webhooks/deliveries", b.adminDeliveriesGetHandler).Name("admin.webhooks.deliveries").Methods(http.MethodGet)
+	adminRouter.HandleFunc("/landscapes/{name}", b.adminLandscapeDeleteHandler).Name("admin.landscape.delete").Methods(http.MethodDelete)
+
+	router.HandleFunc("/health", b.healthHandler).Name("health").Methods(http.MethodGet)
+	router.HandleFunc("/metrics", b.metricsHandler).Name("metrics").Methods(http.MethodGet)
+	router.HandleFunc("/.well-known/jwks.json", b.jwksHandler).Name("jwks").Methods(http.MethodGet)
 	router.HandleFunc("/", homeHandler).Name("home").Methods(http.MethodGet)
 
 	router.Use(logHandler)
+	router.Use(b.limitHandler)
+
+	b.router = router
+	return b
+}
+
+// restoreRevision continues the revision history of the store, so revision
+// numbers survive a restart and the first reload reports the changes since then
+func (b *Broker) restoreRevision() {
+	revision, err := b.store.LandscapeRevision(0)
+	if err == store.ErrNotFound {
+		return
+	}
+	if err != nil {
+		log.Printf("Error: could not restore landscape revision: %v", err)
+		return
+	}
+	b.registry.Restore(*revision)
+}
+
+// recordRevision is a landscape.Listener adding every revision to the store,
+// which numbers it. Brokers sharing a store see the same change, only the
+// broker recording it notifies the webhooks.
+func (b *Broker) recordRevision(before, after *landscape.Set, revision landscape.Revision) {
+	err := b.store.AddLandscapeRevision(&revision)
+	if err == store.ErrExists {
+		return
+	}
+	if err != nil {
+		log.Printf("Error: could not record landscape revision %v: %v", revision.Number, err)
+	}
+	b.notifier.LandscapesChanged(before, after, revision)
+}
+
+// Drain ends all landscape watch streams, so a shutdown of the HTTP server
+// does not wait for them. It is meant for http.Server.RegisterOnShutdown.
+func (b *Broker) Drain() {
+	b.drainOnce.Do(func() {
+		close(b.draining)
+	})
+}
+
+// Close drains the broker and waits until pending webhook deliveries are finished
+func (b *Broker) Close() {
+	b.Drain()
+	b.notifier.Close()
+}
 
-	return router
+// ServeHTTP dispatches the request to the matching route
+func (b *Broker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.router.ServeHTTP(w, r)
 }
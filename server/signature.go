@@ -0,0 +1,71 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/sklevenz/lookup-broker/store"
+)
+
+const (
+	contentTypeJWKSet string = "application/jwk-set+json"
+
+	// credentialSignature is the credential carrying the JWS of the lookup data
+	credentialSignature string = "jws"
+	// defaultCredentialsIssuer is the iss claim of the signed credentials
+	defaultCredentialsIssuer string = "lookup-broker"
+)
+
+// signCredentials adds the JWS of the landscapes and their metadata to the
+// credentials of binding, which is nil for unknown bindings. The webhook is
+// not signed, so its secret stays with the consumer. The token is issued by
+// the broker for the binding as subject and expires with the binding.
+func (b *Broker) signCredentials(credentials map[string]interface{}, binding *store.Binding) error {
+	if b.signer == nil {
+		return nil
+	}
+
+	claims := map[string]interface{}{
+		"iss":        b.issuer,
+		"iat":        time.Now().Unix(),
+		"landscapes": credentials["landscapes"],
+	}
+	if metadata, ok := credentials["metadata"]; ok {
+		claims["metadata"] = metadata
+	}
+	if binding != nil {
+		claims["sub"] = binding.InstanceID + "/" + binding.BindingID
+		if binding.ExpiresAt != nil {
+			claims["exp"] = binding.ExpiresAt.Unix()
+		}
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return err
+	}
+	token, err := b.signer.Sign(payload)
+	if err != nil {
+		return err
+	}
+	credentials[credentialSignature] = token
+	return nil
+}
+
+// jwksHandler publishes the key verifying the signed credentials
+func (b *Broker) jwksHandler(w http.ResponseWriter, r *http.Request) {
+	if b.signer == nil {
+		handleHTTPError(w, http.StatusNotFound, errors.New("credentials are not signed"))
+		return
+	}
+
+	js, err := json.Marshal(b.signer.KeySet())
+	if err != nil {
+		handleHTTPError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set(headerContentType, contentTypeJWKSet)
+	w.Write(js)
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sklevenz/lookup-broker/jws"
+	"github.com/sklevenz/lookup-broker/openapi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignedCredentials(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	signer, err := jws.NewSigner(key)
+	assert.Nil(t, err)
+	broker := New(WithCredentialsSigner(signer), WithCredentialsIssuer("https://lookup.example.com"), WithBindingLifetimes(map[string]time.Duration{"extension": time.Hour}))
+
+	request, _ := http.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil)
+	response := httptest.NewRecorder()
+	broker.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, contentTypeJWKSet, response.Header().Get(headerContentType))
+	var set jws.KeySet
+	assert.Nil(t, json.Unmarshal(response.Body.Bytes(), &set))
+	assert.Equal(t, signer.KeySet(), set)
+
+	response = putBinding(broker, "1", `{"service_id": "1", "plan_id": "1.1", "parameters": {"webhook": {"url": "https://example.com/hook", "secret": "secret"}}}`)
+	assert.Equal(t, http.StatusCreated, response.Code)
+	var content openapi.ServiceBindingResponse
+	assert.Nil(t, json.Unmarshal(response.Body.Bytes(), &content))
+
+	token, ok := content.Credentials[credentialSignature].(string)
+	assert.True(t, ok)
+	payload, err := jws.Verify(token, set)
+	assert.Nil(t, err)
+
+	var claims map[string]interface{}
+	assert.Nil(t, json.Unmarshal(payload, &claims))
+	assert.Equal(t, content.Credentials["landscapes"], claims["landscapes"])
+	assert.NotNil(t, claims["iat"])
+	assert.Equal(t, "https://lookup.example.com", claims["iss"])
+	assert.Equal(t, "123/1", claims["sub"])
+	expiresAt, _ := time.Parse(time.RFC3339, content.Metadata.ExpiresAt)
+	assert.Equal(t, float64(expiresAt.Unix()), claims["exp"])
+	assert.NotContains(t, string(payload), "secret")
+
+	request, _ = http.NewRequest(http.MethodGet, "/v2/service_instances/123/service_bindings/1", nil)
+	request.Header.Set(headerAPIVersion, supportedAPIVersionValue)
+	response = httptest.NewRecorder()
+	broker.ServeHTTP(response, request)
+	var resource openapi.ServiceBindingResource
+	assert.Nil(t, json.Unmarshal(response.Body.Bytes(), &resource))
+	_, err = jws.Verify(resource.Credentials[credentialSignature].(string), set)
+	assert.Nil(t, err)
+}
+
+func TestUnsignedCredentials(t *testing.T) {
+	broker := New()
+
+	request, _ := http.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil)
+	response := httptest.NewRecorder()
+	broker.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusNotFound, response.Code)
+
+	response = putBinding(broker, "1", `{"service_id": "1", "plan_id": "1.1"}`)
+	assert.Equal(t, http.StatusCreated, response.Code)
+	assert.NotContains(t, response.Body.String(), `"`+credentialSignature+`"`)
+}
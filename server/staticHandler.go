@@ -7,9 +7,14 @@ import (
 	"time"
 )
 
-func healthHandler(w http.ResponseWriter, r *http.Request) {
+func (b *Broker) healthHandler(w http.ResponseWriter, r *http.Request) {
+	health := map[string]interface{}{"ok": true}
+	if commit := b.registry.Current().Commit; commit != "" {
+		health["landscapes"] = map[string]string{"commit": commit}
+	}
+
 	w.Header().Set(headerContentType, contentTypeJSON)
-	json.NewEncoder(w).Encode(map[string]bool{"ok": true})
+	json.NewEncoder(w).Encode(health)
 }
 
 func homeHandler(w http.ResponseWriter, r *http.Request) {
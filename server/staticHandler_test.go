@@ -5,6 +5,7 @@ import (
 	"net/http/httptest"
 	"testing"
 
+	"github.com/sklevenz/lookup-broker/landscape"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -29,3 +30,27 @@ func TestHome(t *testing.T) {
 	assert.Equal(t, `Lookup-Broker`, response.Body.String())
 	assert.Equal(t, http.StatusOK, response.Result().StatusCode)
 }
+
+type commitSource struct{}
+
+func (commitSource) Name() string {
+	return "commit"
+}
+
+func (commitSource) Load() ([]landscape.Fragment, error) {
+	doc, err := landscape.ParseDocument([]byte(landscapes))
+	return []landscape.Fragment{{Origin: "commit", Document: doc, Commit: "4b825dc6"}}, err
+}
+
+func TestHealthCommit(t *testing.T) {
+	registry := landscape.NewRegistry(commitSource{})
+	assert.Nil(t, registry.Reload())
+
+	request, _ := http.NewRequest(http.MethodGet, "/health", nil)
+	response := httptest.NewRecorder()
+
+	New(WithRegistry(registry)).ServeHTTP(response, request)
+
+	assert.JSONEq(t, `{"ok":true, "landscapes": {"commit": "4b825dc6"}}`, response.Body.String())
+	assert.Equal(t, http.StatusOK, response.Result().StatusCode)
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// platformAny allows a client certificate to act for every platform
+const platformAny string = "*"
+
+// CertificateReloader serves the certificate of CertFile and KeyFile and
+// reloads it as soon as one of the files changes, so rotated certificates
+// become active without a restart
+type CertificateReloader struct {
+	CertFile string
+	KeyFile  string
+
+	mutex       sync.Mutex
+	certificate *tls.Certificate
+	modified    time.Time
+}
+
+// NewCertificateReloader loads the certificate of certFile and keyFile
+func NewCertificateReloader(certFile, keyFile string) (*CertificateReloader, error) {
+	reloader := &CertificateReloader{CertFile: certFile, KeyFile: keyFile}
+	if _, err := reloader.GetCertificate(nil); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate. If the changed files
+// cannot be loaded, e.g. while they are written, the previous certificate is
+// served.
+func (c *CertificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	modified, err := c.lastModified()
+	if err == nil && c.certificate != nil && !modified.After(c.modified) {
+		return c.certificate, nil
+	}
+
+	if err == nil {
+		var certificate tls.Certificate
+		certificate, err = tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err == nil {
+			if c.certificate != nil {
+				log.Printf("certificate %v reloaded", c.CertFile)
+			}
+			c.certificate = &certificate
+			c.modified = modified
+			return c.certificate, nil
+		}
+	}
+
+	if c.certificate == nil {
+		return nil, err
+	}
+	log.Printf("Error: could not reload certificate %v, keep previous one: %v", c.CertFile, err)
+	return c.certificate, nil
+}
+
+func (c *CertificateReloader) lastModified() (time.Time, error) {
+	var modified time.Time
+	for _, path := range []string{c.CertFile, c.KeyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(modified) {
+			modified = info.ModTime()
+		}
+	}
+	return modified, nil
+}
+
+// NewTLSConfig creates the server configuration for certFile and keyFile.
+// With a clientCAFile client certificates are verified against the CA
+// bundle, they are optional on TLS level and required by the routes of the
+// OSB API if the broker is created WithClientCertificates.
+func NewTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	reloader, err := NewCertificateReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+
+	if clientCAFile != "" {
+		pem, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %v", clientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return config, nil
+}
+
+// clientCertificateHandler requires a verified client certificate. If
+// platforms are configured, the subject of the certificate must be mapped to
+// the platform of the originating identity.
+func (b *Broker) clientCertificateHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			err := errors.New("verified client certificate required")
+			handleV2Error(w, newOSBError(http.StatusUnauthorized, "", err))
+			return
+		}
+
+		if b.clientPlatforms != nil {
+			subject := r.TLS.VerifiedChains[0][0].Subject
+			platform := originatingPlatform(r)
+
+			if !platformAllowed(b.clientPlatforms, subject.CommonName, subject.String(), platform) {
+				err := fmt.Errorf("client certificate %v not allowed for platform %q", subject, platform)
+				handleV2Error(w, newOSBError(http.StatusForbidden, "", err))
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// originatingPlatform returns the platform of the originating identity header
+func originatingPlatform(r *http.Request) string {
+	fields := strings.Fields(r.Header.Get(headerAPIOrginatingIdentity))
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
+}
+
+// platformAllowed looks up the platforms of a certificate by its common name
+// or its complete subject
+func platformAllowed(platforms map[string][]string, commonName string, subject string, platform string) bool {
+	for _, key := range []string{commonName, subject} {
+		for _, allowed := range platforms[key] {
+			if allowed == platformAny || (platform != "" && allowed == platform) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testCertificate struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	certPEM     []byte
+	keyPEM      []byte
+}
+
+func newTestCertificate(t *testing.T, commonName string, parent *testCertificate) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	issuer, issuerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		issuer, issuerKey = parent.certificate, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, issuerKey)
+	assert.Nil(t, err)
+	certificate, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+
+	return &testCertificate{
+		certificate: certificate,
+		key:         key,
+		certPEM:     pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:      pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func (c *testCertificate) write(t *testing.T, dir string, name string) (string, string) {
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	assert.Nil(t, ioutil.WriteFile(certFile, c.certPEM, 0600))
+	assert.Nil(t, ioutil.WriteFile(keyFile, c.keyPEM, 0600))
+	return certFile, keyFile
+}
+
+func (c *testCertificate) tlsCertificate(t *testing.T) tls.Certificate {
+	certificate, err := tls.X509KeyPair(c.certPEM, c.keyPEM)
+	assert.Nil(t, err)
+	return certificate
+}
+
+func TestCertificateReloader(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tls")
+	defer os.RemoveAll(dir)
+
+	ca := newTestCertificate(t, "ca", nil)
+	certFile, keyFile := newTestCertificate(t, "broker-1", ca).write(t, dir, "broker")
+
+	reloader, err := NewCertificateReloader(certFile, keyFile)
+	assert.Nil(t, err)
+
+	certificate, err := reloader.GetCertificate(nil)
+	assert.Nil(t, err)
+	leaf, _ := x509.ParseCertificate(certificate.Certificate[0])
+	assert.Equal(t, "broker-1", leaf.Subject.CommonName)
+
+	rotated := newTestCertificate(t, "broker-2", ca)
+	rotated.write(t, dir, "broker")
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+
+	certificate, err = reloader.GetCertificate(nil)
+	assert.Nil(t, err)
+	leaf, _ = x509.ParseCertificate(certificate.Certificate[0])
+	assert.Equal(t, "broker-2", leaf.Subject.CommonName)
+
+	ioutil.WriteFile(keyFile, []byte("rotation in progress"), 0600)
+	future = future.Add(time.Minute)
+	os.Chtimes(keyFile, future, future)
+
+	certificate, err = reloader.GetCertificate(nil)
+	assert.Nil(t, err)
+	leaf, _ = x509.ParseCertificate(certificate.Certificate[0])
+	assert.Equal(t, "broker-2", leaf.Subject.CommonName)
+
+	_, err = NewCertificateReloader(filepath.Join(dir, "missing.crt"), keyFile)
+	assert.NotNil(t, err)
+}
+
+func TestClientCertificates(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tls")
+	defer os.RemoveAll(dir)
+
+	ca := newTestCertificate(t, "ca", nil)
+	caFile := filepath.Join(dir, "ca.crt")
+	ioutil.WriteFile(caFile, ca.certPEM, 0600)
+	certFile, keyFile := newTestCertificate(t, "broker", ca).write(t, dir, "broker")
+
+	config, err := NewTLSConfig(certFile, keyFile, caFile)
+	assert.Nil(t, err)
+
+	server := httptest.NewUnstartedServer(New(withLandscapes(landscapes), WithClientCertificates(map[string][]string{
+		"cloud-controller": {"cloudfoundry"},
+		"operator":         {platformAny},
+	})))
+	server.Listener = tls.NewListener(server.Listener, config)
+	server.Start()
+	defer server.Close()
+	url := strings.Replace(server.URL, "http://", "https://", 1)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.certificate)
+
+	get := func(path string, client *testCertificate, platform string) int {
+		clientConfig := &tls.Config{RootCAs: pool}
+		if client != nil {
+			clientConfig.Certificates = []tls.Certificate{client.tlsCertificate(t)}
+		}
+		httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig}}
+
+		request, _ := http.NewRequest(http.MethodGet, url+path, nil)
+		request.Header.Set(headerAPIVersion, "2.14")
+		if platform != "" {
+			request.Header.Set(headerAPIOrginatingIdentity, platform+" "+base64.StdEncoding.EncodeToString([]byte(`{"user_id": "1"}`)))
+		}
+
+		response, err := httpClient.Do(request)
+		if !assert.Nil(t, err) {
+			return 0
+		}
+		response.Body.Close()
+		return response.StatusCode
+	}
+
+	controller := newTestCertificate(t, "cloud-controller", ca)
+	operator := newTestCertificate(t, "operator", ca)
+	unknown := newTestCertificate(t, "unknown", ca)
+
+	assert.Equal(t, http.StatusOK, get("/health", nil, ""))
+	assert.Equal(t, http.StatusUnauthorized, get("/v2/catalog", nil, ""))
+	assert.Equal(t, http.StatusOK, get("/v2/catalog", controller, "cloudfoundry"))
+	assert.Equal(t, http.StatusForbidden, get("/v2/catalog", controller, "kubernetes"))
+	assert.Equal(t, http.StatusForbidden, get("/v2/catalog", controller, ""))
+	assert.Equal(t, http.StatusOK, get("/v2/catalog", operator, "kubernetes"))
+	assert.Equal(t, http.StatusForbidden, get("/v2/catalog", unknown, "cloudfoundry"))
+}
@@ -2,19 +2,25 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"reflect"
 	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/sklevenz/lookup-broker/landscape"
 	"github.com/sklevenz/lookup-broker/openapi"
+	"github.com/sklevenz/lookup-broker/store"
+	"github.com/sklevenz/lookup-broker/webhook"
 )
 
 const (
@@ -24,8 +30,12 @@ const (
 	headerAPIOrginatingIdentity string = "X-Broker-API-Originating-Identity"
 	headerAPIRequestIdentity    string = "X-Broker-API-Request-Identity"
 
-	catalogServiceID = "1"
-	catalogPanID     = "1.1"
+	parameterSelector string = "selector"
+	parameterWebhook  string = "webhook"
+
+	catalogServiceID          = "1"
+	catalogPanID              = "1.1"
+	catalogMaintenanceVersion = "0.0.0"
 )
 
 type userIDType struct {
@@ -105,11 +115,13 @@ func handleHTTPError(w http.ResponseWriter, code int, err error) {
 	w.Write(output)
 }
 
-func catalogHandler(w http.ResponseWriter, r *http.Request) {
-	js, err := json.Marshal(buildCatalog(r))
+func catalogHandler(w http.ResponseWriter, r *http.Request) error {
+	catalog := Catalog()
+	log.Printf("Catalog: %v", catalog)
+
+	js, err := json.Marshal(catalog)
 	if err != nil {
-		handleHTTPError(w, http.StatusInternalServerError, err)
-		return
+		return err
 	}
 
 	w.Header().Set(headerContentType, contentTypeJSON)
@@ -117,9 +129,11 @@ func catalogHandler(w http.ResponseWriter, r *http.Request) {
 
 	reader := bytes.NewReader(js)
 	http.ServeContent(w, r, "", startTime, reader)
+	return nil
 }
 
-func buildCatalog(r *http.Request) *openapi.Catalog {
+// Catalog returns the services and plans offered by the broker
+func Catalog() *openapi.Catalog {
 	catalog := openapi.Catalog{}
 	var services []openapi.Service
 	var service openapi.Service
@@ -133,6 +147,7 @@ func buildCatalog(r *http.Request) *openapi.Catalog {
 	service.InstancesRetrievable = true
 	service.BindingsRetrievable = true
 	service.AllowContextUpdates = true
+	service.BindingRotatable = true
 	service.Metadata = map[string]interface{}{}
 	service.DashboardClient = openapi.DashboardClient{}
 	service.DashboardClient.Id = "lookupDashboardClientId"
@@ -154,7 +169,7 @@ func buildCatalog(r *http.Request) *openapi.Catalog {
 	plan.Schemas = openapi.SchemasObject{}
 	plan.MaximumPollingDuration = 10
 	plan.MaintenanceInfo = openapi.MaintenanceInfo{}
-	plan.MaintenanceInfo.Version = "0.0.0"
+	plan.MaintenanceInfo.Version = catalogMaintenanceVersion
 
 	plans = append(plans, plan)
 
@@ -162,8 +177,6 @@ func buildCatalog(r *http.Request) *openapi.Catalog {
 	services = append(services, service)
 	catalog.Services = services
 
-	log.Printf("Catalog: %v", catalog)
-
 	return &catalog
 }
 
@@ -181,16 +194,14 @@ func apiVersionHandler(next http.Handler) http.Handler {
 
 		if requestedAPIVersionValue == "" {
 			err := fmt.Errorf("HTTP Status: (%v) - mandatory request header %v not set", http.StatusPreconditionFailed, headerAPIVersion)
-			log.Printf("Error: %v", err)
-			handleHTTPError(w, http.StatusPreconditionFailed, err)
+			handleV2Error(w, newOSBError(http.StatusPreconditionFailed, "", err))
 			return
 		}
 
 		requestedAPIVersion := strings.Split(requestedAPIVersionValue, ".")[0]
 		if supportedAPIVersion != requestedAPIVersion {
 			err := fmt.Errorf("HTTP Status: (%v) - requested API version is %v but supported API version is %v", http.StatusPreconditionFailed, r.Header.Get(headerAPIVersion), supportedAPIVersionValue)
-			log.Printf("Error: %v", err)
-			handleHTTPError(w, http.StatusPreconditionFailed, err)
+			handleV2Error(w, newOSBError(http.StatusPreconditionFailed, "", err))
 			return
 		}
 
@@ -198,70 +209,107 @@ func apiVersionHandler(next http.Handler) http.Handler {
 	})
 }
 
-func instancePatchHandler(w http.ResponseWriter, r *http.Request) {
+// checkServicePlan verifies that the request refers to the service and plan of the catalog
+func checkServicePlan(serviceID string, planID string) error {
+	if serviceID != catalogServiceID {
+		return badRequest(errors.New("unsupported service id: " + serviceID))
+	}
+	if planID != catalogPanID {
+		return badRequest(errors.New("unsupported plan id: " + planID))
+	}
+	return nil
+}
+
+// checkMaintenanceInfo verifies that the platform knows the maintenance info of the catalog
+func checkMaintenanceInfo(info openapi.MaintenanceInfo) error {
+	if info.Version != "" && info.Version != catalogMaintenanceVersion {
+		err := fmt.Errorf("maintenance_info.version %v does not match the catalog version %v", info.Version, catalogMaintenanceVersion)
+		return newOSBError(http.StatusUnprocessableEntity, errorMaintenanceInfoConflict, err)
+	}
+	return nil
+}
+
+func (b *Broker) instancePatchHandler(w http.ResponseWriter, r *http.Request) error {
 	vars := mux.Vars(r)
 	serviceInstanceID := vars["iid"]
 	log.Println("serviceInstanceID = ", serviceInstanceID)
 
 	var requestContent openapi.ServiceInstanceUpdateRequest
 
-	err := json.NewDecoder(r.Body).Decode(&requestContent)
-	if err != nil {
-		log.Printf("Error: %v", err)
-		handleHTTPError(w, http.StatusBadRequest, err)
-		return
+	if err := b.decodeRequest(r, &requestContent); err != nil {
+		return err
+	}
+
+	if err := checkServicePlan(requestContent.ServiceId, requestContent.PlanId); err != nil {
+		return err
 	}
 
-	if requestContent.ServiceId != catalogServiceID {
-		err := errors.New("unsupported service id: " + requestContent.ServiceId)
-		log.Printf("Error: %v", err)
-		handleHTTPError(w, http.StatusBadRequest, err)
-		return
+	if err := checkMaintenanceInfo(requestContent.MaintenanceInfo); err != nil {
+		return err
 	}
 
-	if requestContent.PlanId != catalogPanID {
-		err := errors.New("unsupported plan id: " + requestContent.PlanId)
-		log.Printf("Error: %v", err)
-		handleHTTPError(w, http.StatusBadRequest, err)
-		return
+	instance, err := b.store.Instance(serviceInstanceID)
+	if err != nil && err != store.ErrNotFound {
+		return err
+	}
+	if instance != nil && !instance.Incomplete {
+		instance.PlanID = requestContent.PlanId
+		if requestContent.Parameters != nil {
+			instance.Parameters = requestContent.Parameters
+		}
+		if requestContent.Context != nil {
+			instance.Context = requestContent.Context
+		}
+		instance.Updated = time.Now().UTC()
+		if err := b.store.SaveInstance(instance); err != nil {
+			return err
+		}
 	}
 
 	responseContent := openapi.ServiceInstanceProvisionResponse{}
 
 	js, err := json.Marshal(responseContent)
 	if err != nil {
-		handleHTTPError(w, http.StatusInternalServerError, err)
-		return
+		return err
 	}
 	w.WriteHeader(http.StatusOK)
 	w.Header().Set(headerContentType, contentTypeJSON)
 	w.Header().Set(headerETag, eTag(responseContent))
 	http.ServeContent(w, r, "", startTime, bytes.NewReader(js))
 
-	return
+	return nil
 }
 
-func instanceGetHandler(w http.ResponseWriter, r *http.Request) {
+func (b *Broker) instanceGetHandler(w http.ResponseWriter, r *http.Request) error {
 	vars := mux.Vars(r)
 	serviceInstanceID := vars["iid"]
 	log.Println("serviceInstanceID = ", serviceInstanceID)
 
+	instance, err := b.store.Instance(serviceInstanceID)
+	if err != nil && err != store.ErrNotFound {
+		return err
+	}
+
 	responseContent := openapi.ServiceInstanceResource{}
+	if instance != nil && !instance.Incomplete {
+		responseContent.ServiceId = instance.ServiceID
+		responseContent.PlanId = instance.PlanID
+		responseContent.Parameters = instance.Parameters
+	}
 
 	js, err := json.Marshal(responseContent)
 	if err != nil {
-		handleHTTPError(w, http.StatusInternalServerError, err)
-		return
+		return err
 	}
 
 	w.Header().Set(headerETag, eTag(responseContent))
 	w.Header().Set(headerContentType, contentTypeJSON)
 	http.ServeContent(w, r, "", startTime, bytes.NewReader(js))
 
-	return
+	return nil
 }
 
-func instancePutHandler(w http.ResponseWriter, r *http.Request) {
+func (b *Broker) instancePutHandler(w http.ResponseWriter, r *http.Request) error {
 
 	vars := mux.Vars(r)
 	serviceInstanceID := vars["iid"]
@@ -269,98 +317,160 @@ func instancePutHandler(w http.ResponseWriter, r *http.Request) {
 
 	var requestContent openapi.ServiceInstanceProvisionRequest
 
-	err := json.NewDecoder(r.Body).Decode(&requestContent)
-	if err != nil {
-		log.Printf("Error: %v", err)
-		handleHTTPError(w, http.StatusBadRequest, err)
-		return
-	}
-
-	if requestContent.ServiceId != catalogServiceID {
-		err := errors.New("unsupported service id: " + requestContent.ServiceId)
-		log.Printf("Error: %v", err)
-		handleHTTPError(w, http.StatusBadRequest, err)
-		return
+	if err := b.decodeRequest(r, &requestContent); err != nil {
+		return err
 	}
 
-	if requestContent.PlanId != catalogPanID {
-		err := errors.New("unsupported plan id: " + requestContent.PlanId)
-		log.Printf("Error: %v", err)
-		handleHTTPError(w, http.StatusBadRequest, err)
-		return
+	if err := checkServicePlan(requestContent.ServiceId, requestContent.PlanId); err != nil {
+		return err
 	}
 
 	if requestContent.OrganizationGuid == "" && requestContent.Context["organization_guid"] == "" {
-		err := errors.New("organization_guid missing")
-		log.Printf("Error: %v", err)
-		handleHTTPError(w, http.StatusBadRequest, err)
-		return
+		return badRequest(errors.New("organization_guid missing"))
 	}
 
 	if requestContent.SpaceGuid == "" && requestContent.Context["plan_guid"] == "" {
-		err := errors.New("space_guid missing")
-		log.Printf("Error: %v", err)
-		handleHTTPError(w, http.StatusBadRequest, err)
-		return
+		return badRequest(errors.New("space_guid missing"))
+	}
+
+	if err := checkMaintenanceInfo(requestContent.MaintenanceInfo); err != nil {
+		return err
+	}
+
+	status := http.StatusCreated
+	existing, err := b.store.Instance(serviceInstanceID)
+	switch {
+	case err == store.ErrNotFound || err == nil && existing.Incomplete:
+		// an incomplete instance is left by a failed provision, which the
+		// platform repeats or mitigates
+		now := time.Now().UTC()
+		instance := &store.Instance{
+			InstanceID:       serviceInstanceID,
+			ServiceID:        requestContent.ServiceId,
+			PlanID:           requestContent.PlanId,
+			OrganizationGUID: requestContent.OrganizationGuid,
+			SpaceGUID:        requestContent.SpaceGuid,
+			Context:          requestContent.Context,
+			Parameters:       requestContent.Parameters,
+			Created:          now,
+			Updated:          now,
+		}
+		save := func(incomplete bool) error {
+			instance.Incomplete = incomplete
+			return b.store.SaveInstance(instance)
+		}
+		if err := trackOperation(r, save, func() error { return nil }); err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	case existing.ServiceID != requestContent.ServiceId || existing.PlanID != requestContent.PlanId ||
+		!reflect.DeepEqual(existing.Parameters, requestContent.Parameters):
+		return newOSBError(http.StatusConflict, "", fmt.Errorf("service instance %v exists with different attributes", serviceInstanceID))
+	default:
+		status = http.StatusOK
 	}
 
 	responseContent := openapi.ServiceInstanceProvisionResponse{}
 
 	js, err := json.Marshal(responseContent)
 	if err != nil {
-		handleHTTPError(w, http.StatusInternalServerError, err)
-		return
+		return err
 	}
-	w.WriteHeader(http.StatusCreated)
+	w.WriteHeader(status)
 	w.Header().Set(headerContentType, contentTypeJSON)
 	w.Header().Set(headerETag, eTag(responseContent))
 	http.ServeContent(w, r, "", startTime, bytes.NewReader(js))
 
-	return
+	return nil
 }
 
-func instanceDeleteHandler(w http.ResponseWriter, r *http.Request) {
+func (b *Broker) instanceDeleteHandler(w http.ResponseWriter, r *http.Request) error {
 	vars := mux.Vars(r)
 	serviceInstanceID := vars["iid"]
 	log.Println("serviceInstanceID = ", serviceInstanceID)
 
+	if err := b.store.DeleteInstance(serviceInstanceID); err != nil && err != store.ErrNotFound {
+		return err
+	}
+
 	w.WriteHeader(http.StatusOK)
+	return nil
 }
 
-func bindingDeleteHandler(w http.ResponseWriter, r *http.Request) {
+func (b *Broker) bindingDeleteHandler(w http.ResponseWriter, r *http.Request) error {
 	vars := mux.Vars(r)
 	serviceInstanceID := vars["iid"]
 	log.Println("serviceInstanceID = ", serviceInstanceID)
+	serviceBindingID := vars["bid"]
+	log.Println("serviceBindingID = ", serviceBindingID)
+
+	if err := b.store.DeleteBinding(serviceInstanceID, serviceBindingID); err != nil && err != store.ErrNotFound {
+		return err
+	}
 
 	w.WriteHeader(http.StatusOK)
+	return nil
 }
 
-func bindingGetHandler(w http.ResponseWriter, r *http.Request) {
+func (b *Broker) bindingGetHandler(w http.ResponseWriter, r *http.Request) error {
 	vars := mux.Vars(r)
 	serviceInstanceID := vars["iid"]
 	log.Println("serviceInstanceID = ", serviceInstanceID)
 	serviceBindingID := vars["bid"]
 	log.Println("serviceBindingID = ", serviceBindingID)
 
-	responseContent := openapi.ServiceBindingResource{}
+	selector, _ := landscape.ParseSelector("")
+
+	binding, err := b.store.Binding(serviceInstanceID, serviceBindingID)
+	if err != nil && err != store.ErrNotFound {
+		return err
+	}
+
+	if binding != nil && binding.Incomplete {
+		binding = nil
+	}
+	if binding != nil && binding.ExpiresAt != nil && !time.Now().Before(*binding.ExpiresAt) {
+		err := fmt.Errorf("service binding %v expired at %v, rotate it", serviceBindingID, binding.ExpiresAt.UTC().Format(time.RFC3339))
+		return newOSBError(http.StatusGone, errorBindingExpired, err)
+	}
 
+	responseContent := openapi.ServiceBindingResource{}
 	responseContent.Parameters = make(map[string]interface{})
-	responseContent.Parameters["landscapes"] = landscape.Get()
+
+	if binding != nil {
+		responseContent.Metadata = bindingMetadata(binding)
+		for key, value := range binding.Parameters {
+			responseContent.Parameters[key] = value
+		}
+		selector, err = landscape.ParseSelector(binding.Selector)
+		if err != nil {
+			return err
+		}
+	}
+
+	responseContent.Credentials = b.bindingCredentials(selector)
+	responseContent.Parameters["landscapes"] = responseContent.Credentials["landscapes"]
+	if err := b.signCredentials(responseContent.Credentials, binding); err != nil {
+		return err
+	}
+	if binding != nil && binding.Webhook != nil {
+		responseContent.Credentials["webhook"] = binding.Webhook
+	}
 
 	js, err := json.Marshal(responseContent)
 	if err != nil {
-		handleHTTPError(w, http.StatusInternalServerError, err)
-		return
+		return err
 	}
 
 	w.Header().Set(headerETag, eTag(responseContent))
 	w.Header().Set(headerContentType, contentTypeJSON)
 	http.ServeContent(w, r, "", startTime, bytes.NewReader(js))
 
-	return
+	return nil
 }
 
-func bindingPutHandler(w http.ResponseWriter, r *http.Request) {
+func (b *Broker) bindingPutHandler(w http.ResponseWriter, r *http.Request) error {
 	vars := mux.Vars(r)
 	serviceInstanceID := vars["iid"]
 	log.Println("serviceInstanceID = ", serviceInstanceID)
@@ -369,28 +479,194 @@ func bindingPutHandler(w http.ResponseWriter, r *http.Request) {
 
 	var requestContent openapi.ServiceBindingRequest
 
-	err := json.NewDecoder(r.Body).Decode(&requestContent)
+	if err := b.decodeRequest(r, &requestContent); err != nil {
+		return err
+	}
+
+	existing, err := b.store.Binding(serviceInstanceID, serviceBindingID)
+	if err != nil && err != store.ErrNotFound {
+		return err
+	}
+	if err == nil && !existing.Incomplete {
+		// a repeated bind returns the existing binding, an incomplete one is
+		// left by a failed bind, which the platform repeats or mitigates
+		if !sameBinding(existing, &requestContent) {
+			return newOSBError(http.StatusConflict, "", fmt.Errorf("service binding %v exists with different attributes", serviceBindingID))
+		}
+		responseContent, err := b.bindingResponse(existing)
+		if err != nil {
+			return err
+		}
+		return writeBindingResponse(w, r, http.StatusOK, responseContent)
+	}
+
+	parameters := requestContent.Parameters
+	var lineage []string
+	if requestContent.PredecessorBindingId != "" {
+		predecessor, err := b.predecessorBinding(serviceInstanceID, serviceBindingID, &requestContent)
+		if err != nil {
+			return err
+		}
+		parameters = predecessor.Parameters
+		lineage = append(append([]string{}, predecessor.Lineage...), predecessor.BindingID)
+	}
+
+	selector, err := bindingSelector(parameters)
+	if err != nil {
+		return badRequest(err)
+	}
+
+	hook, err := b.bindingWebhook(r.Context(), parameters)
 	if err != nil {
-		log.Printf("Error: %v", err)
-		handleHTTPError(w, http.StatusBadRequest, err)
-		return
+		return badRequest(err)
+	}
+
+	binding := &store.Binding{
+		InstanceID: serviceInstanceID,
+		BindingID:  serviceBindingID,
+		ServiceID:  requestContent.ServiceId,
+		PlanID:     requestContent.PlanId,
+		Parameters: parameters,
+		Selector:   selector.String(),
+		Webhook:    hook,
+		Created:    time.Now().UTC(),
+		Lineage:    lineage,
+	}
+	b.setBindingExpiry(binding)
+
+	var responseContent openapi.ServiceBindingResponse
+	save := func(incomplete bool) error {
+		binding.Incomplete = incomplete
+		return b.store.SaveBinding(binding)
+	}
+	work := func() error {
+		var err error
+		responseContent, err = b.bindingResponse(binding)
+		return err
 	}
+	if err := trackOperation(r, save, work); err != nil {
+		return err
+	}
+	return writeBindingResponse(w, r, http.StatusCreated, responseContent)
+}
 
+// sameBinding reports whether request repeats the bind of binding
+func sameBinding(binding *store.Binding, request *openapi.ServiceBindingRequest) bool {
+	if binding.ServiceID != request.ServiceId || binding.PlanID != request.PlanId {
+		return false
+	}
+	if request.PredecessorBindingId != "" {
+		return len(binding.Lineage) > 0 && binding.Lineage[len(binding.Lineage)-1] == request.PredecessorBindingId
+	}
+	return len(binding.Lineage) == 0 && reflect.DeepEqual(binding.Parameters, request.Parameters)
+}
+
+// bindingResponse returns the credentials and metadata of binding
+func (b *Broker) bindingResponse(binding *store.Binding) (openapi.ServiceBindingResponse, error) {
 	responseContent := openapi.ServiceBindingResponse{}
 
-	// responseContent.Parameters = make(map[string]interface{})
-	// responseContent.Parameters["landscapes"] = landscape.Get()
+	selector, err := landscape.ParseSelector(binding.Selector)
+	if err != nil {
+		return responseContent, err
+	}
+
+	responseContent.Metadata = bindingMetadata(binding)
+	responseContent.Credentials = b.bindingCredentials(selector)
+	if err := b.signCredentials(responseContent.Credentials, binding); err != nil {
+		return responseContent, err
+	}
+	if binding.Webhook != nil {
+		responseContent.Credentials["webhook"] = binding.Webhook
+	}
+	return responseContent, nil
+}
 
+func writeBindingResponse(w http.ResponseWriter, r *http.Request, status int, responseContent openapi.ServiceBindingResponse) error {
 	js, err := json.Marshal(responseContent)
 	if err != nil {
-		handleHTTPError(w, http.StatusInternalServerError, err)
-		return
+		return err
 	}
 
-	w.WriteHeader(http.StatusCreated)
+	w.WriteHeader(status)
 	w.Header().Set(headerETag, eTag(responseContent))
 	w.Header().Set(headerContentType, contentTypeJSON)
 	http.ServeContent(w, r, "", startTime, bytes.NewReader(js))
 
-	return
+	return nil
+}
+
+func (b *Broker) bindingCredentials(selector landscape.Selector) map[string]interface{} {
+	set := b.registry.Current()
+
+	credentials := make(map[string]interface{})
+	credentials["landscapes"] = set.Landscapes.Filter(selector)
+	if set.Commit != "" {
+		credentials["metadata"] = map[string]string{"commit": set.Commit}
+	}
+	return credentials
+}
+
+func bindingSelector(parameters map[string]interface{}) (landscape.Selector, error) {
+	value, ok := parameters[parameterSelector]
+	if !ok {
+		return landscape.ParseSelector("")
+	}
+
+	expr, ok := value.(string)
+	if !ok {
+		return nil, fmt.Errorf("parameter %v must be a string", parameterSelector)
+	}
+
+	return landscape.ParseSelector(expr)
+}
+
+func (b *Broker) bindingWebhook(ctx context.Context, parameters map[string]interface{}) (*store.Webhook, error) {
+	value, ok := parameters[parameterWebhook]
+	if !ok {
+		return nil, nil
+	}
+
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("parameter %v must be an object", parameterWebhook)
+	}
+
+	rawURL, _ := object["url"].(string)
+	target, err := url.Parse(rawURL)
+	if err != nil || !target.IsAbs() || (target.Scheme != "http" && target.Scheme != "https") {
+		return nil, fmt.Errorf("parameter %v.url must be an absolute http(s) URL", parameterWebhook)
+	}
+	if err := b.checkWebhookHost(ctx, target.Hostname()); err != nil {
+		return nil, fmt.Errorf("parameter %v.url: %v", parameterWebhook, err)
+	}
+
+	hook := &store.Webhook{URL: target.String()}
+	if secret, ok := object["secret"]; ok {
+		if hook.Secret, ok = secret.(string); !ok || hook.Secret == "" {
+			return nil, fmt.Errorf("parameter %v.secret must be a non empty string", parameterWebhook)
+		}
+	} else {
+		hook.Secret = webhook.NewSecret()
+	}
+	return hook, nil
+}
+
+// checkWebhookHost rejects a webhook host with an address in the denied
+// networks. A host which cannot be resolved is rejected too, as it may
+// resolve to such an address later.
+func (b *Broker) checkWebhookHost(ctx context.Context, host string) error {
+	if len(b.webhookDeniedNetworks) == 0 {
+		return nil
+	}
+
+	addresses, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return fmt.Errorf("host %v cannot be resolved", host)
+	}
+	for _, address := range addresses {
+		if inNetworks(address.IP.String(), b.webhookDeniedNetworks) {
+			return fmt.Errorf("host %v has the denied address %v", host, address.IP)
+		}
+	}
+	return nil
 }
@@ -5,13 +5,17 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"strings"
 	"testing"
 
+	"github.com/sklevenz/lookup-broker/config"
+	"github.com/sklevenz/lookup-broker/landscape"
 	"github.com/sklevenz/lookup-broker/openapi"
+	"github.com/sklevenz/lookup-broker/store"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -44,6 +48,13 @@ const (
 			}`
 )
 
+// withLandscapes configures the landscape document of a broker without registry
+func withLandscapes(document string) Option {
+	c := config.New()
+	c.Landscapes = document
+	return WithConfig(c)
+}
+
 func TestNoApiVersion(t *testing.T) {
 	request, _ := http.NewRequest(http.MethodGet, "/v2/catalog", nil)
 
@@ -165,7 +176,7 @@ func TestCatalogHandler(t *testing.T) {
 	assert.Contains(t, response.Body.String(), "Lookup service broker")
 	assert.Equal(t, http.StatusOK, response.Result().StatusCode)
 	assert.Equal(t, contentTypeJSON, response.Header().Get(headerContentType))
-	assert.Equal(t, fmt.Sprintf("W/\"%v\"", "4b676504ada9e24a9f4be6c86d89a83e"), response.Header().Get(headerETag))
+	assert.Equal(t, fmt.Sprintf("W/\"%v\"", "cab712aa5cc6f5d57bcc87e773b2459e"), response.Header().Get(headerETag))
 }
 
 func TestInstancePutHandler(t *testing.T) {
@@ -306,14 +317,12 @@ func TestBindingDeleteHandler(t *testing.T) {
 }
 
 func TestBindingGetHandler(t *testing.T) {
-	os.Setenv("LANDSCAPES", landscapes)
-
 	request, err := http.NewRequest(http.MethodGet, "/v2/service_instances/123/service_bindings/456", nil)
 	assert.Nil(t, err)
 	request.Header.Set(headerAPIVersion, supportedAPIVersionValue)
 
 	response := httptest.NewRecorder()
-	New().ServeHTTP(response, request)
+	New(withLandscapes(landscapes)).ServeHTTP(response, request)
 
 	assert.Equal(t, http.StatusOK, response.Result().StatusCode)
 
@@ -343,7 +352,57 @@ func TestBindingPutHandler(t *testing.T) {
 		}
 	  }`
 
-	os.Setenv("LANDSCAPES", landscapes)
+	request, err := http.NewRequest(http.MethodPut, "/v2/service_instances/123/service_bindings/456", strings.NewReader(payload))
+	assert.Nil(t, err)
+	request.Header.Set(headerAPIVersion, supportedAPIVersionValue)
+	request.Header.Set(headerContentType, contentTypeJSON)
+
+	response := httptest.NewRecorder()
+	New(withLandscapes(landscapes)).ServeHTTP(response, request)
+
+	assert.Equal(t, http.StatusCreated, response.Result().StatusCode)
+
+	var responseContent openapi.ServiceBindingResponse
+	err = json.NewDecoder(response.Body).Decode(&responseContent)
+
+	assert.Nil(t, err)
+	assert.NotNil(t, responseContent)
+}
+
+func TestBindingPutHandlerSelector(t *testing.T) {
+	const payload = `{
+		"service_id": "1",
+		"plan_id": "1.1",
+		"parameters": {
+		  "selector": "scaleout && !master"
+		}
+	  }`
+
+	request, err := http.NewRequest(http.MethodPut, "/v2/service_instances/123/service_bindings/456", strings.NewReader(payload))
+	assert.Nil(t, err)
+	request.Header.Set(headerAPIVersion, supportedAPIVersionValue)
+	request.Header.Set(headerContentType, contentTypeJSON)
+
+	response := httptest.NewRecorder()
+	New(withLandscapes(landscapes)).ServeHTTP(response, request)
+
+	assert.Equal(t, http.StatusCreated, response.Result().StatusCode)
+
+	var responseContent openapi.ServiceBindingResponse
+	err = json.NewDecoder(response.Body).Decode(&responseContent)
+
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(responseContent.Credentials["landscapes"].(map[string]interface{})))
+}
+
+func TestBindingPutHandlerWrongSelector(t *testing.T) {
+	const payload = `{
+		"service_id": "1",
+		"plan_id": "1.1",
+		"parameters": {
+		  "selector": "region in eu10"
+		}
+	  }`
 
 	request, err := http.NewRequest(http.MethodPut, "/v2/service_instances/123/service_bindings/456", strings.NewReader(payload))
 	assert.Nil(t, err)
@@ -353,11 +412,157 @@ func TestBindingPutHandler(t *testing.T) {
 	response := httptest.NewRecorder()
 	New().ServeHTTP(response, request)
 
+	assert.Equal(t, http.StatusBadRequest, response.Result().StatusCode)
+	assert.Contains(t, response.Body.String(), "selector syntax error")
+}
+
+func TestBindingPutHandlerCommit(t *testing.T) {
+	const payload = `{
+		"service_id": "1",
+		"plan_id": "1.1"
+	  }`
+
+	registry := landscape.NewRegistry(commitSource{})
+	assert.Nil(t, registry.Reload())
+
+	request, err := http.NewRequest(http.MethodPut, "/v2/service_instances/123/service_bindings/456", strings.NewReader(payload))
+	assert.Nil(t, err)
+	request.Header.Set(headerAPIVersion, supportedAPIVersionValue)
+	request.Header.Set(headerContentType, contentTypeJSON)
+
+	response := httptest.NewRecorder()
+	New(WithRegistry(registry)).ServeHTTP(response, request)
+
 	assert.Equal(t, http.StatusCreated, response.Result().StatusCode)
 
 	var responseContent openapi.ServiceBindingResponse
 	err = json.NewDecoder(response.Body).Decode(&responseContent)
 
 	assert.Nil(t, err)
-	assert.NotNil(t, responseContent)
+	assert.Equal(t, map[string]interface{}{"commit": "4b825dc6"}, responseContent.Credentials["metadata"])
+}
+
+func TestBindingWebhook(t *testing.T) {
+	const payload = `{
+		"service_id": "1",
+		"plan_id": "1.1",
+		"parameters": {
+		  "selector": "scaleout",
+		  "webhook": {"url": "https://app.example.com/landscapes"}
+		}
+	  }`
+
+	broker := New(withLandscapes(landscapes))
+
+	request, err := http.NewRequest(http.MethodPut, "/v2/service_instances/123/service_bindings/456", strings.NewReader(payload))
+	assert.Nil(t, err)
+	request.Header.Set(headerAPIVersion, supportedAPIVersionValue)
+	request.Header.Set(headerContentType, contentTypeJSON)
+
+	response := httptest.NewRecorder()
+	broker.ServeHTTP(response, request)
+
+	assert.Equal(t, http.StatusCreated, response.Result().StatusCode)
+
+	var responseContent openapi.ServiceBindingResponse
+	err = json.NewDecoder(response.Body).Decode(&responseContent)
+	assert.Nil(t, err)
+
+	hook := responseContent.Credentials["webhook"].(map[string]interface{})
+	assert.Equal(t, "https://app.example.com/landscapes", hook["url"])
+	assert.NotEmpty(t, hook["secret"])
+
+	binding, err := broker.store.Binding("123", "456")
+	assert.Nil(t, err)
+	assert.Equal(t, "scaleout", binding.Selector)
+	assert.Equal(t, hook["secret"], binding.Webhook.Secret)
+
+	request, _ = http.NewRequest(http.MethodGet, "/v2/service_instances/123/service_bindings/456", nil)
+	request.Header.Set(headerAPIVersion, supportedAPIVersionValue)
+
+	response = httptest.NewRecorder()
+	broker.ServeHTTP(response, request)
+
+	var resource openapi.ServiceBindingResource
+	err = json.NewDecoder(response.Body).Decode(&resource)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(resource.Credentials["landscapes"].(map[string]interface{})))
+	assert.Equal(t, "scaleout", resource.Parameters["selector"])
+
+	request, _ = http.NewRequest(http.MethodDelete, "/v2/service_instances/123/service_bindings/456", nil)
+	request.Header.Set(headerAPIVersion, supportedAPIVersionValue)
+
+	response = httptest.NewRecorder()
+	broker.ServeHTTP(response, request)
+
+	assert.Equal(t, http.StatusOK, response.Result().StatusCode)
+	_, err = broker.store.Binding("123", "456")
+	assert.Equal(t, store.ErrNotFound, err)
+}
+
+func TestBindingWrongWebhook(t *testing.T) {
+	for _, parameter := range []string{`"https://app.example.com"`, `{"url": "/relative"}`, `{"url": "ftp://app.example.com"}`, `{"url": "https://app.example.com", "secret": 1}`} {
+		payload := `{"service_id": "1", "plan_id": "1.1", "parameters": {"webhook": ` + parameter + `}}`
+
+		request, err := http.NewRequest(http.MethodPut, "/v2/service_instances/123/service_bindings/456", strings.NewReader(payload))
+		assert.Nil(t, err)
+		request.Header.Set(headerAPIVersion, supportedAPIVersionValue)
+		request.Header.Set(headerContentType, contentTypeJSON)
+
+		response := httptest.NewRecorder()
+		New().ServeHTTP(response, request)
+
+		assert.Equal(t, http.StatusBadRequest, response.Result().StatusCode, parameter)
+	}
+}
+
+func TestBindingDeniedWebhook(t *testing.T) {
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	_, linkLocal, _ := net.ParseCIDR("169.254.0.0/16")
+	broker := New(WithWebhookDeniedNetworks([]*net.IPNet{loopback, linkLocal}))
+
+	for _, url := range []string{"http://127.0.0.1:8080/hook", "http://localhost/hook", "http://169.254.169.254/latest/meta-data", "https://host.invalid/hook"} {
+		response := putBinding(broker, "1", `{"service_id": "1", "plan_id": "1.1", "parameters": {"webhook": {"url": "`+url+`"}}}`)
+		assert.Equal(t, http.StatusBadRequest, response.Code, url)
+	}
+
+	response := putBinding(broker, "1", `{"service_id": "1", "plan_id": "1.1", "parameters": {"webhook": {"url": "https://93.184.216.34/hook"}}}`)
+	assert.Equal(t, http.StatusCreated, response.Code)
+
+	var osbError openapi.Error
+	response = putBinding(broker, "2", `{"service_id": "1", "plan_id": "1.1", "parameters": {"webhook": {"url": "http://127.0.0.1/hook"}}}`)
+	assert.Nil(t, json.Unmarshal(response.Body.Bytes(), &osbError))
+	assert.Equal(t, "parameter webhook.url: host 127.0.0.1 has the denied address 127.0.0.1", osbError.Description)
+}
+
+func TestInstancePersistence(t *testing.T) {
+	s := store.NewMemoryStore()
+	broker := New(WithStore(s))
+
+	code, _ := putInstance(broker, `{"service_id": "1", "plan_id": "1.1", "organization_guid": "org", "space_guid": "space", "parameters": {"a": "b"}}`)
+	assert.Equal(t, http.StatusCreated, code)
+
+	code, _ = putInstance(broker, `{"service_id": "1", "plan_id": "1.1", "organization_guid": "org", "space_guid": "space", "parameters": {"a": "b"}}`)
+	assert.Equal(t, http.StatusOK, code)
+
+	code, _ = putInstance(broker, `{"service_id": "1", "plan_id": "1.1", "organization_guid": "org", "space_guid": "space", "parameters": {"a": "c"}}`)
+	assert.Equal(t, http.StatusConflict, code)
+
+	// a broker instance sharing the store knows the instance
+	request, _ := http.NewRequest(http.MethodGet, "/v2/service_instances/123", nil)
+	request.Header.Set(headerAPIVersion, supportedAPIVersionValue)
+	response := httptest.NewRecorder()
+	New(WithStore(s)).ServeHTTP(response, request)
+
+	var responseContent openapi.ServiceInstanceResource
+	assert.Nil(t, json.NewDecoder(response.Body).Decode(&responseContent))
+	assert.Equal(t, "1.1", responseContent.PlanId)
+	assert.Equal(t, map[string]interface{}{"a": "b"}, responseContent.Parameters)
+
+	request, _ = http.NewRequest(http.MethodDelete, "/v2/service_instances/123", nil)
+	request.Header.Set(headerAPIVersion, supportedAPIVersionValue)
+	broker.ServeHTTP(httptest.NewRecorder(), request)
+
+	_, err := s.Instance("123")
+	assert.Equal(t, store.ErrNotFound, err)
 }
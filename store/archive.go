@@ -0,0 +1,223 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/sklevenz/lookup-broker/landscape"
+)
+
+// ArchiveVersion is the version of the archive format written by Export
+const ArchiveVersion = 1
+
+// Archive is the state of a store which can be moved to another store.
+// Operation locks and the webhook delivery log are not part of it.
+type Archive struct {
+	Version            int                  `json:"version"`
+	Created            time.Time            `json:"created"`
+	Instances          []Instance           `json:"instances"`
+	Bindings           []Binding            `json:"bindings"`
+	LandscapeVersions  []LandscapeVersion   `json:"landscape_versions"`
+	LandscapeRevisions []landscape.Revision `json:"landscape_revisions"`
+}
+
+// Export reads the state of s into an archive
+func Export(s Store) (*Archive, error) {
+	archive := &Archive{Version: ArchiveVersion, Created: time.Now().UTC()}
+
+	var err error
+	if archive.Instances, err = s.Instances(); err != nil {
+		return nil, err
+	}
+	if archive.Bindings, err = s.Bindings(); err != nil {
+		return nil, err
+	}
+
+	versions, err := s.LandscapeVersions()
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range versions {
+		version, err := s.LandscapeVersion(v.Number)
+		if err != nil {
+			return nil, err
+		}
+		archive.LandscapeVersions = append(archive.LandscapeVersions, *version)
+	}
+
+	revisions, err := s.LandscapeRevisions()
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range revisions {
+		revision, err := s.LandscapeRevision(r.Number)
+		if err != nil {
+			return nil, err
+		}
+		archive.LandscapeRevisions = append(archive.LandscapeRevisions, *revision)
+	}
+	return archive, nil
+}
+
+// ImportCounts counts the entries of an archive
+type ImportCounts struct {
+	Instances          int `json:"instances"`
+	Bindings           int `json:"bindings"`
+	LandscapeVersions  int `json:"landscape_versions"`
+	LandscapeRevisions int `json:"landscape_revisions"`
+}
+
+// ImportConflict is an entry of an archive which differs from the store
+type ImportConflict struct {
+	Type   string `json:"type"`
+	ID     string `json:"id"`
+	Reason string `json:"reason"`
+}
+
+func (c ImportConflict) String() string {
+	return fmt.Sprintf("%v %v: %v", c.Type, c.ID, c.Reason)
+}
+
+// ImportResult reports what an import changed or, on a dry run, would change
+type ImportResult struct {
+	DryRun    bool             `json:"dry_run"`
+	Imported  ImportCounts     `json:"imported"`
+	Unchanged ImportCounts     `json:"unchanged"`
+	Skipped   ImportCounts     `json:"skipped"`
+	Conflicts []ImportConflict `json:"conflicts"`
+}
+
+// Import writes the state of archive to s. Entries equal to the store are
+// left unchanged. If an entry exists with other content, nothing is written
+// and the conflicts are reported. Landscape versions are only imported into
+// a store without landscape versions, as their numbers must be kept. The
+// revision history is only imported into a store without history, else it
+// is skipped as the store continues its own. On a dry run the result is
+// reported without writing.
+func Import(s Store, archive *Archive, dryRun bool) (*ImportResult, error) {
+	if archive.Version != ArchiveVersion {
+		return nil, fmt.Errorf("unsupported archive version %v, expected %v", archive.Version, ArchiveVersion)
+	}
+
+	result := &ImportResult{DryRun: dryRun, Conflicts: []ImportConflict{}}
+	conflict := func(kind string, id string, reason string) {
+		result.Conflicts = append(result.Conflicts, ImportConflict{Type: kind, ID: id, Reason: reason})
+	}
+
+	var instances []*Instance
+	known := map[string]bool{}
+	for i := range archive.Instances {
+		instance := &archive.Instances[i]
+		known[instance.InstanceID] = true
+
+		existing, err := s.Instance(instance.InstanceID)
+		switch {
+		case err == ErrNotFound:
+			instances = append(instances, instance)
+		case err != nil:
+			return nil, err
+		case equalJSON(existing, instance):
+			result.Unchanged.Instances++
+		default:
+			conflict("instance", instance.InstanceID, "exists with different content")
+		}
+	}
+
+	var bindings []*Binding
+	for i := range archive.Bindings {
+		binding := &archive.Bindings[i]
+		id := binding.InstanceID + "/" + binding.BindingID
+
+		existing, err := s.Binding(binding.InstanceID, binding.BindingID)
+		switch {
+		case err == ErrNotFound:
+			if !known[binding.InstanceID] {
+				if _, err := s.Instance(binding.InstanceID); err == ErrNotFound {
+					conflict("binding", id, "instance "+binding.InstanceID+" does not exist")
+					continue
+				}
+			}
+			bindings = append(bindings, binding)
+		case err != nil:
+			return nil, err
+		case equalJSON(existing, binding):
+			result.Unchanged.Bindings++
+		default:
+			conflict("binding", id, "exists with different content")
+		}
+	}
+
+	if len(archive.LandscapeVersions) > 0 {
+		versions, err := s.LandscapeVersions()
+		if err != nil {
+			return nil, err
+		}
+		if len(versions) > 0 {
+			conflict("landscape_versions", fmt.Sprint(len(versions)), "the store has landscape versions already")
+		}
+	}
+
+	var revisions []landscape.Revision
+	if len(archive.LandscapeRevisions) > 0 {
+		history, err := s.LandscapeRevisions()
+		if err != nil {
+			return nil, err
+		}
+		if len(history) == 0 {
+			revisions = archive.LandscapeRevisions
+		} else {
+			result.Skipped.LandscapeRevisions = len(archive.LandscapeRevisions)
+		}
+	}
+
+	result.Imported = ImportCounts{
+		Instances:          len(instances),
+		Bindings:           len(bindings),
+		LandscapeVersions:  len(archive.LandscapeVersions),
+		LandscapeRevisions: len(revisions),
+	}
+	if len(result.Conflicts) > 0 {
+		result.Imported = ImportCounts{}
+	}
+	if dryRun || len(result.Conflicts) > 0 {
+		return result, nil
+	}
+
+	for _, instance := range instances {
+		if err := s.SaveInstance(instance); err != nil {
+			return nil, err
+		}
+	}
+	for _, binding := range bindings {
+		if err := s.SaveBinding(binding); err != nil {
+			return nil, err
+		}
+	}
+	for i := range archive.LandscapeVersions {
+		if err := s.PutLandscapeVersion(&archive.LandscapeVersions[i]); err != nil {
+			return nil, err
+		}
+	}
+	for i := range revisions {
+		if err := s.PutLandscapeRevision(&revisions[i]); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// equalJSON compares the JSON encodings of a and b, which ignores time zones
+// and representations of the same values
+func equalJSON(a interface{}, b interface{}) bool {
+	ja, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	jb, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(ja, jb)
+}
@@ -0,0 +1,152 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sklevenz/lookup-broker/landscape"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportImport(t *testing.T) {
+	source := NewMemoryStore()
+	assert.Nil(t, source.SaveInstance(&Instance{InstanceID: "1", ServiceID: "1", PlanID: "1.1", Context: map[string]interface{}{"platform": "cloudfoundry"}}))
+	assert.Nil(t, source.SaveBinding(&Binding{InstanceID: "1", BindingID: "2", Selector: "aws", Parameters: map[string]interface{}{"selector": "aws"}}))
+	_, err := source.SaveLandscapes(document("a"), "admin", "put landscape a")
+	assert.Nil(t, err)
+	assert.Nil(t, source.PutLandscapeRevision(&landscape.Revision{Number: 7, Changes: []landscape.Change{{Type: landscape.Added, Name: "a"}}}))
+	assert.Nil(t, source.AddDelivery(&Delivery{ID: "d"}))
+
+	archive, err := Export(source)
+	assert.Nil(t, err)
+	assert.Equal(t, ArchiveVersion, archive.Version)
+	assert.Equal(t, 1, len(archive.LandscapeVersions))
+	assert.NotNil(t, archive.LandscapeVersions[0].Document)
+	assert.Equal(t, "a", archive.LandscapeRevisions[0].Changes[0].Name)
+
+	target, _, done := newBoltStore(t)
+	defer done()
+	result, err := Import(target, archive, true)
+	assert.Nil(t, err)
+	assert.True(t, result.DryRun)
+	assert.Equal(t, ImportCounts{Instances: 1, Bindings: 1, LandscapeVersions: 1, LandscapeRevisions: 1}, result.Imported)
+	_, err = target.Instance("1")
+	assert.Equal(t, ErrNotFound, err)
+
+	result, err = Import(target, archive, false)
+	assert.Nil(t, err)
+	assert.False(t, result.DryRun)
+	assert.Equal(t, 0, len(result.Conflicts))
+	assert.Equal(t, ImportCounts{Instances: 1, Bindings: 1, LandscapeVersions: 1, LandscapeRevisions: 1}, result.Imported)
+
+	instance, err := target.Instance("1")
+	assert.Nil(t, err)
+	assert.Equal(t, "cloudfoundry", instance.Context["platform"])
+
+	binding, err := target.Binding("1", "2")
+	assert.Nil(t, err)
+	assert.Equal(t, "aws", binding.Selector)
+
+	version, err := target.LandscapeVersion(0)
+	assert.Nil(t, err)
+	assert.Equal(t, "put landscape a", version.Change)
+
+	revision, err := target.LandscapeRevision(0)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(7), revision.Number)
+
+	deliveries, err := target.Deliveries()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(deliveries))
+
+	archive.Version = 2
+	_, err = Import(target, archive, false)
+	assert.EqualError(t, err, "unsupported archive version 2, expected 1")
+}
+
+func TestImportKeepsLandscapeVersions(t *testing.T) {
+	source := NewMemoryStore()
+	created := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	assert.Nil(t, source.PutLandscapeVersion(&LandscapeVersion{Number: 3, Created: created, Author: "admin", Document: document("a")}))
+	assert.Nil(t, source.PutLandscapeVersion(&LandscapeVersion{Number: 5, Created: created.Add(time.Hour), Author: "admin", Document: document("a", "b")}))
+	archive, err := Export(source)
+	assert.Nil(t, err)
+
+	bolt, _, boltDone := newBoltStore(t)
+	defer boltDone()
+	sqlite, sqliteDone := newSQLiteStore(t)
+	defer sqliteDone()
+
+	for _, target := range []Store{NewMemoryStore(), bolt, sqlite} {
+		_, err := Import(target, archive, false)
+		assert.Nil(t, err)
+
+		versions, err := target.LandscapeVersions()
+		assert.Nil(t, err)
+		assert.Equal(t, 2, len(versions))
+		assert.Equal(t, 3, versions[0].Number)
+		assert.True(t, created.Equal(versions[0].Created))
+		assert.Equal(t, 5, versions[1].Number)
+		assert.True(t, created.Add(time.Hour).Equal(versions[1].Created))
+
+		version, err := target.LandscapeVersion(3)
+		assert.Nil(t, err)
+		assert.Contains(t, version.Document.Landscapes, "a")
+
+		next, err := target.SaveLandscapes(document("c"), "admin", "put landscape c")
+		assert.Nil(t, err)
+		assert.Equal(t, 6, next.Number)
+	}
+}
+
+func TestImportConflicts(t *testing.T) {
+	source := NewMemoryStore()
+	assert.Nil(t, source.SaveInstance(&Instance{InstanceID: "1", ServiceID: "1", PlanID: "1.1"}))
+	assert.Nil(t, source.SaveInstance(&Instance{InstanceID: "2", ServiceID: "1", PlanID: "1.1"}))
+	assert.Nil(t, source.SaveBinding(&Binding{InstanceID: "1", BindingID: "b", Selector: "aws"}))
+	assert.Nil(t, source.SaveBinding(&Binding{InstanceID: "3", BindingID: "c", Selector: "aws"}))
+	_, err := source.SaveLandscapes(document("a"), "admin", "put landscape a")
+	assert.Nil(t, err)
+
+	archive, err := Export(source)
+	assert.Nil(t, err)
+
+	target := NewMemoryStore()
+	assert.Nil(t, target.SaveInstance(&Instance{InstanceID: "1", ServiceID: "1", PlanID: "1.1"}))
+	assert.Nil(t, target.SaveInstance(&Instance{InstanceID: "2", ServiceID: "1", PlanID: "1.2"}))
+	_, err = target.SaveLandscapes(document("b"), "admin", "put landscape b")
+	assert.Nil(t, err)
+
+	result, err := Import(target, archive, false)
+	assert.Nil(t, err)
+	assert.Equal(t, ImportCounts{}, result.Imported)
+	assert.Equal(t, ImportCounts{Instances: 1}, result.Unchanged)
+	assert.Equal(t, []ImportConflict{
+		{Type: "instance", ID: "2", Reason: "exists with different content"},
+		{Type: "binding", ID: "3/c", Reason: "instance 3 does not exist"},
+		{Type: "landscape_versions", ID: "1", Reason: "the store has landscape versions already"},
+	}, result.Conflicts)
+	assert.Equal(t, "instance 2: exists with different content", result.Conflicts[0].String())
+
+	_, err = target.Binding("1", "b")
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestImportSkipsRevisions(t *testing.T) {
+	source := NewMemoryStore()
+	assert.Nil(t, source.AddLandscapeRevision(&landscape.Revision{}))
+	archive, err := Export(source)
+	assert.Nil(t, err)
+
+	target := NewMemoryStore()
+	assert.Nil(t, target.AddLandscapeRevision(&landscape.Revision{Commit: "target"}))
+
+	result, err := Import(target, archive, false)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(result.Conflicts))
+	assert.Equal(t, ImportCounts{LandscapeRevisions: 1}, result.Skipped)
+
+	revision, err := target.LandscapeRevision(1)
+	assert.Nil(t, err)
+	assert.Equal(t, "target", revision.Commit)
+}
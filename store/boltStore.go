@@ -0,0 +1,467 @@
+package store
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/sklevenz/lookup-broker/landscape"
+)
+
+var (
+	bucketLandscapeVersions  = []byte("landscape_versions")
+	bucketLandscapeRevisions = []byte("landscape_revisions")
+	bucketInstances          = []byte("instances")
+	bucketBindings           = []byte("bindings")
+	bucketInstanceLocks      = []byte("instance_locks")
+	bucketDeliveries         = []byte("deliveries")
+
+	buckets = [][]byte{bucketLandscapeVersions, bucketLandscapeRevisions, bucketInstances, bucketBindings, bucketInstanceLocks, bucketDeliveries}
+)
+
+const (
+	// boltOpenTimeout limits the wait for the file lock held by another process
+	boltOpenTimeout = time.Second
+	// boltCompactTxSize limits the size of a transaction while compacting
+	boltCompactTxSize = 64 << 20
+)
+
+// boltStore keeps the state in an embedded bbolt database for a single broker instance
+type boltStore struct {
+	path string
+
+	// mutex guards db, which is replaced by Compact
+	mutex sync.RWMutex
+	db    *bolt.DB
+}
+
+// NewBoltStore creates a store in the bbolt database file at path
+func NewBoltStore(path string) (Store, error) {
+	db, err := openBolt(path)
+	if err != nil {
+		return nil, err
+	}
+	return &boltStore{path: path, db: db}, nil
+}
+
+func openBolt(path string) (*bolt.DB, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: boltOpenTimeout})
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf("database %v is in use by another process", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range buckets {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func (s *boltStore) view(f func(tx *bolt.Tx) error) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.db.View(f)
+}
+
+func (s *boltStore) update(f func(tx *bolt.Tx) error) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.db.Update(f)
+}
+
+func itob(n uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, n)
+	return b
+}
+
+func bindingKey(instanceID string, bindingID string) []byte {
+	return []byte(instanceID + "\x00" + bindingID)
+}
+
+func put(bucket *bolt.Bucket, key []byte, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(key, data)
+}
+
+// get decodes the value of key into v
+func get(bucket *bolt.Bucket, key []byte, v interface{}) error {
+	data := bucket.Get(key)
+	if data == nil {
+		return ErrNotFound
+	}
+	return json.Unmarshal(data, v)
+}
+
+// last decodes the value of the last key into v
+func last(bucket *bolt.Bucket, v interface{}) error {
+	_, data := bucket.Cursor().Last()
+	if data == nil {
+		return ErrNotFound
+	}
+	return json.Unmarshal(data, v)
+}
+
+// trim removes the first keys of bucket to keep max entries
+func trim(bucket *bolt.Bucket, max int) error {
+	var keys [][]byte
+	cursor := bucket.Cursor()
+	for key, _ := cursor.First(); key != nil; key, _ = cursor.Next() {
+		keys = append(keys, key)
+	}
+	if len(keys) <= max {
+		return nil
+	}
+
+	for _, key := range keys[:len(keys)-max] {
+		if err := bucket.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func remove(bucket *bolt.Bucket, key []byte) error {
+	if bucket.Get(key) == nil {
+		return ErrNotFound
+	}
+	return bucket.Delete(key)
+}
+
+func (s *boltStore) LandscapeVersions() ([]LandscapeVersion, error) {
+	versions := []LandscapeVersion{}
+	err := s.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketLandscapeVersions).ForEach(func(key, data []byte) error {
+			var version LandscapeVersion
+			if err := json.Unmarshal(data, &version); err != nil {
+				return err
+			}
+			version.Document = nil
+			versions = append(versions, version)
+			return nil
+		})
+	})
+	return versions, err
+}
+
+func (s *boltStore) LandscapeVersion(number int) (*LandscapeVersion, error) {
+	var version LandscapeVersion
+	err := s.view(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketLandscapeVersions)
+		if number == 0 {
+			return last(bucket, &version)
+		}
+		if number < 0 {
+			return ErrNotFound
+		}
+		return get(bucket, itob(uint64(number)), &version)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &version, nil
+}
+
+func (s *boltStore) SaveLandscapes(document *landscape.Document, author string, change string) (*LandscapeVersion, error) {
+	version := &LandscapeVersion{
+		Created:  time.Now().UTC(),
+		Author:   author,
+		Change:   change,
+		Document: document,
+	}
+
+	err := s.update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketLandscapeVersions)
+		version.Number = 1
+		if key, _ := bucket.Cursor().Last(); key != nil {
+			version.Number = int(binary.BigEndian.Uint64(key)) + 1
+		}
+		return put(bucket, itob(uint64(version.Number)), version)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return version, nil
+}
+
+func (s *boltStore) PutLandscapeVersion(version *LandscapeVersion) error {
+	return s.update(func(tx *bolt.Tx) error {
+		return put(tx.Bucket(bucketLandscapeVersions), itob(uint64(version.Number)), version)
+	})
+}
+
+func (s *boltStore) AddLandscapeRevision(revision *landscape.Revision) error {
+	return s.update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketLandscapeRevisions)
+		var latest landscape.Revision
+		err := last(bucket, &latest)
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+		if err == nil && sameLandscapes(latest.Landscapes, revision.Landscapes) {
+			return ErrExists
+		}
+		revision.Number = latest.Number + 1
+		return putRevision(bucket, revision)
+	})
+}
+
+func (s *boltStore) PutLandscapeRevision(revision *landscape.Revision) error {
+	return s.update(func(tx *bolt.Tx) error {
+		return putRevision(tx.Bucket(bucketLandscapeRevisions), revision)
+	})
+}
+
+func putRevision(bucket *bolt.Bucket, revision *landscape.Revision) error {
+	if err := put(bucket, itob(uint64(revision.Number)), revision); err != nil {
+		return err
+	}
+	return trim(bucket, maxLandscapeRevisions)
+}
+
+func (s *boltStore) LandscapeRevisions() ([]landscape.Revision, error) {
+	revisions := []landscape.Revision{}
+	err := s.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketLandscapeRevisions).ForEach(func(key, data []byte) error {
+			var revision landscape.Revision
+			if err := json.Unmarshal(data, &revision); err != nil {
+				return err
+			}
+			revision.Changes = nil
+			revision.Landscapes = nil
+			revisions = append(revisions, revision)
+			return nil
+		})
+	})
+	return revisions, err
+}
+
+func (s *boltStore) LandscapeRevision(number int64) (*landscape.Revision, error) {
+	var revision landscape.Revision
+	err := s.view(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketLandscapeRevisions)
+		if number == 0 {
+			return last(bucket, &revision)
+		}
+		if number < 0 {
+			return ErrNotFound
+		}
+		return get(bucket, itob(uint64(number)), &revision)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &revision, nil
+}
+
+func (s *boltStore) Instances() ([]Instance, error) {
+	instances := []Instance{}
+	err := s.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketInstances).ForEach(func(key, data []byte) error {
+			var instance Instance
+			err := json.Unmarshal(data, &instance)
+			instances = append(instances, instance)
+			return err
+		})
+	})
+	return instances, err
+}
+
+func (s *boltStore) Instance(instanceID string) (*Instance, error) {
+	var instance Instance
+	err := s.view(func(tx *bolt.Tx) error {
+		return get(tx.Bucket(bucketInstances), []byte(instanceID), &instance)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &instance, nil
+}
+
+func (s *boltStore) SaveInstance(instance *Instance) error {
+	return s.update(func(tx *bolt.Tx) error {
+		return put(tx.Bucket(bucketInstances), []byte(instance.InstanceID), instance)
+	})
+}
+
+func (s *boltStore) DeleteInstance(instanceID string) error {
+	return s.update(func(tx *bolt.Tx) error {
+		return remove(tx.Bucket(bucketInstances), []byte(instanceID))
+	})
+}
+
+func (s *boltStore) Bindings() ([]Binding, error) {
+	bindings := []Binding{}
+	err := s.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketBindings).ForEach(func(key, data []byte) error {
+			var binding Binding
+			err := json.Unmarshal(data, &binding)
+			bindings = append(bindings, binding)
+			return err
+		})
+	})
+	return bindings, err
+}
+
+func (s *boltStore) Binding(instanceID string, bindingID string) (*Binding, error) {
+	var binding Binding
+	err := s.view(func(tx *bolt.Tx) error {
+		return get(tx.Bucket(bucketBindings), bindingKey(instanceID, bindingID), &binding)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &binding, nil
+}
+
+func (s *boltStore) SaveBinding(binding *Binding) error {
+	return s.update(func(tx *bolt.Tx) error {
+		return put(tx.Bucket(bucketBindings), bindingKey(binding.InstanceID, binding.BindingID), binding)
+	})
+}
+
+func (s *boltStore) DeleteBinding(instanceID string, bindingID string) error {
+	return s.update(func(tx *bolt.Tx) error {
+		return remove(tx.Bucket(bucketBindings), bindingKey(instanceID, bindingID))
+	})
+}
+
+func (s *boltStore) LockInstance(lock *InstanceLock) error {
+	return s.update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketInstanceLocks)
+
+		var held InstanceLock
+		err := get(bucket, []byte(lock.InstanceID), &held)
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+		if err == nil && held.Owner != lock.Owner && held.Expires.After(lock.Acquired) {
+			return ErrLocked
+		}
+		return put(bucket, []byte(lock.InstanceID), lock)
+	})
+}
+
+func (s *boltStore) UnlockInstance(instanceID string, owner string) error {
+	return s.update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketInstanceLocks)
+
+		var held InstanceLock
+		if err := get(bucket, []byte(instanceID), &held); err != nil {
+			return err
+		}
+		if held.Owner != owner {
+			return ErrNotFound
+		}
+		return bucket.Delete([]byte(instanceID))
+	})
+}
+
+func (s *boltStore) AddDelivery(delivery *Delivery) error {
+	return s.update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketDeliveries)
+		sequence, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		if err := put(bucket, itob(sequence), delivery); err != nil {
+			return err
+		}
+		return trim(bucket, maxDeliveries)
+	})
+}
+
+func (s *boltStore) Deliveries() ([]Delivery, error) {
+	deliveries := []Delivery{}
+	err := s.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketDeliveries).ForEach(func(key, data []byte) error {
+			var delivery Delivery
+			err := json.Unmarshal(data, &delivery)
+			deliveries = append(deliveries, delivery)
+			return err
+		})
+	})
+	return deliveries, err
+}
+
+// Backup writes a consistent copy of the database to w while the store is in use
+func (s *boltStore) Backup(w io.Writer) (int64, error) {
+	var n int64
+	err := s.view(func(tx *bolt.Tx) error {
+		var err error
+		n, err = tx.WriteTo(w)
+		return err
+	})
+	return n, err
+}
+
+// Compact rewrites the database file without the space of deleted entries.
+// The store is blocked while compacting.
+func (s *boltStore) Compact() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	tmp := s.path + ".compact"
+	dst, err := bolt.Open(tmp, 0600, &bolt.Options{Timeout: boltOpenTimeout})
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	if err := bolt.Compact(dst, s.db, boltCompactTxSize); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+
+	if err := s.db.Close(); err != nil {
+		return err
+	}
+	return s.reopen(os.Rename(tmp, s.path))
+}
+
+// reopen opens the database closed by Compact and returns cause, the error
+// of compacting. If the database cannot be opened, the closed handle is kept,
+// so the store fails with bolt.ErrDatabaseNotOpen instead of a nil database.
+func (s *boltStore) reopen(cause error) error {
+	db, err := openBolt(s.path)
+	if err != nil {
+		if cause != nil {
+			return fmt.Errorf("%v, reopening the database failed: %v", cause, err)
+		}
+		return err
+	}
+	s.db = db
+	return cause
+}
+
+func (s *boltStore) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.db.Close()
+}
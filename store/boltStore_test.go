@@ -0,0 +1,197 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sklevenz/lookup-broker/landscape"
+	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+)
+
+func newBoltStore(t *testing.T) (Store, string, func()) {
+	dir, _ := ioutil.TempDir("", "store")
+	path := filepath.Join(dir, "broker.db")
+	s, err := NewBoltStore(path)
+	assert.Nil(t, err)
+	return s, path, func() {
+		s.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestBoltStoreInUse(t *testing.T) {
+	_, path, done := newBoltStore(t)
+	defer done()
+
+	_, err := NewBoltStore(path)
+	assert.EqualError(t, err, "database "+path+" is in use by another process")
+}
+
+func TestBoltStoreLandscapes(t *testing.T) {
+	s, _, done := newBoltStore(t)
+	defer done()
+
+	_, err := s.LandscapeVersion(0)
+	assert.Equal(t, ErrNotFound, err)
+
+	_, err = s.SaveLandscapes(document("a"), "admin", "put landscape a")
+	assert.Nil(t, err)
+	v2, err := s.SaveLandscapes(document("a", "b"), "admin", "put landscape b")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, v2.Number)
+
+	latest, err := s.LandscapeVersion(0)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, latest.Number)
+	assert.Equal(t, 2, len(latest.Document.Landscapes))
+
+	versions, err := s.LandscapeVersions()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(versions))
+	assert.Nil(t, versions[0].Document)
+
+	for i := 1; i <= maxLandscapeRevisions+2; i++ {
+		revision := &landscape.Revision{Changes: []landscape.Change{{Type: landscape.Added, Name: "cf-1"}}, Landscapes: landscape.Landscapes{fmt.Sprintf("cf-%v", i): {}}}
+		assert.Nil(t, s.AddLandscapeRevision(revision))
+		assert.Equal(t, int64(i), revision.Number)
+	}
+	assert.Equal(t, ErrExists, s.AddLandscapeRevision(&landscape.Revision{Landscapes: landscape.Landscapes{fmt.Sprintf("cf-%v", maxLandscapeRevisions+2): {}}}))
+
+	revisions, err := s.LandscapeRevisions()
+	assert.Nil(t, err)
+	assert.Equal(t, maxLandscapeRevisions, len(revisions))
+	assert.Equal(t, int64(3), revisions[0].Number)
+	assert.Nil(t, revisions[0].Changes)
+
+	revision, err := s.LandscapeRevision(0)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(maxLandscapeRevisions+2), revision.Number)
+	assert.Equal(t, "cf-1", revision.Changes[0].Name)
+
+	_, err = s.LandscapeRevision(1)
+	assert.Equal(t, ErrNotFound, err)
+
+	assert.Nil(t, s.PutLandscapeRevision(&landscape.Revision{Number: 3, Commit: "replaced"}))
+	revision, err = s.LandscapeRevision(3)
+	assert.Nil(t, err)
+	assert.Equal(t, "replaced", revision.Commit)
+}
+
+func TestBoltStoreInstancesAndBindings(t *testing.T) {
+	s, _, done := newBoltStore(t)
+	defer done()
+
+	assert.Nil(t, s.SaveInstance(&Instance{InstanceID: "1", ServiceID: "1", PlanID: "1.1"}))
+	assert.Nil(t, s.SaveInstance(&Instance{InstanceID: "1", ServiceID: "1", PlanID: "1.2"}))
+
+	instance, err := s.Instance("1")
+	assert.Nil(t, err)
+	assert.Equal(t, "1.2", instance.PlanID)
+
+	assert.Nil(t, s.SaveBinding(&Binding{InstanceID: "1", BindingID: "2", Selector: "aws"}))
+	assert.Nil(t, s.SaveBinding(&Binding{InstanceID: "1", BindingID: "3"}))
+	bindings, err := s.Bindings()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(bindings))
+
+	binding, err := s.Binding("1", "2")
+	assert.Nil(t, err)
+	assert.Equal(t, "aws", binding.Selector)
+
+	assert.Nil(t, s.DeleteBinding("1", "2"))
+	assert.Equal(t, ErrNotFound, s.DeleteBinding("1", "2"))
+
+	assert.Nil(t, s.DeleteInstance("1"))
+	assert.Equal(t, ErrNotFound, s.DeleteInstance("1"))
+	instances, err := s.Instances()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(instances))
+}
+
+func TestBoltStoreInstanceLocks(t *testing.T) {
+	s, _, done := newBoltStore(t)
+	defer done()
+	now := time.Now()
+
+	assert.Nil(t, s.LockInstance(&InstanceLock{InstanceID: "1", Owner: "a", Acquired: now, Expires: now.Add(time.Minute)}))
+	assert.Equal(t, ErrLocked, s.LockInstance(&InstanceLock{InstanceID: "1", Owner: "b", Acquired: now, Expires: now.Add(time.Minute)}))
+
+	assert.Equal(t, ErrNotFound, s.UnlockInstance("1", "b"))
+	assert.Nil(t, s.UnlockInstance("1", "a"))
+
+	later := now.Add(2 * time.Minute)
+	assert.Nil(t, s.LockInstance(&InstanceLock{InstanceID: "1", Owner: "b", Acquired: now, Expires: now.Add(time.Minute)}))
+	assert.Nil(t, s.LockInstance(&InstanceLock{InstanceID: "1", Owner: "c", Acquired: later, Expires: later.Add(time.Minute)}))
+}
+
+func TestBoltStoreDeliveries(t *testing.T) {
+	s, _, done := newBoltStore(t)
+	defer done()
+
+	for i := 0; i < maxDeliveries+5; i++ {
+		assert.Nil(t, s.AddDelivery(&Delivery{ID: "d", Attempt: i}))
+	}
+
+	deliveries, err := s.Deliveries()
+	assert.Nil(t, err)
+	assert.Equal(t, maxDeliveries, len(deliveries))
+	assert.Equal(t, 5, deliveries[0].Attempt)
+	assert.Equal(t, maxDeliveries+4, deliveries[maxDeliveries-1].Attempt)
+}
+
+func TestBoltStoreBackupAndCompact(t *testing.T) {
+	s, path, done := newBoltStore(t)
+	defer done()
+
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, s.SaveBinding(&Binding{InstanceID: "1", BindingID: fmt.Sprint(i), Parameters: map[string]interface{}{"padding": string(make([]byte, 1024))}}))
+	}
+	for i := 1; i < 500; i++ {
+		assert.Nil(t, s.DeleteBinding("1", fmt.Sprint(i)))
+	}
+
+	var backup bytes.Buffer
+	n, err := s.(Backuper).Backup(&backup)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(backup.Len()), n)
+
+	backupPath := path + ".backup"
+	assert.Nil(t, ioutil.WriteFile(backupPath, backup.Bytes(), 0600))
+	restored, err := NewBoltStore(backupPath)
+	assert.Nil(t, err)
+	_, err = restored.Binding("1", "0")
+	assert.Nil(t, err)
+	assert.Nil(t, restored.Close())
+
+	before, _ := os.Stat(path)
+	assert.Nil(t, s.(Compacter).Compact())
+	after, _ := os.Stat(path)
+	assert.True(t, after.Size() < before.Size())
+
+	_, err = s.Binding("1", "0")
+	assert.Nil(t, err)
+	assert.Nil(t, s.SaveBinding(&Binding{InstanceID: "1", BindingID: "1"}))
+}
+
+func TestBoltStoreReopenFailure(t *testing.T) {
+	s, path, done := newBoltStore(t)
+	defer done()
+
+	b := s.(*boltStore)
+	assert.Nil(t, b.db.Close())
+	other, err := openBolt(path)
+	assert.Nil(t, err)
+	defer other.Close()
+
+	err = b.reopen(errors.New("rename failed"))
+	assert.EqualError(t, err, "rename failed, reopening the database failed: database "+path+" is in use by another process")
+	_, err = s.Binding("1", "1")
+	assert.Equal(t, bolt.ErrDatabaseNotOpen, err)
+}
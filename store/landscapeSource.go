@@ -0,0 +1,30 @@
+package store
+
+import (
+	"fmt"
+
+	"github.com/sklevenz/lookup-broker/landscape"
+)
+
+// LandscapeSource provides the latest landscape version of a store
+type LandscapeSource struct {
+	Store Store
+}
+
+// Name of the source
+func (s LandscapeSource) Name() string {
+	return "store"
+}
+
+// Load the latest version, an empty store provides no fragment
+func (s LandscapeSource) Load() ([]landscape.Fragment, error) {
+	version, err := s.Store.LandscapeVersion(0)
+	if err == ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", s.Name(), err)
+	}
+
+	return []landscape.Fragment{{Origin: fmt.Sprintf("%v:version/%v", s.Name(), version.Number), Document: version.Document}}, nil
+}
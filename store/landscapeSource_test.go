@@ -0,0 +1,25 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLandscapeSource(t *testing.T) {
+	s := NewMemoryStore()
+	source := LandscapeSource{Store: s}
+
+	fragments, err := source.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(fragments))
+
+	s.SaveLandscapes(document("a"), "admin", "put landscape a")
+	s.SaveLandscapes(document("a", "b"), "admin", "put landscape b")
+
+	fragments, err = source.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(fragments))
+	assert.Equal(t, "store:version/2", fragments[0].Origin)
+	assert.Equal(t, 2, len(fragments[0].Document.Landscapes))
+}
@@ -0,0 +1,453 @@
+package store
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sklevenz/lookup-broker/landscape"
+)
+
+// memoryStore keeps the state in memory and optionally writes it through to a JSON file
+type memoryStore struct {
+	path string
+
+	mutex sync.RWMutex
+	state memoryState
+}
+
+type memoryState struct {
+	LandscapeVersions  []LandscapeVersion   `json:"landscape_versions"`
+	LandscapeRevisions []landscape.Revision `json:"landscape_revisions"`
+	Instances          []Instance           `json:"instances,omitempty"`
+	Bindings           []Binding            `json:"bindings"`
+	InstanceLocks      []InstanceLock       `json:"instance_locks,omitempty"`
+	Deliveries         []Delivery           `json:"deliveries"`
+}
+
+const (
+	// maxDeliveries limits the size of the delivery log
+	maxDeliveries = 1000
+	// maxLandscapeRevisions limits the size of the revision history
+	maxLandscapeRevisions = 1000
+)
+
+// NewMemoryStore creates a store which does not survive a restart
+func NewMemoryStore() Store {
+	return &memoryStore{}
+}
+
+// NewFileStore creates a store persisted as JSON file at path
+func NewFileStore(path string) (Store, error) {
+	s := &memoryStore{path: path}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &s.state); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *memoryStore) LandscapeVersions() ([]LandscapeVersion, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	versions := make([]LandscapeVersion, len(s.state.LandscapeVersions))
+	for i, version := range s.state.LandscapeVersions {
+		version.Document = nil
+		versions[i] = version
+	}
+	return versions, nil
+}
+
+func (s *memoryStore) LandscapeVersion(number int) (*LandscapeVersion, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	versions := s.state.LandscapeVersions
+	if len(versions) == 0 {
+		return nil, ErrNotFound
+	}
+	if number == 0 {
+		version := versions[len(versions)-1]
+		return &version, nil
+	}
+
+	for _, version := range versions {
+		if version.Number == number {
+			return &version, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *memoryStore) SaveLandscapes(document *landscape.Document, author string, change string) (*LandscapeVersion, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	version := LandscapeVersion{
+		Number:   1,
+		Created:  time.Now().UTC(),
+		Author:   author,
+		Change:   change,
+		Document: document,
+	}
+
+	if n := len(s.state.LandscapeVersions); n > 0 {
+		version.Number = s.state.LandscapeVersions[n-1].Number + 1
+	}
+
+	err := s.update(func() {
+		s.state.LandscapeVersions = append(s.state.LandscapeVersions, version)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &version, nil
+}
+
+func (s *memoryStore) PutLandscapeVersion(version *LandscapeVersion) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	previous := s.state.LandscapeVersions
+	versions := make([]LandscapeVersion, 0, len(previous)+1)
+	i := 0
+	for ; i < len(previous) && previous[i].Number < version.Number; i++ {
+		versions = append(versions, previous[i])
+	}
+	versions = append(versions, *version)
+	if i < len(previous) && previous[i].Number == version.Number {
+		i++
+	}
+	versions = append(versions, previous[i:]...)
+
+	return s.update(func() {
+		s.state.LandscapeVersions = versions
+	})
+}
+
+func (s *memoryStore) AddLandscapeRevision(revision *landscape.Revision) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	revision.Number = 1
+	if n := len(s.state.LandscapeRevisions); n > 0 {
+		latest := s.state.LandscapeRevisions[n-1]
+		if sameLandscapes(latest.Landscapes, revision.Landscapes) {
+			return ErrExists
+		}
+		revision.Number = latest.Number + 1
+	}
+	return s.putLandscapeRevision(revision)
+}
+
+func (s *memoryStore) PutLandscapeRevision(revision *landscape.Revision) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.putLandscapeRevision(revision)
+}
+
+// putLandscapeRevision inserts revision in the order of numbers, replacing a
+// revision with the same number. Must be called with the mutex locked.
+func (s *memoryStore) putLandscapeRevision(revision *landscape.Revision) error {
+	previous := s.state.LandscapeRevisions
+	revisions := make([]landscape.Revision, 0, len(previous)+1)
+	i := 0
+	for ; i < len(previous) && previous[i].Number < revision.Number; i++ {
+		revisions = append(revisions, previous[i])
+	}
+	revisions = append(revisions, *revision)
+	if i < len(previous) && previous[i].Number == revision.Number {
+		i++
+	}
+	revisions = append(revisions, previous[i:]...)
+	if len(revisions) > maxLandscapeRevisions {
+		revisions = revisions[len(revisions)-maxLandscapeRevisions:]
+	}
+
+	return s.update(func() {
+		s.state.LandscapeRevisions = revisions
+	})
+}
+
+func (s *memoryStore) LandscapeRevisions() ([]landscape.Revision, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	revisions := make([]landscape.Revision, len(s.state.LandscapeRevisions))
+	for i, revision := range s.state.LandscapeRevisions {
+		revision.Changes = nil
+		revision.Landscapes = nil
+		revisions[i] = revision
+	}
+	return revisions, nil
+}
+
+func (s *memoryStore) LandscapeRevision(number int64) (*landscape.Revision, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	revisions := s.state.LandscapeRevisions
+	if len(revisions) == 0 {
+		return nil, ErrNotFound
+	}
+	if number == 0 {
+		revision := revisions[len(revisions)-1]
+		return &revision, nil
+	}
+
+	for _, revision := range revisions {
+		if revision.Number == number {
+			return &revision, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *memoryStore) Instances() ([]Instance, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return append([]Instance{}, s.state.Instances...), nil
+}
+
+func (s *memoryStore) instanceIndex(instanceID string) int {
+	for i, instance := range s.state.Instances {
+		if instance.InstanceID == instanceID {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *memoryStore) Instance(instanceID string) (*Instance, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	i := s.instanceIndex(instanceID)
+	if i < 0 {
+		return nil, ErrNotFound
+	}
+
+	instance := s.state.Instances[i]
+	return &instance, nil
+}
+
+func (s *memoryStore) SaveInstance(instance *Instance) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.update(func() {
+		if i := s.instanceIndex(instance.InstanceID); i >= 0 {
+			s.state.Instances[i] = *instance
+		} else {
+			s.state.Instances = append(s.state.Instances, *instance)
+		}
+	})
+}
+
+func (s *memoryStore) DeleteInstance(instanceID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	i := s.instanceIndex(instanceID)
+	if i < 0 {
+		return ErrNotFound
+	}
+
+	return s.update(func() {
+		s.state.Instances = append(s.state.Instances[:i], s.state.Instances[i+1:]...)
+	})
+}
+
+func (s *memoryStore) Bindings() ([]Binding, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return append([]Binding{}, s.state.Bindings...), nil
+}
+
+func (s *memoryStore) bindingIndex(instanceID string, bindingID string) int {
+	for i, binding := range s.state.Bindings {
+		if binding.InstanceID == instanceID && binding.BindingID == bindingID {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *memoryStore) Binding(instanceID string, bindingID string) (*Binding, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	i := s.bindingIndex(instanceID, bindingID)
+	if i < 0 {
+		return nil, ErrNotFound
+	}
+
+	binding := s.state.Bindings[i]
+	return &binding, nil
+}
+
+func (s *memoryStore) SaveBinding(binding *Binding) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.update(func() {
+		if i := s.bindingIndex(binding.InstanceID, binding.BindingID); i >= 0 {
+			s.state.Bindings[i] = *binding
+		} else {
+			s.state.Bindings = append(s.state.Bindings, *binding)
+		}
+	})
+}
+
+func (s *memoryStore) DeleteBinding(instanceID string, bindingID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	i := s.bindingIndex(instanceID, bindingID)
+	if i < 0 {
+		return ErrNotFound
+	}
+
+	return s.update(func() {
+		s.state.Bindings = append(s.state.Bindings[:i], s.state.Bindings[i+1:]...)
+	})
+}
+
+func (s *memoryStore) lockIndex(instanceID string) int {
+	for i, lock := range s.state.InstanceLocks {
+		if lock.InstanceID == instanceID {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *memoryStore) LockInstance(lock *InstanceLock) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	i := s.lockIndex(lock.InstanceID)
+	if i >= 0 {
+		held := s.state.InstanceLocks[i]
+		if held.Owner != lock.Owner && held.Expires.After(lock.Acquired) {
+			return ErrLocked
+		}
+	}
+	return s.update(func() {
+		if i >= 0 {
+			s.state.InstanceLocks[i] = *lock
+		} else {
+			s.state.InstanceLocks = append(s.state.InstanceLocks, *lock)
+		}
+	})
+}
+
+func (s *memoryStore) UnlockInstance(instanceID string, owner string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	i := s.lockIndex(instanceID)
+	if i < 0 || s.state.InstanceLocks[i].Owner != owner {
+		return ErrNotFound
+	}
+
+	return s.update(func() {
+		s.state.InstanceLocks = append(s.state.InstanceLocks[:i], s.state.InstanceLocks[i+1:]...)
+	})
+}
+
+func (s *memoryStore) AddDelivery(delivery *Delivery) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.update(func() {
+		s.state.Deliveries = append(s.state.Deliveries, *delivery)
+		if len(s.state.Deliveries) > maxDeliveries {
+			s.state.Deliveries = s.state.Deliveries[len(s.state.Deliveries)-maxDeliveries:]
+		}
+	})
+}
+
+func (s *memoryStore) Deliveries() ([]Delivery, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return append([]Delivery{}, s.state.Deliveries...), nil
+}
+
+func (s *memoryStore) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.flush()
+}
+
+// update applies change to the state and writes it through, the state is
+// restored if the write fails. Must be called with the mutex locked.
+func (s *memoryStore) update(change func()) error {
+	if s.path == "" {
+		change()
+		return nil
+	}
+
+	previous := s.state.clone()
+	change()
+	if err := s.flush(); err != nil {
+		s.state = previous
+		return err
+	}
+	return nil
+}
+
+// clone copies the entries of the state, so changes in place do not affect it
+func (state memoryState) clone() memoryState {
+	return memoryState{
+		LandscapeVersions:  append([]LandscapeVersion(nil), state.LandscapeVersions...),
+		LandscapeRevisions: append([]landscape.Revision(nil), state.LandscapeRevisions...),
+		Instances:          append([]Instance(nil), state.Instances...),
+		Bindings:           append([]Binding(nil), state.Bindings...),
+		InstanceLocks:      append([]InstanceLock(nil), state.InstanceLocks...),
+		Deliveries:         append([]Delivery(nil), state.Deliveries...),
+	}
+}
+
+func (s *memoryStore) flush() error {
+	if s.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(s.state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
@@ -0,0 +1,201 @@
+package store
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sklevenz/lookup-broker/landscape"
+	"github.com/stretchr/testify/assert"
+)
+
+func document(names ...string) *landscape.Document {
+	doc := &landscape.Document{Landscapes: map[string]landscape.Definition{}}
+	for _, name := range names {
+		doc.Landscapes[name] = landscape.Definition{CloudController: "https://api." + name + ".example.com"}
+	}
+	return doc
+}
+
+func TestMemoryStoreLandscapeVersions(t *testing.T) {
+	s := NewMemoryStore()
+
+	_, err := s.LandscapeVersion(0)
+	assert.Equal(t, ErrNotFound, err)
+
+	v1, err := s.SaveLandscapes(document("a"), "admin", "put landscape a")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, v1.Number)
+
+	v2, err := s.SaveLandscapes(document("a", "b"), "admin", "put landscape b")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, v2.Number)
+
+	latest, err := s.LandscapeVersion(0)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, latest.Number)
+	assert.Equal(t, 2, len(latest.Document.Landscapes))
+
+	first, err := s.LandscapeVersion(1)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(first.Document.Landscapes))
+
+	_, err = s.LandscapeVersion(3)
+	assert.Equal(t, ErrNotFound, err)
+
+	versions, err := s.LandscapeVersions()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(versions))
+	assert.Equal(t, "put landscape b", versions[1].Change)
+	assert.Nil(t, versions[1].Document)
+}
+
+func TestFileStore(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "store")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "store.json")
+
+	s, err := NewFileStore(path)
+	assert.Nil(t, err)
+
+	_, err = s.SaveLandscapes(document("a"), "admin", "put landscape a")
+	assert.Nil(t, err)
+	assert.Nil(t, s.Close())
+
+	reopened, err := NewFileStore(path)
+	assert.Nil(t, err)
+
+	latest, err := reopened.LandscapeVersion(0)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, latest.Number)
+	assert.Equal(t, "admin", latest.Author)
+	assert.Contains(t, latest.Document.Landscapes, "a")
+
+	ioutil.WriteFile(path, []byte("not json"), 0644)
+	_, err = NewFileStore(path)
+	assert.NotNil(t, err)
+}
+
+func TestFileStoreWriteFailure(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "store")
+	defer os.RemoveAll(dir)
+
+	s, err := NewFileStore(filepath.Join(dir, "store.json"))
+	assert.Nil(t, err)
+	assert.Nil(t, s.SaveInstance(&Instance{InstanceID: "1", PlanID: "1.1"}))
+	assert.Nil(t, s.SaveBinding(&Binding{InstanceID: "1", BindingID: "1"}))
+
+	// the state is unchanged if it cannot be written
+	os.RemoveAll(dir)
+	assert.NotNil(t, s.SaveInstance(&Instance{InstanceID: "1", PlanID: "1.2"}))
+	assert.NotNil(t, s.SaveInstance(&Instance{InstanceID: "2"}))
+	assert.NotNil(t, s.DeleteBinding("1", "1"))
+	assert.NotNil(t, s.LockInstance(&InstanceLock{InstanceID: "1", Owner: "a"}))
+	assert.NotNil(t, s.AddLandscapeRevision(&landscape.Revision{}))
+
+	instances, _ := s.Instances()
+	assert.Equal(t, []Instance{{InstanceID: "1", PlanID: "1.1"}}, instances)
+	bindings, _ := s.Bindings()
+	assert.Equal(t, 1, len(bindings))
+	_, err = s.LandscapeRevision(0)
+	assert.Equal(t, ErrNotFound, err)
+	assert.Equal(t, ErrNotFound, s.UnlockInstance("1", "a"))
+}
+
+func TestMemoryStoreBindings(t *testing.T) {
+	s := NewMemoryStore()
+
+	_, err := s.Binding("1", "2")
+	assert.Equal(t, ErrNotFound, err)
+
+	assert.Nil(t, s.SaveBinding(&Binding{InstanceID: "1", BindingID: "2", Selector: "aws"}))
+	assert.Nil(t, s.SaveBinding(&Binding{InstanceID: "1", BindingID: "3"}))
+	assert.Nil(t, s.SaveBinding(&Binding{InstanceID: "1", BindingID: "2", Selector: "gcp"}))
+
+	binding, err := s.Binding("1", "2")
+	assert.Nil(t, err)
+	assert.Equal(t, "gcp", binding.Selector)
+
+	bindings, err := s.Bindings()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(bindings))
+
+	assert.Nil(t, s.DeleteBinding("1", "2"))
+	assert.Equal(t, ErrNotFound, s.DeleteBinding("1", "2"))
+
+	bindings, _ = s.Bindings()
+	assert.Equal(t, 1, len(bindings))
+}
+
+func TestMemoryStoreLandscapeRevisions(t *testing.T) {
+	s := NewMemoryStore()
+
+	_, err := s.LandscapeRevision(0)
+	assert.Equal(t, ErrNotFound, err)
+
+	for i := int64(1); i <= 2; i++ {
+		revision := &landscape.Revision{
+			Changes:    []landscape.Change{{Type: landscape.Added, Name: fmt.Sprintf("cf-%v", i)}},
+			Landscapes: landscape.Landscapes{fmt.Sprintf("cf-%v", i): {}},
+		}
+		assert.Nil(t, s.AddLandscapeRevision(revision))
+		assert.Equal(t, i, revision.Number)
+	}
+	assert.Equal(t, ErrExists, s.AddLandscapeRevision(&landscape.Revision{Landscapes: landscape.Landscapes{"cf-2": {}}}))
+
+	revisions, err := s.LandscapeRevisions()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(revisions))
+	assert.Nil(t, revisions[0].Changes)
+	assert.Nil(t, revisions[0].Landscapes)
+
+	revision, err := s.LandscapeRevision(1)
+	assert.Nil(t, err)
+	assert.Equal(t, "cf-1", revision.Changes[0].Name)
+
+	revision, err = s.LandscapeRevision(0)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), revision.Number)
+
+	_, err = s.LandscapeRevision(3)
+	assert.Equal(t, ErrNotFound, err)
+
+	assert.Nil(t, s.PutLandscapeRevision(&landscape.Revision{Number: 1, Commit: "replaced"}))
+	assert.Nil(t, s.PutLandscapeRevision(&landscape.Revision{Number: 5}))
+	revisions, _ = s.LandscapeRevisions()
+	assert.Equal(t, []int64{1, 2, 5}, []int64{revisions[0].Number, revisions[1].Number, revisions[2].Number})
+	assert.Equal(t, "replaced", revisions[0].Commit)
+}
+
+func TestMemoryStoreDeliveries(t *testing.T) {
+	s := NewMemoryStore()
+
+	for i := 0; i < maxDeliveries+5; i++ {
+		assert.Nil(t, s.AddDelivery(&Delivery{ID: "d", Attempt: i}))
+	}
+
+	deliveries, err := s.Deliveries()
+	assert.Nil(t, err)
+	assert.Equal(t, maxDeliveries, len(deliveries))
+	assert.Equal(t, maxDeliveries+4, deliveries[maxDeliveries-1].Attempt)
+}
+
+func TestMemoryStoreInstanceLocks(t *testing.T) {
+	s := NewMemoryStore()
+	now := time.Now()
+
+	assert.Nil(t, s.LockInstance(&InstanceLock{InstanceID: "1", Owner: "a", Acquired: now, Expires: now.Add(time.Minute)}))
+	assert.Equal(t, ErrLocked, s.LockInstance(&InstanceLock{InstanceID: "1", Owner: "b", Acquired: now, Expires: now.Add(time.Minute)}))
+	assert.Nil(t, s.LockInstance(&InstanceLock{InstanceID: "2", Owner: "b", Acquired: now, Expires: now.Add(time.Minute)}))
+
+	assert.Equal(t, ErrNotFound, s.UnlockInstance("1", "b"))
+	assert.Nil(t, s.UnlockInstance("1", "a"))
+	assert.Nil(t, s.LockInstance(&InstanceLock{InstanceID: "1", Owner: "b", Acquired: now, Expires: now.Add(time.Minute)}))
+
+	later := now.Add(2 * time.Minute)
+	assert.Nil(t, s.LockInstance(&InstanceLock{InstanceID: "1", Owner: "c", Acquired: later, Expires: later.Add(time.Minute)}))
+	assert.Equal(t, ErrNotFound, s.UnlockInstance("1", "b"))
+}
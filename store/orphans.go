@@ -0,0 +1,192 @@
+package store
+
+import (
+	"sort"
+	"time"
+)
+
+// Reasons for which an entry is reported as orphan
+const (
+	OrphanUntouched       = "untouched"
+	OrphanInstanceMissing = "instance_missing"
+	OrphanIncomplete      = "incomplete"
+)
+
+// Orphan is an instance or binding the platform most likely lost track of
+type Orphan struct {
+	InstanceID string    `json:"instance_id"`
+	BindingID  string    `json:"binding_id,omitempty"`
+	Reason     string    `json:"reason"`
+	Touched    time.Time `json:"touched"`
+}
+
+// IsBinding is true for an orphaned binding, else the instance is orphaned
+func (o Orphan) IsBinding() bool {
+	return o.BindingID != ""
+}
+
+// FindOrphans reports the instances and bindings of s which were not touched
+// by a provision, update or bind for maxAge, and the bindings whose instance
+// does not exist. An instance is touched by the operations on its bindings
+// as well. Incomplete instances and bindings of failed provisions and binds
+// are reported, too. A maxAge of zero only reports incomplete entries and
+// bindings of missing instances.
+func FindOrphans(s Store, maxAge time.Duration, now time.Time) ([]Orphan, error) {
+	instances, err := s.Instances()
+	if err != nil {
+		return nil, err
+	}
+	bindings, err := s.Bindings()
+	if err != nil {
+		return nil, err
+	}
+
+	touched := map[string]time.Time{}
+	for _, instance := range instances {
+		touched[instance.InstanceID] = latest(instance.Created, instance.Updated)
+	}
+
+	untouched := func(t time.Time) bool {
+		return maxAge > 0 && now.Sub(t) > maxAge
+	}
+
+	orphans := []Orphan{}
+	for _, binding := range bindings {
+		last, ok := touched[binding.InstanceID]
+		switch {
+		case binding.Incomplete:
+			orphans = append(orphans, Orphan{InstanceID: binding.InstanceID, BindingID: binding.BindingID, Reason: OrphanIncomplete, Touched: binding.Created})
+			continue
+		case !ok:
+			orphans = append(orphans, Orphan{InstanceID: binding.InstanceID, BindingID: binding.BindingID, Reason: OrphanInstanceMissing, Touched: binding.Created})
+			continue
+		case untouched(binding.Created):
+			orphans = append(orphans, Orphan{InstanceID: binding.InstanceID, BindingID: binding.BindingID, Reason: OrphanUntouched, Touched: binding.Created})
+		}
+		touched[binding.InstanceID] = latest(last, binding.Created)
+	}
+
+	for _, instance := range instances {
+		if instance.Incomplete {
+			orphans = append(orphans, Orphan{InstanceID: instance.InstanceID, Reason: OrphanIncomplete, Touched: touched[instance.InstanceID]})
+		} else if last := touched[instance.InstanceID]; untouched(last) {
+			orphans = append(orphans, Orphan{InstanceID: instance.InstanceID, Reason: OrphanUntouched, Touched: last})
+		}
+	}
+
+	sort.SliceStable(orphans, func(i, j int) bool {
+		if orphans[i].InstanceID != orphans[j].InstanceID {
+			return orphans[i].InstanceID < orphans[j].InstanceID
+		}
+		return orphans[i].BindingID < orphans[j].BindingID
+	})
+	return orphans, nil
+}
+
+// PurgeOrphans deletes the orphans holding the lock of their instance for
+// timeout. Orphans of an instance with an operation in progress are skipped,
+// as the operation may not be complete yet or be the orphan mitigation of the
+// platform. Under the lock the orphans are found again with maxAge, so
+// entries completed or touched since they were found are kept. The bindings
+// of an instance are deleted before the instance.
+func PurgeOrphans(s Store, orphans []Orphan, maxAge time.Duration, owner string, timeout time.Duration) ([]Orphan, error) {
+	byInstance := map[string][]Orphan{}
+	var ids []string
+	for _, orphan := range orphans {
+		if _, ok := byInstance[orphan.InstanceID]; !ok {
+			ids = append(ids, orphan.InstanceID)
+		}
+		byInstance[orphan.InstanceID] = append(byInstance[orphan.InstanceID], orphan)
+	}
+
+	purged := []Orphan{}
+	for _, id := range ids {
+		now := time.Now().UTC()
+		lock := &InstanceLock{InstanceID: id, Owner: owner, Operation: "purge", Acquired: now, Expires: now.Add(timeout)}
+		err := s.LockInstance(lock)
+		if err == ErrLocked {
+			continue
+		}
+		if err != nil {
+			return purged, err
+		}
+
+		var deleted []Orphan
+		candidates, err := stillOrphans(s, byInstance[id], maxAge)
+		if err == nil {
+			deleted, err = purgeInstanceOrphans(s, candidates)
+		}
+		purged = append(purged, deleted...)
+		if unlockErr := s.UnlockInstance(id, owner); err == nil {
+			err = unlockErr
+		}
+		if err != nil {
+			return purged, err
+		}
+	}
+	return purged, nil
+}
+
+// stillOrphans returns the orphans which are found again in the current state
+// of s. Must be called holding the lock of their instance.
+func stillOrphans(s Store, orphans []Orphan, maxAge time.Duration) ([]Orphan, error) {
+	current, err := FindOrphans(s, maxAge, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+
+	found := map[string]bool{}
+	for _, orphan := range current {
+		found[orphan.InstanceID+"\x00"+orphan.BindingID] = true
+	}
+	still := []Orphan{}
+	for _, orphan := range orphans {
+		if found[orphan.InstanceID+"\x00"+orphan.BindingID] {
+			still = append(still, orphan)
+		}
+	}
+	return still, nil
+}
+
+func purgeInstanceOrphans(s Store, orphans []Orphan) ([]Orphan, error) {
+	var instance *Orphan
+	purged := []Orphan{}
+	for i, orphan := range orphans {
+		if !orphan.IsBinding() {
+			instance = &orphans[i]
+			continue
+		}
+		err := s.DeleteBinding(orphan.InstanceID, orphan.BindingID)
+		if err != nil && err != ErrNotFound {
+			return purged, err
+		}
+		purged = append(purged, orphan)
+	}
+	if instance == nil {
+		return purged, nil
+	}
+
+	// bindings created after the orphans were found keep the instance
+	bindings, err := s.Bindings()
+	if err != nil {
+		return purged, err
+	}
+	for _, binding := range bindings {
+		if binding.InstanceID == instance.InstanceID {
+			return purged, nil
+		}
+	}
+
+	err = s.DeleteInstance(instance.InstanceID)
+	if err != nil && err != ErrNotFound {
+		return purged, err
+	}
+	return append(purged, *instance), nil
+}
+
+func latest(a time.Time, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
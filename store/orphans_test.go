@@ -0,0 +1,124 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFindOrphans(t *testing.T) {
+	now := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+
+	s := NewMemoryStore()
+	s.SaveInstance(&Instance{InstanceID: "active", Created: now.Add(-30 * day)})
+	s.SaveBinding(&Binding{InstanceID: "active", BindingID: "new", Created: now.Add(-day)})
+	s.SaveBinding(&Binding{InstanceID: "active", BindingID: "old", Created: now.Add(-20 * day)})
+	s.SaveInstance(&Instance{InstanceID: "idle", Created: now.Add(-30 * day), Updated: now.Add(-15 * day)})
+	s.SaveBinding(&Binding{InstanceID: "idle", BindingID: "old", Created: now.Add(-20 * day)})
+	s.SaveInstance(&Instance{InstanceID: "updated", Created: now.Add(-30 * day), Updated: now.Add(-day)})
+	s.SaveBinding(&Binding{InstanceID: "gone", BindingID: "new", Created: now.Add(-day)})
+
+	orphans, err := FindOrphans(s, 0, now)
+	assert.Nil(t, err)
+	assert.Equal(t, []Orphan{{InstanceID: "gone", BindingID: "new", Reason: OrphanInstanceMissing, Touched: now.Add(-day)}}, orphans)
+
+	orphans, err = FindOrphans(s, 10*day, now)
+	assert.Nil(t, err)
+	assert.Equal(t, []Orphan{
+		{InstanceID: "active", BindingID: "old", Reason: OrphanUntouched, Touched: now.Add(-20 * day)},
+		{InstanceID: "gone", BindingID: "new", Reason: OrphanInstanceMissing, Touched: now.Add(-day)},
+		{InstanceID: "idle", Reason: OrphanUntouched, Touched: now.Add(-15 * day)},
+		{InstanceID: "idle", BindingID: "old", Reason: OrphanUntouched, Touched: now.Add(-20 * day)},
+	}, orphans)
+	assert.True(t, orphans[0].IsBinding())
+	assert.False(t, orphans[2].IsBinding())
+}
+
+func TestPurgeOrphans(t *testing.T) {
+	s := NewMemoryStore()
+	s.SaveInstance(&Instance{InstanceID: "idle"})
+	s.SaveBinding(&Binding{InstanceID: "idle", BindingID: "1"})
+	s.SaveBinding(&Binding{InstanceID: "locked", BindingID: "2"})
+	s.SaveInstance(&Instance{InstanceID: "rebound"})
+	s.SaveBinding(&Binding{InstanceID: "rebound", BindingID: "3"})
+
+	now := time.Now().UTC()
+	assert.Nil(t, s.LockInstance(&InstanceLock{InstanceID: "locked", Owner: "broker", Acquired: now, Expires: now.Add(time.Minute)}))
+
+	orphans := []Orphan{
+		{InstanceID: "idle", Reason: OrphanUntouched},
+		{InstanceID: "idle", BindingID: "1", Reason: OrphanUntouched},
+		{InstanceID: "locked", BindingID: "2", Reason: OrphanInstanceMissing},
+		{InstanceID: "rebound", Reason: OrphanUntouched},
+	}
+	purged, err := PurgeOrphans(s, orphans, 24*time.Hour, "reconciler", time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, []Orphan{orphans[1], orphans[0]}, purged)
+
+	_, err = s.Instance("idle")
+	assert.Equal(t, ErrNotFound, err)
+	_, err = s.Binding("locked", "2")
+	assert.Nil(t, err)
+	_, err = s.Instance("rebound")
+	assert.Nil(t, err)
+
+	assert.Nil(t, s.LockInstance(&InstanceLock{InstanceID: "idle", Owner: "broker", Acquired: now, Expires: now.Add(time.Minute)}))
+}
+
+func TestIncompleteOrphans(t *testing.T) {
+	s := NewMemoryStore()
+	s.SaveInstance(&Instance{InstanceID: "1", Incomplete: true})
+	s.SaveInstance(&Instance{InstanceID: "2"})
+	s.SaveBinding(&Binding{InstanceID: "2", BindingID: "binding", Incomplete: true})
+	s.SaveInstance(&Instance{InstanceID: "3"})
+	s.SaveBinding(&Binding{InstanceID: "3", BindingID: "binding in progress", Incomplete: true})
+
+	orphans, err := FindOrphans(s, 0, time.Now().UTC())
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(orphans))
+	for _, orphan := range orphans {
+		assert.Equal(t, OrphanIncomplete, orphan.Reason)
+	}
+
+	now := time.Now().UTC()
+	assert.Nil(t, s.LockInstance(&InstanceLock{InstanceID: "3", Owner: "broker", Acquired: now, Expires: now.Add(time.Minute)}))
+
+	purged, err := PurgeOrphans(s, orphans, 0, "reconciler", time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, []Orphan{orphans[0], orphans[1]}, purged)
+
+	_, err = s.Binding("3", "binding in progress")
+	assert.Nil(t, err)
+	_, err = s.Instance("2")
+	assert.Nil(t, err)
+}
+
+func TestPurgeOrphansChangedSinceFound(t *testing.T) {
+	s := NewMemoryStore()
+	old := time.Now().UTC().Add(-48 * time.Hour)
+	s.SaveInstance(&Instance{InstanceID: "1", Incomplete: true})
+	s.SaveInstance(&Instance{InstanceID: "2", Created: old})
+	s.SaveBinding(&Binding{InstanceID: "2", BindingID: "binding", Created: old, Incomplete: true})
+	s.SaveInstance(&Instance{InstanceID: "3", Created: old})
+
+	orphans, err := FindOrphans(s, 24*time.Hour, time.Now().UTC())
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(orphans))
+
+	// the retried provision and bind complete and the instance is updated
+	s.SaveInstance(&Instance{InstanceID: "1", Created: time.Now().UTC()})
+	s.SaveInstance(&Instance{InstanceID: "2", Created: old})
+	s.SaveBinding(&Binding{InstanceID: "2", BindingID: "binding", Created: time.Now().UTC()})
+	s.SaveInstance(&Instance{InstanceID: "3", Created: old, Updated: time.Now().UTC()})
+
+	purged, err := PurgeOrphans(s, orphans, 24*time.Hour, "reconciler", time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, []Orphan{}, purged)
+
+	instances, _ := s.Instances()
+	assert.Equal(t, 3, len(instances))
+	_, err = s.Binding("2", "binding")
+	assert.Nil(t, err)
+}
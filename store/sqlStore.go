@@ -0,0 +1,509 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	// database drivers of the supported dialects
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/sklevenz/lookup-broker/landscape"
+)
+
+// dialect covers the differences of the supported SQL databases
+type dialect struct {
+	name string
+	// numbered placeholders $1, $2, ... instead of ?
+	numbered bool
+	// serial is the column type of a generated key
+	serial string
+	// lockMigrations serializes migrations of concurrently starting brokers
+	lockMigrations string
+	// lockLandscapes serializes the numbering of landscape versions and
+	// revisions of concurrent brokers
+	lockLandscapes string
+}
+
+var (
+	sqliteDialect = dialect{
+		name:   "sqlite",
+		serial: "INTEGER PRIMARY KEY AUTOINCREMENT",
+	}
+	postgresDialect = dialect{
+		name:           "postgres",
+		numbered:       true,
+		serial:         "BIGSERIAL PRIMARY KEY",
+		lockMigrations: "SELECT pg_advisory_xact_lock(4711)",
+		lockLandscapes: "SELECT pg_advisory_xact_lock(4712)",
+	}
+)
+
+// rebind replaces the ? placeholders of query by the placeholders of the dialect
+func (d dialect) rebind(query string) string {
+	if !d.numbered {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// migrations create and change the schema, they are applied in order and
+// must never be changed once released. {serial} is replaced by the serial
+// column type of the dialect.
+var migrations = [][]string{
+	{
+		`CREATE TABLE landscape_versions (number INTEGER PRIMARY KEY, data TEXT NOT NULL)`,
+		`CREATE TABLE landscape_revisions (number BIGINT PRIMARY KEY, data TEXT NOT NULL)`,
+		`CREATE TABLE bindings (instance_id VARCHAR(255) NOT NULL, binding_id VARCHAR(255) NOT NULL, data TEXT NOT NULL, PRIMARY KEY (instance_id, binding_id))`,
+		`CREATE TABLE deliveries (id {serial}, data TEXT NOT NULL)`,
+	},
+	{
+		`CREATE TABLE instances (instance_id VARCHAR(255) PRIMARY KEY, data TEXT NOT NULL)`,
+		`CREATE TABLE instance_locks (instance_id VARCHAR(255) PRIMARY KEY, owner VARCHAR(255) NOT NULL, expires BIGINT NOT NULL, data TEXT NOT NULL)`,
+	},
+}
+
+// sqlStore keeps the state in a SQL database shared by all broker instances
+type sqlStore struct {
+	db      *sql.DB
+	dialect dialect
+}
+
+// NewSQLStore creates a store in the database dataSource of driver sqlite3 or
+// postgres and migrates its schema to the current version
+func NewSQLStore(driver string, dataSource string) (Store, error) {
+	var d dialect
+	switch driver {
+	case "sqlite3":
+		d = sqliteDialect
+	case "postgres":
+		d = postgresDialect
+	default:
+		return nil, fmt.Errorf("unsupported database driver %v", driver)
+	}
+
+	db, err := sql.Open(driver, dataSource)
+	if err != nil {
+		return nil, err
+	}
+	if d == sqliteDialect {
+		// SQLite allows a single writer, an in-memory database exists per connection
+		db.SetMaxOpenConns(1)
+	}
+
+	s := &sqlStore{db: db, dialect: d}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not migrate %v database: %v", d.name, err)
+	}
+	return s, nil
+}
+
+// OpenDatabase creates a SQL store for a database URL, postgres://... for
+// Postgres, sqlite:path or sqlite:///path for SQLite
+func OpenDatabase(url string) (Store, error) {
+	switch {
+	case strings.HasPrefix(url, "postgres://"), strings.HasPrefix(url, "postgresql://"):
+		return NewSQLStore("postgres", url)
+	case strings.HasPrefix(url, "sqlite://"):
+		return NewSQLStore("sqlite3", strings.TrimPrefix(url, "sqlite://"))
+	case strings.HasPrefix(url, "sqlite:"):
+		return NewSQLStore("sqlite3", strings.TrimPrefix(url, "sqlite:"))
+	}
+	return nil, fmt.Errorf("unsupported database URL, expected postgres:// or sqlite:")
+}
+
+// migrate applies the migrations which are not yet applied, each in a transaction
+func (s *sqlStore) migrate() error {
+	if _, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY, applied BIGINT NOT NULL)`); err != nil {
+		return err
+	}
+
+	for i, statements := range migrations {
+		version := i + 1
+		err := s.transaction(func(tx *sql.Tx) error {
+			if err := lock(tx, s.dialect.lockMigrations); err != nil {
+				return err
+			}
+
+			var applied int
+			if err := tx.QueryRow(s.dialect.rebind(`SELECT COUNT(*) FROM schema_migrations WHERE version = ?`), version).Scan(&applied); err != nil {
+				return err
+			}
+			if applied > 0 {
+				return nil
+			}
+
+			for _, statement := range statements {
+				if _, err := tx.Exec(strings.ReplaceAll(statement, "{serial}", s.dialect.serial)); err != nil {
+					return fmt.Errorf("migration %v: %v", version, err)
+				}
+			}
+			_, err := tx.Exec(s.dialect.rebind(`INSERT INTO schema_migrations (version, applied) VALUES (?, ?)`), version, time.Now().Unix())
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqlStore) transaction(f func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// lock executes statement, a lock held until the end of tx, if the dialect
+// has one
+func lock(tx *sql.Tx, statement string) error {
+	if statement == "" {
+		return nil
+	}
+	_, err := tx.Exec(statement)
+	return err
+}
+
+func (s *sqlStore) exec(query string, args ...interface{}) (sql.Result, error) {
+	return s.db.Exec(s.dialect.rebind(query), args...)
+}
+
+// get decodes the data column of the single row of query into v
+func (s *sqlStore) get(v interface{}, query string, args ...interface{}) error {
+	var data string
+	err := s.db.QueryRow(s.dialect.rebind(query), args...).Scan(&data)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(data), v)
+}
+
+// list decodes the data column of every row of query by decode
+func (s *sqlStore) list(decode func(data []byte) error, query string, args ...interface{}) error {
+	rows, err := s.db.Query(s.dialect.rebind(query), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return err
+		}
+		if err := decode([]byte(data)); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func marshal(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	return string(data), err
+}
+
+// deleted maps a delete of no rows to ErrNotFound
+func deleted(result sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *sqlStore) LandscapeVersions() ([]LandscapeVersion, error) {
+	versions := []LandscapeVersion{}
+	err := s.list(func(data []byte) error {
+		var version LandscapeVersion
+		if err := json.Unmarshal(data, &version); err != nil {
+			return err
+		}
+		version.Document = nil
+		versions = append(versions, version)
+		return nil
+	}, `SELECT data FROM landscape_versions ORDER BY number`)
+	return versions, err
+}
+
+func (s *sqlStore) LandscapeVersion(number int) (*LandscapeVersion, error) {
+	var version LandscapeVersion
+	var err error
+	if number == 0 {
+		err = s.get(&version, `SELECT data FROM landscape_versions ORDER BY number DESC LIMIT 1`)
+	} else {
+		err = s.get(&version, `SELECT data FROM landscape_versions WHERE number = ?`, number)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &version, nil
+}
+
+func (s *sqlStore) SaveLandscapes(document *landscape.Document, author string, change string) (*LandscapeVersion, error) {
+	version := &LandscapeVersion{
+		Created:  time.Now().UTC(),
+		Author:   author,
+		Change:   change,
+		Document: document,
+	}
+
+	err := s.transaction(func(tx *sql.Tx) error {
+		if err := lock(tx, s.dialect.lockLandscapes); err != nil {
+			return err
+		}
+		if err := tx.QueryRow(`SELECT COALESCE(MAX(number), 0) + 1 FROM landscape_versions`).Scan(&version.Number); err != nil {
+			return err
+		}
+		data, err := marshal(version)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(s.dialect.rebind(`INSERT INTO landscape_versions (number, data) VALUES (?, ?)`), version.Number, data)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return version, nil
+}
+
+func (s *sqlStore) PutLandscapeVersion(version *LandscapeVersion) error {
+	data, err := marshal(version)
+	if err != nil {
+		return err
+	}
+
+	return s.transaction(func(tx *sql.Tx) error {
+		if err := lock(tx, s.dialect.lockLandscapes); err != nil {
+			return err
+		}
+		_, err := tx.Exec(s.dialect.rebind(`INSERT INTO landscape_versions (number, data) VALUES (?, ?)
+		ON CONFLICT (number) DO UPDATE SET data = excluded.data`), version.Number, data)
+		return err
+	})
+}
+
+func (s *sqlStore) AddLandscapeRevision(revision *landscape.Revision) error {
+	return s.transaction(func(tx *sql.Tx) error {
+		if err := lock(tx, s.dialect.lockLandscapes); err != nil {
+			return err
+		}
+
+		var data string
+		err := tx.QueryRow(`SELECT data FROM landscape_revisions ORDER BY number DESC LIMIT 1`).Scan(&data)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		var latest landscape.Revision
+		if err == nil {
+			if err := json.Unmarshal([]byte(data), &latest); err != nil {
+				return err
+			}
+			if sameLandscapes(latest.Landscapes, revision.Landscapes) {
+				return ErrExists
+			}
+		}
+		revision.Number = latest.Number + 1
+		return s.putLandscapeRevision(tx, revision)
+	})
+}
+
+func (s *sqlStore) PutLandscapeRevision(revision *landscape.Revision) error {
+	return s.transaction(func(tx *sql.Tx) error {
+		if err := lock(tx, s.dialect.lockLandscapes); err != nil {
+			return err
+		}
+		return s.putLandscapeRevision(tx, revision)
+	})
+}
+
+func (s *sqlStore) putLandscapeRevision(tx *sql.Tx, revision *landscape.Revision) error {
+	data, err := marshal(revision)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(s.dialect.rebind(`INSERT INTO landscape_revisions (number, data) VALUES (?, ?)
+		ON CONFLICT (number) DO UPDATE SET data = excluded.data`), revision.Number, data); err != nil {
+		return err
+	}
+	_, err = tx.Exec(s.dialect.rebind(`DELETE FROM landscape_revisions WHERE number <= (SELECT MAX(number) FROM landscape_revisions) - ?`), maxLandscapeRevisions)
+	return err
+}
+
+func (s *sqlStore) LandscapeRevisions() ([]landscape.Revision, error) {
+	revisions := []landscape.Revision{}
+	err := s.list(func(data []byte) error {
+		var revision landscape.Revision
+		if err := json.Unmarshal(data, &revision); err != nil {
+			return err
+		}
+		revision.Changes = nil
+		revision.Landscapes = nil
+		revisions = append(revisions, revision)
+		return nil
+	}, `SELECT data FROM landscape_revisions ORDER BY number`)
+	return revisions, err
+}
+
+func (s *sqlStore) LandscapeRevision(number int64) (*landscape.Revision, error) {
+	var revision landscape.Revision
+	var err error
+	if number == 0 {
+		err = s.get(&revision, `SELECT data FROM landscape_revisions ORDER BY number DESC LIMIT 1`)
+	} else {
+		err = s.get(&revision, `SELECT data FROM landscape_revisions WHERE number = ?`, number)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &revision, nil
+}
+
+func (s *sqlStore) Instances() ([]Instance, error) {
+	instances := []Instance{}
+	err := s.list(func(data []byte) error {
+		var instance Instance
+		err := json.Unmarshal(data, &instance)
+		instances = append(instances, instance)
+		return err
+	}, `SELECT data FROM instances ORDER BY instance_id`)
+	return instances, err
+}
+
+func (s *sqlStore) Instance(instanceID string) (*Instance, error) {
+	var instance Instance
+	if err := s.get(&instance, `SELECT data FROM instances WHERE instance_id = ?`, instanceID); err != nil {
+		return nil, err
+	}
+	return &instance, nil
+}
+
+func (s *sqlStore) SaveInstance(instance *Instance) error {
+	data, err := marshal(instance)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.exec(`INSERT INTO instances (instance_id, data) VALUES (?, ?)
+		ON CONFLICT (instance_id) DO UPDATE SET data = excluded.data`, instance.InstanceID, data)
+	return err
+}
+
+func (s *sqlStore) DeleteInstance(instanceID string) error {
+	return deleted(s.exec(`DELETE FROM instances WHERE instance_id = ?`, instanceID))
+}
+
+func (s *sqlStore) Bindings() ([]Binding, error) {
+	bindings := []Binding{}
+	err := s.list(func(data []byte) error {
+		var binding Binding
+		err := json.Unmarshal(data, &binding)
+		bindings = append(bindings, binding)
+		return err
+	}, `SELECT data FROM bindings ORDER BY instance_id, binding_id`)
+	return bindings, err
+}
+
+func (s *sqlStore) Binding(instanceID string, bindingID string) (*Binding, error) {
+	var binding Binding
+	if err := s.get(&binding, `SELECT data FROM bindings WHERE instance_id = ? AND binding_id = ?`, instanceID, bindingID); err != nil {
+		return nil, err
+	}
+	return &binding, nil
+}
+
+func (s *sqlStore) SaveBinding(binding *Binding) error {
+	data, err := marshal(binding)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.exec(`INSERT INTO bindings (instance_id, binding_id, data) VALUES (?, ?, ?)
+		ON CONFLICT (instance_id, binding_id) DO UPDATE SET data = excluded.data`, binding.InstanceID, binding.BindingID, data)
+	return err
+}
+
+func (s *sqlStore) DeleteBinding(instanceID string, bindingID string) error {
+	return deleted(s.exec(`DELETE FROM bindings WHERE instance_id = ? AND binding_id = ?`, instanceID, bindingID))
+}
+
+func (s *sqlStore) LockInstance(lock *InstanceLock) error {
+	data, err := marshal(lock)
+	if err != nil {
+		return err
+	}
+
+	// the lock is only taken over from the same owner or after it expired
+	result, err := s.exec(`INSERT INTO instance_locks (instance_id, owner, expires, data) VALUES (?, ?, ?, ?)
+		ON CONFLICT (instance_id) DO UPDATE SET owner = excluded.owner, expires = excluded.expires, data = excluded.data
+		WHERE instance_locks.owner = excluded.owner OR instance_locks.expires <= ?`,
+		lock.InstanceID, lock.Owner, lock.Expires.UnixNano(), data, lock.Acquired.UnixNano())
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return ErrLocked
+	}
+	return nil
+}
+
+func (s *sqlStore) UnlockInstance(instanceID string, owner string) error {
+	return deleted(s.exec(`DELETE FROM instance_locks WHERE instance_id = ? AND owner = ?`, instanceID, owner))
+}
+
+func (s *sqlStore) AddDelivery(delivery *Delivery) error {
+	data, err := marshal(delivery)
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.exec(`INSERT INTO deliveries (data) VALUES (?)`, data); err != nil {
+		return err
+	}
+	_, err = s.exec(`DELETE FROM deliveries WHERE id <= (SELECT MAX(id) FROM deliveries) - ?`, maxDeliveries)
+	return err
+}
+
+func (s *sqlStore) Deliveries() ([]Delivery, error) {
+	deliveries := []Delivery{}
+	err := s.list(func(data []byte) error {
+		var delivery Delivery
+		err := json.Unmarshal(data, &delivery)
+		deliveries = append(deliveries, delivery)
+		return err
+	}, `SELECT data FROM deliveries ORDER BY id`)
+	return deliveries, err
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
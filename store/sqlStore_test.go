@@ -0,0 +1,171 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sklevenz/lookup-broker/landscape"
+	"github.com/stretchr/testify/assert"
+)
+
+func newSQLiteStore(t *testing.T) (Store, func()) {
+	dir, _ := ioutil.TempDir("", "store")
+	s, err := OpenDatabase("sqlite:" + filepath.Join(dir, "broker.db"))
+	assert.Nil(t, err)
+	return s, func() {
+		s.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestOpenDatabase(t *testing.T) {
+	_, err := OpenDatabase("mysql://localhost/broker")
+	assert.NotNil(t, err)
+
+	s, err := OpenDatabase("sqlite::memory:")
+	assert.Nil(t, err)
+	assert.Nil(t, s.Close())
+}
+
+func TestDialectRebind(t *testing.T) {
+	query := `SELECT data FROM bindings WHERE instance_id = ? AND binding_id = ?`
+	assert.Equal(t, query, sqliteDialect.rebind(query))
+	assert.Equal(t, `SELECT data FROM bindings WHERE instance_id = $1 AND binding_id = $2`, postgresDialect.rebind(query))
+}
+
+func TestSQLStoreMigrations(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "store")
+	defer os.RemoveAll(dir)
+	path := "sqlite:" + filepath.Join(dir, "broker.db")
+
+	s, err := OpenDatabase(path)
+	assert.Nil(t, err)
+	assert.Nil(t, s.SaveBinding(&Binding{InstanceID: "1", BindingID: "2", Selector: "aws"}))
+	assert.Nil(t, s.Close())
+
+	// reopening applies no migration twice and keeps the state
+	s, err = OpenDatabase(path)
+	assert.Nil(t, err)
+	defer s.Close()
+
+	var count int
+	assert.Nil(t, s.(*sqlStore).db.QueryRow(`SELECT COUNT(*) FROM schema_migrations`).Scan(&count))
+	assert.Equal(t, len(migrations), count)
+
+	binding, err := s.Binding("1", "2")
+	assert.Nil(t, err)
+	assert.Equal(t, "aws", binding.Selector)
+}
+
+func TestSQLStoreLandscapes(t *testing.T) {
+	s, done := newSQLiteStore(t)
+	defer done()
+
+	_, err := s.LandscapeVersion(0)
+	assert.Equal(t, ErrNotFound, err)
+
+	_, err = s.SaveLandscapes(document("a"), "admin", "put landscape a")
+	assert.Nil(t, err)
+	v2, err := s.SaveLandscapes(document("a", "b"), "admin", "put landscape b")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, v2.Number)
+
+	latest, err := s.LandscapeVersion(0)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, latest.Number)
+	assert.Equal(t, 2, len(latest.Document.Landscapes))
+
+	versions, err := s.LandscapeVersions()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(versions))
+	assert.Nil(t, versions[0].Document)
+
+	assert.Nil(t, s.AddLandscapeRevision(&landscape.Revision{Changes: []landscape.Change{{Type: landscape.Added, Name: "cf-1"}}, Landscapes: landscape.Landscapes{"cf-1": {}}}))
+	second := &landscape.Revision{}
+	assert.Nil(t, s.AddLandscapeRevision(second))
+	assert.Equal(t, int64(2), second.Number)
+	assert.Equal(t, ErrExists, s.AddLandscapeRevision(&landscape.Revision{}))
+
+	revisions, err := s.LandscapeRevisions()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(revisions))
+	assert.Nil(t, revisions[0].Changes)
+
+	revision, err := s.LandscapeRevision(1)
+	assert.Nil(t, err)
+	assert.Equal(t, "cf-1", revision.Changes[0].Name)
+
+	revision, err = s.LandscapeRevision(0)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), revision.Number)
+
+	assert.Nil(t, s.PutLandscapeRevision(&landscape.Revision{Number: 1, Commit: "replaced"}))
+	revision, err = s.LandscapeRevision(1)
+	assert.Nil(t, err)
+	assert.Equal(t, "replaced", revision.Commit)
+	revisions, _ = s.LandscapeRevisions()
+	assert.Equal(t, 2, len(revisions))
+}
+
+func TestSQLStoreInstancesAndBindings(t *testing.T) {
+	s, done := newSQLiteStore(t)
+	defer done()
+
+	assert.Nil(t, s.SaveInstance(&Instance{InstanceID: "1", ServiceID: "1", PlanID: "1.1", Parameters: map[string]interface{}{"a": "b"}}))
+	assert.Nil(t, s.SaveInstance(&Instance{InstanceID: "1", ServiceID: "1", PlanID: "1.2"}))
+
+	instance, err := s.Instance("1")
+	assert.Nil(t, err)
+	assert.Equal(t, "1.2", instance.PlanID)
+
+	instances, err := s.Instances()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(instances))
+
+	assert.Nil(t, s.SaveBinding(&Binding{InstanceID: "1", BindingID: "2", Selector: "aws"}))
+	bindings, err := s.Bindings()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(bindings))
+
+	assert.Nil(t, s.DeleteBinding("1", "2"))
+	assert.Equal(t, ErrNotFound, s.DeleteBinding("1", "2"))
+	_, err = s.Binding("1", "2")
+	assert.Equal(t, ErrNotFound, err)
+
+	assert.Nil(t, s.DeleteInstance("1"))
+	assert.Equal(t, ErrNotFound, s.DeleteInstance("1"))
+}
+
+func TestSQLStoreInstanceLocks(t *testing.T) {
+	s, done := newSQLiteStore(t)
+	defer done()
+	now := time.Now()
+
+	assert.Nil(t, s.LockInstance(&InstanceLock{InstanceID: "1", Owner: "a", Acquired: now, Expires: now.Add(time.Minute)}))
+	assert.Equal(t, ErrLocked, s.LockInstance(&InstanceLock{InstanceID: "1", Owner: "b", Acquired: now, Expires: now.Add(time.Minute)}))
+
+	assert.Equal(t, ErrNotFound, s.UnlockInstance("1", "b"))
+	assert.Nil(t, s.UnlockInstance("1", "a"))
+	assert.Nil(t, s.LockInstance(&InstanceLock{InstanceID: "1", Owner: "b", Acquired: now, Expires: now.Add(time.Minute)}))
+
+	later := now.Add(2 * time.Minute)
+	assert.Nil(t, s.LockInstance(&InstanceLock{InstanceID: "1", Owner: "c", Acquired: later, Expires: later.Add(time.Minute)}))
+	assert.Equal(t, ErrNotFound, s.UnlockInstance("1", "b"))
+}
+
+func TestSQLStoreDeliveries(t *testing.T) {
+	s, done := newSQLiteStore(t)
+	defer done()
+
+	for i := 0; i < maxDeliveries+5; i++ {
+		assert.Nil(t, s.AddDelivery(&Delivery{ID: "d", Attempt: i}))
+	}
+
+	deliveries, err := s.Deliveries()
+	assert.Nil(t, err)
+	assert.Equal(t, maxDeliveries, len(deliveries))
+	assert.Equal(t, maxDeliveries+4, deliveries[maxDeliveries-1].Attempt)
+}
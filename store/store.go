@@ -0,0 +1,177 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/sklevenz/lookup-broker/landscape"
+)
+
+var (
+	// ErrNotFound is returned if a requested entry does not exist
+	ErrNotFound = errors.New("not found")
+	// ErrLocked is returned if an instance is locked by another operation
+	ErrLocked = errors.New("locked")
+	// ErrExists is returned if a landscape revision is already recorded
+	ErrExists = errors.New("exists")
+)
+
+// LandscapeVersion is a version of the landscapes managed by the admin API
+type LandscapeVersion struct {
+	Number   int                 `json:"number"`
+	Created  time.Time           `json:"created"`
+	Author   string              `json:"author"`
+	Change   string              `json:"change"`
+	Document *landscape.Document `json:"document,omitempty"`
+}
+
+// Webhook is the endpoint notified about landscape changes of a binding
+type Webhook struct {
+	URL    string `json:"url"`
+	Secret string `json:"secret,omitempty"`
+}
+
+// Instance is a provisioned service instance
+type Instance struct {
+	InstanceID       string                 `json:"instance_id"`
+	ServiceID        string                 `json:"service_id"`
+	PlanID           string                 `json:"plan_id"`
+	OrganizationGUID string                 `json:"organization_guid,omitempty"`
+	SpaceGUID        string                 `json:"space_guid,omitempty"`
+	Context          map[string]interface{} `json:"context,omitempty"`
+	Parameters       map[string]interface{} `json:"parameters,omitempty"`
+	Created          time.Time              `json:"created"`
+	Updated          time.Time              `json:"updated"`
+	// Incomplete is set until the provision responds, an incomplete instance
+	// is left by a failed provision for the orphan mitigation of the platform
+	Incomplete bool `json:"incomplete,omitempty"`
+}
+
+// Binding is a service binding together with its lookup parameters
+type Binding struct {
+	InstanceID string                 `json:"instance_id"`
+	BindingID  string                 `json:"binding_id"`
+	ServiceID  string                 `json:"service_id"`
+	PlanID     string                 `json:"plan_id"`
+	Parameters map[string]interface{} `json:"parameters,omitempty"`
+	Selector   string                 `json:"selector"`
+	Webhook    *Webhook               `json:"webhook,omitempty"`
+	Created    time.Time              `json:"created"`
+	// Lineage lists the IDs of the rotated predecessors, the oldest first
+	Lineage []string `json:"lineage,omitempty"`
+	// ExpiresAt and RenewBefore are set if the plan limits the lifetime
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	RenewBefore *time.Time `json:"renew_before,omitempty"`
+	// Incomplete is set until the bind responds, see Instance.Incomplete
+	Incomplete bool `json:"incomplete,omitempty"`
+}
+
+// Delivery is an attempt to notify a webhook
+type Delivery struct {
+	ID         string    `json:"id"`
+	InstanceID string    `json:"instance_id"`
+	BindingID  string    `json:"binding_id"`
+	URL        string    `json:"url"`
+	Attempt    int       `json:"attempt"`
+	Status     int       `json:"status,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+// InstanceLock marks an operation in progress on a service instance. A lock
+// which is not released by its owner expires.
+type InstanceLock struct {
+	InstanceID string    `json:"instance_id"`
+	Owner      string    `json:"owner"`
+	Operation  string    `json:"operation"`
+	Acquired   time.Time `json:"acquired"`
+	Expires    time.Time `json:"expires"`
+}
+
+// Store persists the state of the broker
+type Store interface {
+	// LandscapeVersions returns all versions without documents in ascending order
+	LandscapeVersions() ([]LandscapeVersion, error)
+	// LandscapeVersion returns a version with its document, number 0 is the latest version
+	LandscapeVersion(number int) (*LandscapeVersion, error)
+	// SaveLandscapes stores document as new version
+	SaveLandscapes(document *landscape.Document, author string, change string) (*LandscapeVersion, error)
+	// PutLandscapeVersion stores version with its number and creation time,
+	// replacing a version with the same number
+	PutLandscapeVersion(version *LandscapeVersion) error
+	// AddLandscapeRevision appends to the history of landscape revisions and
+	// sets the number of revision to the next number of the history. It returns
+	// ErrExists if the latest revision has the same landscapes, as another
+	// broker recorded the change already.
+	AddLandscapeRevision(revision *landscape.Revision) error
+	// PutLandscapeRevision stores revision with its number, replacing a
+	// revision with the same number
+	PutLandscapeRevision(revision *landscape.Revision) error
+	// LandscapeRevisions returns the history of landscape revisions without
+	// changes and landscapes in ascending order
+	LandscapeRevisions() ([]landscape.Revision, error)
+	// LandscapeRevision returns a revision with its changes and landscapes,
+	// number 0 is the latest revision
+	LandscapeRevision(number int64) (*landscape.Revision, error)
+
+	// Instances returns all service instances
+	Instances() ([]Instance, error)
+	// Instance returns a service instance or ErrNotFound
+	Instance(instanceID string) (*Instance, error)
+	// SaveInstance creates or replaces a service instance
+	SaveInstance(instance *Instance) error
+	// DeleteInstance removes a service instance or returns ErrNotFound
+	DeleteInstance(instanceID string) error
+
+	// Bindings returns all bindings
+	Bindings() ([]Binding, error)
+	// Binding returns a binding or ErrNotFound
+	Binding(instanceID string, bindingID string) (*Binding, error)
+	// SaveBinding creates or replaces a binding
+	SaveBinding(binding *Binding) error
+	// DeleteBinding removes a binding or returns ErrNotFound
+	DeleteBinding(instanceID string, bindingID string) error
+
+	// LockInstance acquires the lock of an instance or returns ErrLocked if
+	// another owner holds a lock which has not expired
+	LockInstance(lock *InstanceLock) error
+	// UnlockInstance releases the lock of an instance held by owner
+	UnlockInstance(instanceID string, owner string) error
+
+	// AddDelivery appends to the webhook delivery log
+	AddDelivery(delivery *Delivery) error
+	// Deliveries returns the webhook delivery log, latest entry last
+	Deliveries() ([]Delivery, error)
+
+	// Close flushes and releases the store
+	Close() error
+}
+
+// Backuper is a store supporting backups while it is in use
+type Backuper interface {
+	// Backup writes a consistent copy of the store to w
+	Backup(w io.Writer) (int64, error)
+}
+
+// Compacter is a store which can release the space of deleted entries
+type Compacter interface {
+	// Compact rewrites the store without the space of deleted entries
+	Compact() error
+}
+
+// sameLandscapes compares landscapes by their JSON encoding, which is how
+// all stores keep them
+func sameLandscapes(a, b landscape.Landscapes) bool {
+	x, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	y, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(x, y)
+}
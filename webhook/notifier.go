@@ -0,0 +1,242 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sklevenz/lookup-broker/landscape"
+	"github.com/sklevenz/lookup-broker/store"
+)
+
+const (
+	// HeaderSignature carries the HMAC-SHA256 of the body keyed with the webhook secret
+	HeaderSignature string = "X-Lookup-Signature"
+	// HeaderDelivery carries the id of the delivery, identical for all attempts
+	HeaderDelivery string = "X-Lookup-Delivery"
+	// HeaderEvent carries the event type
+	HeaderEvent string = "X-Lookup-Event"
+
+	// EventLandscapesChanged is sent when the landscapes of a binding change
+	EventLandscapesChanged string = "landscapes.changed"
+
+	signaturePrefix string = "sha256="
+
+	defaultAttempts = 5
+	defaultBackoff  = time.Second
+	defaultTimeout  = 10 * time.Second
+)
+
+// Event is the body posted to a webhook
+type Event struct {
+	Event      string             `json:"event"`
+	InstanceID string             `json:"instance_id"`
+	BindingID  string             `json:"binding_id"`
+	Revision   int64              `json:"revision"`
+	Time       time.Time          `json:"time"`
+	Changes    []landscape.Change `json:"changes"`
+}
+
+// Notifier posts the landscape changes of each binding to its webhook
+type Notifier struct {
+	Store    store.Store
+	Client   *http.Client
+	Attempts int
+	Backoff  time.Duration
+
+	wg sync.WaitGroup
+}
+
+// NewNotifier creates a notifier for the webhooks of the bindings in s. Failed
+// deliveries are retried with exponential backoff. Webhooks are not posted to
+// addresses in denied and redirects are not followed.
+func NewNotifier(s store.Store, denied []*net.IPNet) *Notifier {
+	return &Notifier{
+		Store:    s,
+		Client:   newClient(denied),
+		Attempts: defaultAttempts,
+		Backoff:  defaultBackoff,
+	}
+}
+
+// newClient creates a client which checks every address it connects to, as
+// the host of a webhook may resolve to another address than at bind time.
+// A redirect is answered to the notifier as failed delivery.
+func newClient(denied []*net.IPNet) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: defaultTimeout,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			for _, network := range denied {
+				if ip != nil && network.Contains(ip) {
+					return fmt.Errorf("address %v is denied", host)
+				}
+			}
+			return nil
+		},
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// a proxy would connect to the webhook unchecked
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &http.Client{
+		Timeout:   defaultTimeout,
+		Transport: transport,
+		CheckRedirect: func(request *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// Sign returns the signature of body for secret as sent in HeaderSignature
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks signature of body for secret
+func Verify(secret string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, body)), []byte(signature))
+}
+
+// NewSecret generates a random webhook secret
+func NewSecret() string {
+	return randomHex(32)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// LandscapesChanged is a landscape.Listener notifying every binding whose
+// selected landscapes differ between before and after
+func (n *Notifier) LandscapesChanged(before, after *landscape.Set, revision landscape.Revision) {
+	bindings, err := n.Store.Bindings()
+	if err != nil {
+		log.Printf("Error: could not read bindings: %v", err)
+		return
+	}
+
+	now := time.Now()
+	for _, binding := range bindings {
+		// an incomplete binding was never handed out to the platform, the
+		// consumer of an expired binding waits for its rotation
+		if binding.Webhook == nil || binding.Incomplete || binding.ExpiresAt != nil && now.After(*binding.ExpiresAt) {
+			continue
+		}
+
+		selector, err := landscape.ParseSelector(binding.Selector)
+		if err != nil {
+			log.Printf("Error: binding %v: %v", binding.BindingID, err)
+			continue
+		}
+
+		changes := landscape.Diff(before.Landscapes.Filter(selector), after.Landscapes.Filter(selector))
+		if len(changes) == 0 {
+			continue
+		}
+
+		event := &Event{
+			Event:      EventLandscapesChanged,
+			InstanceID: binding.InstanceID,
+			BindingID:  binding.BindingID,
+			Revision:   revision.Number,
+			Time:       time.Now().UTC(),
+			Changes:    changes,
+		}
+
+		n.wg.Add(1)
+		go func(binding store.Binding) {
+			defer n.wg.Done()
+			n.deliver(&binding, event)
+		}(binding)
+	}
+}
+
+// Close waits until all pending deliveries are finished
+func (n *Notifier) Close() {
+	n.wg.Wait()
+}
+
+func (n *Notifier) deliver(binding *store.Binding, event *Event) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Error: %v", err)
+		return
+	}
+
+	id := randomHex(16)
+	backoff := n.Backoff
+
+	for attempt := 1; attempt <= n.Attempts; attempt++ {
+		delivery := &store.Delivery{
+			ID:         id,
+			InstanceID: binding.InstanceID,
+			BindingID:  binding.BindingID,
+			URL:        binding.Webhook.URL,
+			Attempt:    attempt,
+			Time:       time.Now().UTC(),
+		}
+
+		delivery.Status, err = n.post(binding.Webhook, id, body)
+		if err != nil {
+			delivery.Error = err.Error()
+		}
+		if err := n.Store.AddDelivery(delivery); err != nil {
+			log.Printf("Error: could not log delivery %v: %v", id, err)
+		}
+
+		if err == nil {
+			return
+		}
+
+		log.Printf("Error: delivery %v attempt %v to %v: %v", id, attempt, binding.Webhook.URL, err)
+		if attempt < n.Attempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
+
+func (n *Notifier) post(webhook *store.Webhook, id string, body []byte) (int, error) {
+	request, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(HeaderEvent, EventLandscapesChanged)
+	request.Header.Set(HeaderDelivery, id)
+	request.Header.Set(HeaderSignature, Sign(webhook.Secret, body))
+
+	response, err := n.Client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, fmt.Errorf("HTTP Status: (%v)", response.StatusCode)
+	}
+	return response.StatusCode, nil
+}
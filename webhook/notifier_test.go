@@ -0,0 +1,157 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sklevenz/lookup-broker/landscape"
+	"github.com/sklevenz/lookup-broker/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func set(landscapes landscape.Landscapes) *landscape.Set {
+	return &landscape.Set{Landscapes: landscapes}
+}
+
+func TestSign(t *testing.T) {
+	signature := Sign("secret", []byte("body"))
+	assert.Equal(t, "sha256=dc46983557fea127b43af721467eb9b3fde2338fe3e14f51952aa8478c13d355", signature)
+	assert.True(t, Verify("secret", []byte("body"), signature))
+	assert.False(t, Verify("other", []byte("body"), signature))
+	assert.NotEqual(t, NewSecret(), NewSecret())
+}
+
+func TestLandscapesChanged(t *testing.T) {
+	var mutex sync.Mutex
+	var events []Event
+	calls := 0
+
+	consumer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		body, _ := ioutil.ReadAll(r.Body)
+		assert.True(t, Verify("secret", body, r.Header.Get(HeaderSignature)))
+		assert.Equal(t, EventLandscapesChanged, r.Header.Get(HeaderEvent))
+		assert.NotEmpty(t, r.Header.Get(HeaderDelivery))
+
+		var event Event
+		assert.Nil(t, json.Unmarshal(body, &event))
+		events = append(events, event)
+	}))
+	defer consumer.Close()
+
+	s := store.NewMemoryStore()
+	s.SaveBinding(&store.Binding{InstanceID: "1", BindingID: "aws", Selector: "aws", Webhook: &store.Webhook{URL: consumer.URL, Secret: "secret"}})
+	s.SaveBinding(&store.Binding{InstanceID: "1", BindingID: "gcp", Selector: "gcp", Webhook: &store.Webhook{URL: consumer.URL, Secret: "secret"}})
+	s.SaveBinding(&store.Binding{InstanceID: "1", BindingID: "none", Selector: ""})
+	expired := time.Now().Add(-time.Minute)
+	s.SaveBinding(&store.Binding{InstanceID: "1", BindingID: "expired", Selector: "aws", Webhook: &store.Webhook{URL: consumer.URL, Secret: "secret"}, ExpiresAt: &expired})
+	s.SaveBinding(&store.Binding{InstanceID: "1", BindingID: "incomplete", Selector: "aws", Webhook: &store.Webhook{URL: consumer.URL, Secret: "secret"}, Incomplete: true})
+
+	notifier := NewNotifier(s, nil)
+	notifier.Backoff = time.Millisecond
+
+	before := landscape.Landscapes{
+		"a": {CloudController: "https://api.a.example.com", Labels: []string{"aws"}},
+		"b": {CloudController: "https://api.b.example.com", Labels: []string{"gcp"}},
+	}
+	after := landscape.Landscapes{
+		"a": {CloudController: "https://api.a2.example.com", Labels: []string{"aws"}},
+		"b": {CloudController: "https://api.b.example.com", Labels: []string{"gcp"}},
+	}
+
+	notifier.LandscapesChanged(set(before), set(after), landscape.Revision{Number: 1, Changes: landscape.Diff(before, after)})
+	notifier.Close()
+
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, "aws", events[0].BindingID)
+	assert.Equal(t, int64(1), events[0].Revision)
+	assert.Equal(t, []landscape.Change{{Type: landscape.Modified, Name: "a", Before: &landscape.Landscape{CloudController: "https://api.a.example.com", Labels: []string{"aws"}}, After: &landscape.Landscape{CloudController: "https://api.a2.example.com", Labels: []string{"aws"}}, Fields: []landscape.FieldChange{{Field: "cloudcontroller", Before: "https://api.a.example.com", After: "https://api.a2.example.com"}}}}, events[0].Changes)
+
+	deliveries, err := s.Deliveries()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(deliveries))
+	assert.Equal(t, 1, deliveries[0].Attempt)
+	assert.Equal(t, http.StatusServiceUnavailable, deliveries[0].Status)
+	assert.NotEmpty(t, deliveries[0].Error)
+	assert.Equal(t, 2, deliveries[1].Attempt)
+	assert.Equal(t, http.StatusOK, deliveries[1].Status)
+	assert.Equal(t, deliveries[0].ID, deliveries[1].ID)
+}
+
+func TestLandscapesChangedGivesUp(t *testing.T) {
+	s := store.NewMemoryStore()
+	s.SaveBinding(&store.Binding{InstanceID: "1", BindingID: "2", Webhook: &store.Webhook{URL: "http://127.0.0.1:1/unreachable", Secret: "secret"}})
+
+	notifier := NewNotifier(s, nil)
+	notifier.Attempts = 3
+	notifier.Backoff = time.Millisecond
+
+	after := landscape.Landscapes{"a": {CloudController: "https://api.a.example.com"}}
+	notifier.LandscapesChanged(set(landscape.Landscapes{}), set(after), landscape.Revision{Number: 1, Changes: landscape.Diff(landscape.Landscapes{}, after)})
+	notifier.Close()
+
+	deliveries, err := s.Deliveries()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(deliveries))
+	assert.Equal(t, 0, deliveries[2].Status)
+	assert.NotEmpty(t, deliveries[2].Error)
+}
+
+func TestLandscapesChangedDeniedNetworks(t *testing.T) {
+	var hits int32
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+	}))
+	defer internal.Close()
+
+	// a consumer outside the denied network redirecting to the internal service
+	consumer := httptest.NewUnstartedServer(http.RedirectHandler(internal.URL+"/latest/meta-data", http.StatusFound))
+	listener, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Skip("no listener on 127.0.0.2:", err)
+	}
+	consumer.Listener = listener
+	consumer.Start()
+	defer consumer.Close()
+
+	s := store.NewMemoryStore()
+	s.SaveBinding(&store.Binding{InstanceID: "1", BindingID: "redirect", Webhook: &store.Webhook{URL: consumer.URL, Secret: "secret"}})
+	s.SaveBinding(&store.Binding{InstanceID: "1", BindingID: "internal", Webhook: &store.Webhook{URL: internal.URL, Secret: "secret"}})
+
+	_, loopback, _ := net.ParseCIDR("127.0.0.1/32")
+	notifier := NewNotifier(s, []*net.IPNet{loopback})
+	notifier.Attempts = 1
+
+	after := landscape.Landscapes{"a": {CloudController: "https://api.a.example.com"}}
+	notifier.LandscapesChanged(set(landscape.Landscapes{}), set(after), landscape.Revision{Number: 1, Changes: landscape.Diff(landscape.Landscapes{}, after)})
+	notifier.Close()
+
+	assert.Equal(t, int32(0), atomic.LoadInt32(&hits))
+	deliveries, err := s.Deliveries()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(deliveries))
+	for _, delivery := range deliveries {
+		switch delivery.BindingID {
+		case "redirect":
+			assert.Equal(t, http.StatusFound, delivery.Status)
+		case "internal":
+			assert.Equal(t, 0, delivery.Status)
+			assert.Contains(t, delivery.Error, "address 127.0.0.1 is denied")
+		}
+	}
+}